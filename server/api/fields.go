@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"packet-repackage/database"
+	"packet-repackage/engine"
 	"packet-repackage/models"
 
 	"github.com/gin-gonic/gin"
@@ -19,24 +20,35 @@ func ListFields(c *gin.Context) {
 func GetField(c *gin.Context) {
 	id := c.Param("id")
 	var field models.Field
-	
+
 	if err := database.DB.First(&field, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Field not found"})
 		return
 	}
-	
+
 	c.JSON(http.StatusOK, gin.H{"data": field})
 }
 
 // CreateField creates a new field definition
 func CreateField(c *gin.Context) {
 	var field models.Field
-	
+
 	if err := c.ShouldBindJSON(&field); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if err := engine.ValidateAnchor(field.Anchor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if field.LengthOf != "" {
+		if err := engine.ValidateLengthRegion(field.LengthOf); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := database.DB.Create(&field).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -49,7 +61,7 @@ func CreateField(c *gin.Context) {
 func UpdateField(c *gin.Context) {
 	id := c.Param("id")
 	var field models.Field
-	
+
 	if err := database.DB.First(&field, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Field not found"})
 		return
@@ -66,6 +78,21 @@ func UpdateField(c *gin.Context) {
 	field.Offset = updates.Offset
 	field.Length = updates.Length
 	field.Type = updates.Type
+	field.Anchor = updates.Anchor
+	field.LengthOf = updates.LengthOf
+	field.LengthAdjust = updates.LengthAdjust
+	field.LittleEndian = updates.LittleEndian
+
+	if err := engine.ValidateAnchor(field.Anchor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if field.LengthOf != "" {
+		if err := engine.ValidateLengthRegion(field.LengthOf); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
 	if err := database.DB.Save(&field).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -78,7 +105,7 @@ func UpdateField(c *gin.Context) {
 // DeleteField deletes a field
 func DeleteField(c *gin.Context) {
 	id := c.Param("id")
-	
+
 	if err := database.DB.Delete(&models.Field{}, id).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
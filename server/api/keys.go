@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"packet-repackage/database"
+	"packet-repackage/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyRequest creates or updates a secret key. Value is write-only.
+type KeyRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Value       string `json:"value"`    // Key material, empty on update to keep the current key
+	Encoding    string `json:"encoding"` // text (default), hex or base64
+}
+
+// ListKeys returns all secret keys (names only)
+func ListKeys(c *gin.Context) {
+	var keys []models.SecretKey
+	database.DB.Order("name ASC").Find(&keys)
+	c.JSON(http.StatusOK, gin.H{"data": keys})
+}
+
+// CreateKey stores a new secret key
+func CreateKey(c *gin.Context) {
+	var req KeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" || req.Value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key name and value are required"})
+		return
+	}
+
+	material, err := decodeKey(req.Value, req.Encoding)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key := models.SecretKey{
+		Name:        req.Name,
+		Description: req.Description,
+		Key:         material,
+		Size:        len(material),
+	}
+	if err := database.DB.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusCreated, gin.H{"data": key})
+}
+
+// UpdateKey renames, re-describes or rotates a secret key
+func UpdateKey(c *gin.Context) {
+	id := c.Param("id")
+	var key models.SecretKey
+
+	if err := database.DB.First(&key, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+
+	var req KeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name != "" {
+		key.Name = req.Name
+	}
+	key.Description = req.Description
+	if req.Value != "" {
+		material, err := decodeKey(req.Value, req.Encoding)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		key.Key = material
+		key.Size = len(material)
+	}
+
+	if err := database.DB.Save(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"data": key})
+}
+
+// DeleteKey deletes a secret key
+func DeleteKey(c *gin.Context) {
+	id := c.Param("id")
+
+	// Hard delete so the key material doesn't linger and the name can be reused
+	if err := database.DB.Unscoped().Delete(&models.SecretKey{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"message": "Key deleted successfully"})
+}
+
+func decodeKey(value, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "text":
+		return []byte(value), nil
+	case "hex":
+		return hex.DecodeString(value)
+	case "base64":
+		return base64.StdEncoding.DecodeString(value)
+	default:
+		return nil, errors.New("encoding must be text, hex or base64")
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"packet-repackage/database"
+	"packet-repackage/engine"
+	"packet-repackage/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListLookupTables returns all lookup tables (without entries)
+func ListLookupTables(c *gin.Context) {
+	var tables []models.LookupTable
+	database.DB.Order("name ASC").Find(&tables)
+	c.JSON(http.StatusOK, gin.H{"data": tables})
+}
+
+// GetLookupTable returns a lookup table with its entries
+func GetLookupTable(c *gin.Context) {
+	id := c.Param("id")
+	var table models.LookupTable
+
+	if err := database.DB.Preload("Entries", func(db *gorm.DB) *gorm.DB {
+		return db.Order("key ASC")
+	}).First(&table, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lookup table not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": table})
+}
+
+// CreateLookupTable creates a new lookup table, optionally with entries
+func CreateLookupTable(c *gin.Context) {
+	var table models.LookupTable
+
+	if err := c.ShouldBindJSON(&table); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateMissAction(&table); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := database.DB.Create(&table).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusCreated, gin.H{"data": table})
+}
+
+// UpdateLookupTable updates the settings of a lookup table (entries are managed separately)
+func UpdateLookupTable(c *gin.Context) {
+	id := c.Param("id")
+	var table models.LookupTable
+
+	if err := database.DB.First(&table, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lookup table not found"})
+		return
+	}
+
+	var updates models.LookupTable
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateMissAction(&updates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update fields
+	table.Name = updates.Name
+	table.Description = updates.Description
+	table.MissAction = updates.MissAction
+	table.DefaultValue = updates.DefaultValue
+
+	if err := database.DB.Save(&table).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"data": table})
+}
+
+// DeleteLookupTable deletes a lookup table and its entries
+func DeleteLookupTable(c *gin.Context) {
+	id := c.Param("id")
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("table_id = ?", id).Delete(&models.LookupEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&models.LookupTable{}, id).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"message": "Lookup table deleted successfully"})
+}
+
+// SetLookupEntry adds an entry or updates the value of an existing key
+func SetLookupEntry(c *gin.Context) {
+	table, ok := findLookupTable(c)
+	if !ok {
+		return
+	}
+
+	var entry models.LookupEntry
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if entry.Key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entry key is required"})
+		return
+	}
+	entry.TableID = table.ID
+
+	if err := upsertLookupEntries(database.DB, []models.LookupEntry{entry}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"data": entry})
+}
+
+// DeleteLookupEntry removes an entry from a lookup table
+func DeleteLookupEntry(c *gin.Context) {
+	id := c.Param("id")
+	entryID := c.Param("entry_id")
+
+	result := database.DB.Unscoped().Where("table_id = ?", id).Delete(&models.LookupEntry{}, entryID)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"message": "Entry deleted successfully"})
+}
+
+// ImportLookupEntries loads "key,value" rows from an uploaded CSV file ("file" form field).
+// Existing keys are updated; with replace=true all other entries are removed.
+// A first row of "key,value" is treated as a header.
+func ImportLookupEntries(c *gin.Context) {
+	table, ok := findLookupTable(c)
+	if !ok {
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is required: " + err.Error()})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	entries, err := parseLookupCSV(file, table.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if c.Query("replace") == "true" {
+			if err := tx.Unscoped().Where("table_id = ?", table.ID).Delete(&models.LookupEntry{}).Error; err != nil {
+				return err
+			}
+		}
+		return upsertLookupEntries(tx, entries)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import entries: " + err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Entries imported successfully",
+		"imported": len(entries),
+	})
+}
+
+// ExportLookupEntries downloads the entries of a lookup table as CSV
+func ExportLookupEntries(c *gin.Context) {
+	table, ok := findLookupTable(c)
+	if !ok {
+		return
+	}
+
+	var entries []models.LookupEntry
+	database.DB.Where("table_id = ?", table.ID).Order("key ASC").Find(&entries)
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", table.Name+".csv"))
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"key", "value"})
+	for _, entry := range entries {
+		writer.Write([]string{entry.Key, entry.Value})
+	}
+	writer.Flush()
+}
+
+func findLookupTable(c *gin.Context) (*models.LookupTable, bool) {
+	var table models.LookupTable
+	if err := database.DB.First(&table, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lookup table not found"})
+		return nil, false
+	}
+	return &table, true
+}
+
+func validateMissAction(table *models.LookupTable) error {
+	switch table.MissAction {
+	case "":
+		table.MissAction = engine.LookupMissKeep
+	case engine.LookupMissKeep, engine.LookupMissDefault, engine.LookupMissDrop:
+	default:
+		return errors.New("miss_action must be keep, default or drop")
+	}
+	return nil
+}
+
+func parseLookupCSV(r io.Reader, tableID uint) ([]models.LookupEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []models.LookupEntry
+	seen := make(map[string]int)
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line++
+
+		if line == 1 && len(record) >= 2 && strings.EqualFold(record[0], "key") && strings.EqualFold(record[1], "value") {
+			continue
+		}
+		if len(record) < 2 || record[0] == "" {
+			return nil, fmt.Errorf("line %d: expected key,value", line)
+		}
+
+		// Last occurrence of a key wins
+		if i, dup := seen[record[0]]; dup {
+			entries[i].Value = record[1]
+			continue
+		}
+		seen[record[0]] = len(entries)
+		entries = append(entries, models.LookupEntry{TableID: tableID, Key: record[0], Value: record[1]})
+	}
+
+	return entries, nil
+}
+
+func upsertLookupEntries(db *gorm.DB, entries []models.LookupEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "table_id"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).CreateInBatches(entries, 500).Error
+}
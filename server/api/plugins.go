@@ -0,0 +1,116 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"packet-repackage/database"
+	"packet-repackage/engine"
+	"packet-repackage/models"
+	"packet-repackage/nfqueue"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxPluginSize limits uploaded WebAssembly modules
+const maxPluginSize = 16 << 20
+
+// ListPlugins returns all uploaded plugins (without module bytes)
+func ListPlugins(c *gin.Context) {
+	var plugins []models.Plugin
+	database.DB.Omit("module").Order("name ASC").Find(&plugins)
+	c.JSON(http.StatusOK, gin.H{"data": plugins})
+}
+
+// GetPlugin returns a specific plugin
+func GetPlugin(c *gin.Context) {
+	id := c.Param("id")
+	var plugin models.Plugin
+
+	if err := database.DB.Omit("module").First(&plugin, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": plugin})
+}
+
+// UploadPlugin stores a WebAssembly module, replacing any plugin with the same name.
+// Expects a multipart form with "name", optional "description" and the module in "file".
+func UploadPlugin(c *gin.Context) {
+	name := c.PostForm("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plugin name is required"})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Module file is required: " + err.Error()})
+		return
+	}
+	if fileHeader.Size > maxPluginSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Module file is too large"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	module, err := io.ReadAll(io.LimitReader(file, maxPluginSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := engine.ValidatePlugin(module); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plugin: " + err.Error()})
+		return
+	}
+
+	sum := sha256.Sum256(module)
+
+	// Replace the module if the name already exists
+	var plugin models.Plugin
+	database.DB.Where("name = ?", name).First(&plugin)
+	plugin.Name = name
+	plugin.Description = c.PostForm("description")
+	plugin.Module = module
+	plugin.Size = len(module)
+	plugin.SHA256 = hex.EncodeToString(sum[:])
+
+	if err := database.DB.Save(&plugin).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusCreated, gin.H{"data": plugin})
+}
+
+// DeletePlugin deletes a plugin
+func DeletePlugin(c *gin.Context) {
+	id := c.Param("id")
+
+	// Hard delete so the name can be reused
+	if err := database.DB.Unscoped().Delete(&models.Plugin{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reloadConfig()
+	c.JSON(http.StatusOK, gin.H{"message": "Plugin deleted successfully"})
+}
+
+// reloadConfig makes plugin, lookup table and key changes visible to the packet handler
+func reloadConfig() {
+	if err := nfqueue.ReloadConfig(); err != nil {
+		database.Logger.Error("Failed to reload configuration", zap.Error(err))
+	}
+}
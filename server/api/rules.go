@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"packet-repackage/database"
+	"packet-repackage/engine"
 	"packet-repackage/models"
 
 	"github.com/gin-gonic/gin"
@@ -37,6 +38,22 @@ func CreateRule(c *gin.Context) {
 		return
 	}
 
+	if err := engine.ValidateActions(rule.Actions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := engine.ValidateOutputOptions(rule.OutputOptions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rule.Stream != "" {
+		if _, err := engine.ParseStreamConfig(rule.Stream); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	if err := database.DB.Create(&rule).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -61,13 +78,31 @@ func UpdateRule(c *gin.Context) {
 		return
 	}
 
+	if err := engine.ValidateActions(updates.Actions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := engine.ValidateOutputOptions(updates.OutputOptions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if updates.Stream != "" {
+		if _, err := engine.ParseStreamConfig(updates.Stream); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// Update fields
 	rule.Name = updates.Name
 	rule.Enabled = updates.Enabled
 	rule.MatchCondition = updates.MatchCondition
+	rule.ConditionScript = updates.ConditionScript
 	rule.Actions = updates.Actions
 	rule.OutputOptions = updates.OutputOptions
 	rule.Priority = updates.Priority
+	rule.Stream = updates.Stream
 
 	if err := database.DB.Save(&rule).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
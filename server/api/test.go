@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"packet-repackage/database"
 	"packet-repackage/engine"
 	"packet-repackage/models"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -14,6 +17,8 @@ import (
 type TestRequest struct {
 	HexPacket string `json:"hex_packet" binding:"required"`
 	RuleID    uint   `json:"rule_id"`
+	FaultSeed int64  `json:"fault_seed"` // Replays the fault injection of a logged packet (0 = new seed)
+	MTU       int    `json:"mtu"`        // Egress MTU to check the modified packet against (0 = no check)
 }
 
 // TestResponse represents a test mode response
@@ -23,8 +28,20 @@ type TestResponse struct {
 	MatchedRule     *models.Rule           `json:"matched_rule"`
 	ModifiedFields  map[string]interface{} `json:"modified_fields"`
 	ModifiedPacket  string                 `json:"modified_packet"`
+	Verdict         string                 `json:"verdict,omitempty"`       // Drop/reject verdict set by the rule's actions
+	RejectPacket    string                 `json:"reject_packet,omitempty"` // Reply that a reject verdict would send
+	Fragments       []string               `json:"fragments,omitempty"`     // IPv4 fragments sent instead of an oversized packet
+	Mirrors         []engine.MirrorRequest `json:"mirrors,omitempty"`       // Copies the rule would send (not sent in test mode)
+	DelayMs         int                    `json:"delay_ms,omitempty"`      // Time the packet would be held before forwarding
+	FaultSeed       int64                  `json:"fault_seed,omitempty"`    // Seed used for fault injection
+	Faults          []string               `json:"faults,omitempty"`        // Faults applied to the modified packet
+	Duplicates      int                    `json:"duplicates,omitempty"`    // Extra copies a duplicate fault would send
+	Mark            string                 `json:"mark,omitempty"`          // Mark the packet would get when accepted
 	ProcessingSteps []string               `json:"processing_steps"`
 	Error           string                 `json:"error,omitempty"`
+	ErrorPolicy     string                 `json:"error_policy,omitempty"` // How a failed action was handled: skipped, aborted or dropped
+	Skipped         []string               `json:"skipped,omitempty"`      // Errors of actions skipped by their on_error policy
+	Warnings        []string               `json:"warnings,omitempty"`     // Problems that didn't stop processing, e.g. a length that couldn't be fixed
 
 	// 5-Tuple info
 	SrcIP    string `json:"src_ip"`
@@ -64,22 +81,18 @@ func TestRule(c *gin.Context) {
 		c.JSON(http.StatusOK, response)
 		return
 	}
+	// Variable changes made while testing must not affect live traffic
+	ctx.DryRun = true
+	ctx.FaultSeed = req.FaultSeed
 	response.ProcessingSteps = append(response.ProcessingSteps, "Packet parsed successfully")
 
-	// Populate 5-tuple info
-	if ctx.IPv4Layer != nil {
-		response.SrcIP = ctx.IPv4Layer.SrcIP.String()
-		response.DstIP = ctx.IPv4Layer.DstIP.String()
-		response.Protocol = ctx.IPv4Layer.Protocol.String()
-	}
-	if ctx.TCPLayer != nil {
-		response.SrcPort = int(ctx.TCPLayer.SrcPort)
-		response.DstPort = int(ctx.TCPLayer.DstPort)
-		response.Protocol = "TCP"
-	} else if ctx.UDPLayer != nil {
-		response.SrcPort = int(ctx.UDPLayer.SrcPort)
-		response.DstPort = int(ctx.UDPLayer.DstPort)
-		response.Protocol = "UDP"
+	// Populate 5-tuple info (IPv4 or IPv6)
+	if tuple := ctx.FiveTuple(); tuple.SrcIP != "" {
+		response.SrcIP = tuple.SrcIP
+		response.DstIP = tuple.DstIP
+		response.SrcPort = tuple.SrcPort
+		response.DstPort = tuple.DstPort
+		response.Protocol = tuple.Protocol
 	}
 
 	// Get all fields
@@ -117,7 +130,7 @@ func TestRule(c *gin.Context) {
 		database.DB.Where("enabled = ?", true).Order("priority DESC").Find(&rules)
 
 		for _, r := range rules {
-			matched, err := engine.EvaluateCondition(r.MatchCondition, ctx, fields)
+			matched, err := engine.MatchRule(r, ctx, fields)
 			if err != nil {
 				continue
 			}
@@ -138,7 +151,7 @@ func TestRule(c *gin.Context) {
 	response.ProcessingSteps = append(response.ProcessingSteps, "Matched rule: "+rule.Name)
 
 	// Evaluate condition
-	matched, err := engine.EvaluateCondition(rule.MatchCondition, ctx, fields)
+	matched, err := engine.MatchRule(rule, ctx, fields)
 	if err != nil {
 		response.Error = "Failed to evaluate condition: " + err.Error()
 		c.JSON(http.StatusOK, response)
@@ -162,10 +175,20 @@ func TestRule(c *gin.Context) {
 	err = engine.ExecuteActions(rule.Actions, ctx)
 	if err != nil {
 		response.Error = "Failed to execute actions: " + err.Error()
+		response.ErrorPolicy = "aborted"
+		var actionErr *engine.ActionError
+		if errors.As(err, &actionErr) && actionErr.Policy == engine.OnErrorDrop {
+			response.ErrorPolicy = "dropped"
+			response.Verdict = engine.VerdictDrop
+		}
 		c.JSON(http.StatusOK, response)
 		return
 	}
 	response.ProcessingSteps = append(response.ProcessingSteps, "Executed rule actions")
+	if len(ctx.Skipped) > 0 {
+		response.ErrorPolicy = "skipped"
+		response.Skipped = ctx.Skipped
+	}
 
 	// Build modified fields comparison
 	for k, v := range ctx.Fields {
@@ -177,6 +200,41 @@ func TestRule(c *gin.Context) {
 		}
 	}
 
+	response.Mirrors = ctx.Mirrors
+	response.DelayMs = int(ctx.Delay / time.Millisecond)
+	if ctx.Mark != nil {
+		response.Mark = ctx.Mark.String()
+	}
+
+	// Passed packets are forwarded as they came in
+	if ctx.Verdict == engine.VerdictPass {
+		response.Verdict = ctx.Verdict
+		response.ModifiedPacket = hex.EncodeToString(rawPacket)
+		response.ProcessingSteps = append(response.ProcessingSteps, "Packet passed unmodified by verdict: "+ctx.Verdict)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Dropped packets are not forwarded, so there is nothing to repackage
+	if ctx.Verdict != engine.VerdictAccept {
+		response.Verdict = ctx.Verdict
+		response.ProcessingSteps = append(response.ProcessingSteps, "Packet dropped by verdict: "+ctx.Verdict)
+
+		if engine.IsReject(ctx.Verdict) {
+			reply, err := engine.BuildRejectPacket(ctx)
+			if err != nil {
+				response.Error = "Failed to build reject reply: " + err.Error()
+				c.JSON(http.StatusOK, response)
+				return
+			}
+			response.RejectPacket = hex.EncodeToString(reply)
+			response.ProcessingSteps = append(response.ProcessingSteps, "Built reject reply packet")
+		}
+
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
 	// Repackage packet
 	modifiedPacket, err := engine.RepackagePacket(rule.OutputOptions, ctx, fields)
 	if err != nil {
@@ -184,8 +242,45 @@ func TestRule(c *gin.Context) {
 		c.JSON(http.StatusOK, response)
 		return
 	}
-	response.ModifiedPacket = hex.EncodeToString(modifiedPacket)
 	response.ProcessingSteps = append(response.ProcessingSteps, "Packet repackaged successfully")
+	response.Warnings = ctx.Warnings
+
+	// Fault injection works on the final bytes
+	if ctx.HasFaults() {
+		faults, err := engine.ApplyFaults(ctx, modifiedPacket)
+		if err != nil {
+			response.Error = "Failed to inject faults: " + err.Error()
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		modifiedPacket = faults.Packet
+		response.Faults = faults.Applied
+		response.Duplicates = faults.Duplicates
+		response.ProcessingSteps = append(response.ProcessingSteps, "Faults injected")
+	}
+	response.FaultSeed = ctx.FaultSeed
+	response.ModifiedPacket = hex.EncodeToString(modifiedPacket)
+
+	// Packets that grew past the egress MTU are fragmented, or refused when DF is set
+	ctx.MTU = req.MTU
+	sizing, err := engine.ApplyMTU(ctx, modifiedPacket)
+	response.Warnings = ctx.Warnings
+	if err != nil {
+		response.Error = "Failed to fit packet to MTU: " + err.Error()
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if sizing.Reply != nil {
+		response.Verdict = engine.VerdictFragNeeded
+		response.RejectPacket = hex.EncodeToString(sizing.Reply)
+		response.ProcessingSteps = append(response.ProcessingSteps, "Packet dropped by verdict: "+engine.VerdictFragNeeded)
+	}
+	for _, fragment := range sizing.Fragments {
+		response.Fragments = append(response.Fragments, hex.EncodeToString(fragment))
+	}
+	if len(sizing.Fragments) > 0 {
+		response.ProcessingSteps = append(response.ProcessingSteps, fmt.Sprintf("Packet fragmented into %d fragments", len(sizing.Fragments)))
+	}
 
 	c.JSON(http.StatusOK, response)
 }
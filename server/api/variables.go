@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"packet-repackage/engine"
+	"packet-repackage/nfqueue"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListVariables returns the current variables, optionally filtered by ?scope=
+func ListVariables(c *gin.Context) {
+	scope := c.Query("scope")
+	if !validVariableScope(scope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be global, rule or flow"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": engine.ListVariables(scope)})
+}
+
+// DeleteVariables resets variables matching ?scope= and ?name= (all variables if neither is given)
+func DeleteVariables(c *gin.Context) {
+	scope := c.Query("scope")
+	name := c.Query("name")
+	if !validVariableScope(scope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be global, rule or flow"})
+		return
+	}
+
+	removed := engine.DeleteVariables(scope, name)
+	if err := nfqueue.DeleteStoredVariables(scope, "", name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Variables deleted successfully",
+		"deleted": removed,
+	})
+}
+
+func validVariableScope(scope string) bool {
+	switch scope {
+	case "", engine.ScopeGlobal, engine.ScopeRule, engine.ScopeFlow:
+		return true
+	}
+	return false
+}
@@ -14,7 +14,7 @@ var Logger *zap.Logger
 // InitDatabase initializes the SQLite database and runs migrations
 func InitDatabase(dbPath string) error {
 	var err error
-	
+
 	// Open database connection
 	DB, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
 	if err != nil {
@@ -30,6 +30,11 @@ func InitDatabase(dbPath string) error {
 		&models.VlanConfigIP{},
 		&models.ProcessLog{},
 		&models.NFTRule{},
+		&models.Plugin{},
+		&models.LookupTable{},
+		&models.LookupEntry{},
+		&models.Variable{},
+		&models.SecretKey{},
 	)
 	if err != nil {
 		return err
@@ -62,6 +67,6 @@ func InitLogger(logPath string, logLevel string) error {
 	if err != nil {
 		return err
 	}
-	
+
 	return nil
 }
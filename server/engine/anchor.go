@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"fmt"
+	"packet-repackage/models"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Field anchors: the point of the packet a field's offset counts from. Anchoring on a
+// header instead of the packet start keeps fields in place across Ethernet and IP input,
+// IP options and IPv6 extension headers.
+const (
+	AnchorPacket    = "packet"    // Start of the packet (default)
+	AnchorNetwork   = "network"   // IPv4 or IPv6 header
+	AnchorTransport = "transport" // Header after IP, past any IPv6 extension headers
+	AnchorPayload   = "payload"   // Data after the TCP or UDP header
+)
+
+// ValidateAnchor checks a Field.Anchor
+func ValidateAnchor(anchor string) error {
+	switch anchor {
+	case "", AnchorPacket, AnchorNetwork, AnchorTransport, AnchorPayload:
+		return nil
+	}
+	return fmt.Errorf("anchor must be packet, network, transport or payload")
+}
+
+// UpperProtocol returns the protocol carried by the IP packet; for IPv6 that is the next
+// header after any extension headers
+func (ctx *PacketContext) UpperProtocol() layers.IPProtocol {
+	if ctx.IPv4Layer != nil {
+		return ctx.IPv4Layer.Protocol
+	}
+	if ctx.IPv6Layer == nil {
+		return 0
+	}
+
+	protocol := ctx.IPv6Layer.NextHeader
+	for _, layer := range ctx.Packet.Layers() {
+		switch ext := layer.(type) {
+		case *layers.IPv6HopByHop:
+			protocol = ext.NextHeader
+		case *layers.IPv6Routing:
+			protocol = ext.NextHeader
+		case *layers.IPv6Fragment:
+			protocol = ext.NextHeader
+		case *layers.IPv6Destination:
+			protocol = ext.NextHeader
+		}
+	}
+	return protocol
+}
+
+// transportLayer returns the first layer after the IP header and its extension headers
+func (ctx *PacketContext) transportLayer() gopacket.Layer {
+	network := false
+	for _, layer := range ctx.Packet.Layers() {
+		switch layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			network = true
+		case *layers.IPv6HopByHop, *layers.IPv6Routing, *layers.IPv6Fragment, *layers.IPv6Destination:
+		default:
+			if network {
+				return layer
+			}
+		}
+	}
+	return nil
+}
+
+// anchorOffset returns the position of an anchor in the packet, -1 if the packet lacks it
+func (ctx *PacketContext) anchorOffset(anchor string) int {
+	switch anchor {
+	case "", AnchorPacket:
+		return 0
+	case AnchorNetwork:
+		if ctx.IPv4Layer != nil {
+			return ctx.LayerOffset(ctx.IPv4Layer)
+		}
+		return ctx.LayerOffset(ctx.IPv6Layer)
+	case AnchorTransport:
+		return ctx.LayerOffset(ctx.transportLayer())
+	case AnchorPayload:
+		var offset int
+		switch {
+		case ctx.TCPLayer != nil:
+			offset = ctx.LayerOffset(ctx.TCPLayer)
+			if offset >= 0 {
+				offset += int(ctx.TCPLayer.DataOffset) * 4
+			}
+		case ctx.UDPLayer != nil:
+			offset = ctx.LayerOffset(ctx.UDPLayer)
+			if offset >= 0 {
+				offset += 8
+			}
+		default:
+			return -1
+		}
+		if offset > len(ctx.RawPacket) {
+			return -1
+		}
+		return offset
+	}
+	return -1
+}
+
+// resolveField returns field with its offset counted from the packet start. Fields whose
+// anchor is missing from this packet are reported as unavailable.
+func (ctx *PacketContext) resolveField(field models.Field) (models.Field, bool) {
+	if field.Type == "builtin" || field.Anchor == "" || field.Anchor == AnchorPacket {
+		return field, true
+	}
+
+	base := ctx.anchorOffset(field.Anchor)
+	if base < 0 {
+		return field, false
+	}
+	field.Offset += base
+	field.Anchor = ""
+	return field, true
+}
+
+// resolveFields resolves all fields, leaving out those not present in this packet
+func (ctx *PacketContext) resolveFields(fields []models.Field) []models.Field {
+	resolved := make([]models.Field, 0, len(fields))
+	for _, field := range fields {
+		if f, ok := ctx.resolveField(field); ok {
+			resolved = append(resolved, f)
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"packet-repackage/models"
+	"strings"
+	"sync"
+)
+
+// Anonymization uses Crypto-PAn (Fan, Xu, Ammar, Moon 2004): each output bit is the input
+// bit XORed with an AES-derived bit that depends only on the preceding input bits, so
+// addresses sharing a prefix keep sharing a prefix of the same length. The same key
+// always yields the same pseudonym. MAC addresses are treated as 48-bit prefixes whose
+// individual/group and universal/local bits are kept; multicast/broadcast MACs are left
+// alone so they keep their meaning.
+
+// cryptoPAn holds the keyed state for one key
+type cryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+var (
+	anonymizersMu sync.Mutex
+	anonymizers   = map[string]*cryptoPAn{} // Key name -> state, reset by SetKeys
+)
+
+// newCryptoPAn derives the AES key and pad from a 32-byte secret; other lengths are hashed to 32 bytes
+func newCryptoPAn(secret []byte) (*cryptoPAn, error) {
+	if len(secret) != 32 {
+		sum := sha256.Sum256(secret)
+		secret = sum[:]
+	}
+
+	block, err := aes.NewCipher(secret[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cryptoPAn{block: block}
+	block.Encrypt(c.pad[:], secret[16:32])
+	return c, nil
+}
+
+// anonymize maps an address of up to 16 bytes to its pseudonym
+func (c *cryptoPAn) anonymize(addr []byte) []byte {
+	result := make([]byte, len(addr))
+	var input, output [aes.BlockSize]byte
+
+	for i := 0; i < len(addr)*8; i++ {
+		// Input block: the first i bits of the address, the rest from the pad
+		input = c.pad
+		full := i / 8
+		copy(input[:full], addr[:full])
+		if rem := i % 8; rem > 0 {
+			mask := byte(0xff << (8 - rem))
+			input[full] = addr[full]&mask | c.pad[full]&^mask
+		}
+
+		c.block.Encrypt(output[:], input[:])
+
+		bit := (addr[i/8] >> (7 - i%8)) & 1
+		result[i/8] |= (bit ^ output[0]>>7) << (7 - i%8)
+	}
+
+	return result
+}
+
+// anonymizerFor returns the Crypto-PAn state for a key from the key store
+func anonymizerFor(keyName string) (*cryptoPAn, error) {
+	anonymizersMu.Lock()
+	defer anonymizersMu.Unlock()
+
+	if c, ok := anonymizers[keyName]; ok {
+		return c, nil
+	}
+
+	keysMu.RLock()
+	secret, ok := keys[keyName]
+	keysMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key not found: %s", keyName)
+	}
+
+	c, err := newCryptoPAn(secret)
+	if err != nil {
+		return nil, err
+	}
+	anonymizers[keyName] = c
+	return c, nil
+}
+
+// resetAnonymizers drops cached state after the keys change
+func resetAnonymizers() {
+	anonymizersMu.Lock()
+	anonymizers = map[string]*cryptoPAn{}
+	anonymizersMu.Unlock()
+}
+
+// executeAnonymize replaces an IPv4, IPv6 or MAC field with its pseudonym under the key named by action.Value
+func executeAnonymize(action Action, ctx *PacketContext) error {
+	c, err := anonymizerFor(action.Value)
+	if err != nil {
+		return err
+	}
+
+	field, ok := ctx.fieldDef(action.Field)
+	if !ok {
+		return fmt.Errorf("field not found: %s", action.Field)
+	}
+
+	value := ctx.Fields[action.Field]
+	if value == nil {
+		return fmt.Errorf("field %s has no value", action.Field)
+	}
+
+	result, err := anonymizeValue(c, value, field)
+	if err != nil {
+		return fmt.Errorf("cannot anonymize %s: %w", action.Field, err)
+	}
+
+	ctx.Fields[action.Field] = result
+	ctx.fixChecksums = true
+	return nil
+}
+
+// anonymizeValue anonymizes a field value, keeping its representation
+func anonymizeValue(c *cryptoPAn, value interface{}, field models.Field) (interface{}, error) {
+	switch field.Type {
+	case "hex":
+		raw, err := hex.DecodeString(toString(value))
+		if err != nil {
+			return nil, err
+		}
+		anonymized, err := anonymizeBytes(c, raw)
+		if err != nil {
+			return nil, err
+		}
+		return hex.EncodeToString(anonymized), nil
+
+	case "decimal":
+		if field.Length != 4 {
+			return nil, fmt.Errorf("decimal fields must be 4 bytes (IPv4)")
+		}
+		n, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("not a number: %v", value)
+		}
+		raw := make([]byte, 4)
+		binary.BigEndian.PutUint32(raw, uint32(n))
+		return int64(binary.BigEndian.Uint32(c.anonymize(raw))), nil
+
+	default:
+		// Textual addresses: string fields and builtins such as src_ip
+		return anonymizeText(c, strings.TrimSpace(toString(value)))
+	}
+}
+
+// anonymizeBytes anonymizes a binary IPv4 (4 bytes), MAC (6) or IPv6 (16) address
+func anonymizeBytes(c *cryptoPAn, raw []byte) ([]byte, error) {
+	switch len(raw) {
+	case 4, 16:
+		return c.anonymize(raw), nil
+	case 6:
+		if raw[0]&1 == 1 {
+			return raw, nil // Multicast or broadcast
+		}
+		// A unicast MAC must stay unicast (I/G bit) and keep its U/L bit
+		anonymized := c.anonymize(raw)
+		anonymized[0] = anonymized[0]&^0x03 | raw[0]&0x03
+		return anonymized, nil
+	default:
+		return nil, fmt.Errorf("%d bytes is not an IPv4, IPv6 or MAC address", len(raw))
+	}
+}
+
+func anonymizeText(c *cryptoPAn, text string) (string, error) {
+	if ip := net.ParseIP(text); ip != nil {
+		if v4 := ip.To4(); v4 != nil && !strings.Contains(text, ":") {
+			return net.IP(c.anonymize(v4)).String(), nil
+		}
+		return net.IP(c.anonymize(ip.To16())).String(), nil
+	}
+
+	if mac, err := net.ParseMAC(text); err == nil && len(mac) == 6 {
+		anonymized, _ := anonymizeBytes(c, mac)
+		return net.HardwareAddr(anonymized).String(), nil
+	}
+
+	return "", fmt.Errorf("%q is not an IP or MAC address", text)
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+
+	"packet-repackage/models"
+)
+
+func TestAnonymizeMACKeepsUnicast(t *testing.T) {
+	c, err := newCryptoPAn([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		mac := make([]byte, 6)
+		rng.Read(mac)
+		mac[0] &^= 0x01 // unicast, universal or local
+
+		got, err := anonymizeBytes(c, mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[0]&0x03 != mac[0]&0x03 {
+			t.Fatalf("%s -> %s changed the I/G or U/L bit", net.HardwareAddr(mac), net.HardwareAddr(got))
+		}
+	}
+
+	// Group addresses are left alone
+	for _, text := range []string{"ff:ff:ff:ff:ff:ff", "01:00:5e:00:00:01", "33:33:00:00:00:01"} {
+		mac, _ := net.ParseMAC(text)
+		got, _ := anonymizeBytes(c, mac)
+		if !bytes.Equal(got, mac) {
+			t.Errorf("%s -> %s", text, net.HardwareAddr(got))
+		}
+	}
+}
+
+func TestAnonymizeDeterministic(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	first, _ := newCryptoPAn(secret)
+	second, _ := newCryptoPAn(secret)
+	other, _ := newCryptoPAn([]byte("another key"))
+
+	tests := []struct {
+		value interface{}
+		field models.Field
+	}{
+		{"00:1a:2b:3c:4d:5e", models.Field{Type: "string"}},
+		{"02:1a:2b:3c:4d:5e", models.Field{Type: "string"}},
+		{"001a2b3c4d5e", models.Field{Type: "hex", Length: 6}},
+		{"192.0.2.1", models.Field{Type: "string"}},
+		{"2001:db8::1", models.Field{Type: "string"}},
+		{int64(0xc0000201), models.Field{Type: "decimal", Length: 4}},
+	}
+	for _, tt := range tests {
+		a, err := anonymizeValue(first, tt.value, tt.field)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.value, err)
+		}
+		b, _ := anonymizeValue(second, tt.value, tt.field)
+		if a != b {
+			t.Errorf("%v: %v and %v under the same key", tt.value, a, b)
+		}
+		if c, _ := anonymizeValue(other, tt.value, tt.field); c == a {
+			t.Errorf("%v: %v under both keys", tt.value, a)
+		}
+		if a == tt.value {
+			t.Errorf("%v: not anonymized", tt.value)
+		}
+	}
+}
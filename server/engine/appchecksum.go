@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// Application checksums are output options given as objects, e.g.
+//
+//	["compute_checksum", {"checksum": "crc16_modbus", "field": "crc", "region": "0..0x1e"}]
+//
+// Options run in order, so list them before compute_checksum when the IP and UDP
+// checksums cover the application frame.
+
+// ChecksumOption computes a checksum over a region of the packet and writes it into a field
+type ChecksumOption struct {
+	Checksum string `json:"checksum"` // Algorithm, see checksumAlgorithms
+	Field    string `json:"field"`    // Field receiving the checksum, as wide as the algorithm's result
+	Region   string `json:"region"`   // Bytes covered, in Field.LengthOf syntax ("first..last", "0x2a..0x40", ...)
+	Endian   string `json:"endian"`   // big or little; empty uses the algorithm's usual order
+}
+
+type checksumAlgorithm struct {
+	width        int // Result size in bytes
+	littleEndian bool
+	compute      func([]byte) uint32
+}
+
+var checksumAlgorithms = map[string]checksumAlgorithm{
+	"crc16_modbus": {2, true, func(data []byte) uint32 { return uint32(crc16Reflected(data, 0xa001, 0xffff, 0)) }},
+	"crc16_ccitt":  {2, false, func(data []byte) uint32 { return uint32(crc16CCITT(data)) }}, // CRC-16/CCITT-FALSE
+	"crc16_dnp":    {2, true, func(data []byte) uint32 { return uint32(crc16Reflected(data, 0xa6bc, 0, 0xffff)) }},
+	"crc32":        {4, false, crc32.ChecksumIEEE},
+	"sum8":         {1, false, func(data []byte) uint32 { return byteSum(data) & 0xff }},
+	"sum16":        {2, false, func(data []byte) uint32 { return byteSum(data) & 0xffff }},
+	"xor8":         {1, false, xor8},
+	"fletcher16":   {2, false, fletcher16},
+}
+
+// parseChecksumOption decodes and validates an object output option
+func parseChecksumOption(raw json.RawMessage) (ChecksumOption, checksumAlgorithm, error) {
+	var option ChecksumOption
+	if err := json.Unmarshal(raw, &option); err != nil {
+		return option, checksumAlgorithm{}, fmt.Errorf("invalid output option %s: %w", raw, err)
+	}
+
+	algorithm, ok := checksumAlgorithms[option.Checksum]
+	if !ok {
+		return option, algorithm, fmt.Errorf("unknown checksum algorithm: %q", option.Checksum)
+	}
+	switch option.Endian {
+	case "":
+	case "big":
+		algorithm.littleEndian = false
+	case "little":
+		algorithm.littleEndian = true
+	default:
+		return option, algorithm, fmt.Errorf("checksum endian must be big or little")
+	}
+	if option.Field == "" {
+		return option, algorithm, fmt.Errorf("checksum %s needs a field", option.Checksum)
+	}
+	if _, err := parseLengthRegion(option.Region); err != nil {
+		return option, algorithm, err
+	}
+	return option, algorithm, nil
+}
+
+// ValidateOutputOptions checks the output options of a rule before it is saved: the JSON
+// array must parse and object options must be valid checksum options
+func ValidateOutputOptions(optionsJSON string) error {
+	if strings.TrimSpace(optionsJSON) == "" {
+		return nil
+	}
+	var options []json.RawMessage
+	if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+		return fmt.Errorf("output options must be a JSON array: %w", err)
+	}
+	for _, raw := range options {
+		var name string
+		if json.Unmarshal(raw, &name) == nil {
+			continue
+		}
+		if _, _, err := parseChecksumOption(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyChecksumOption writes the checksum of the region into the field of the reassembled packet
+func applyChecksumOption(packet []byte, raw json.RawMessage, segments []FieldSegment) error {
+	option, algorithm, err := parseChecksumOption(raw)
+	if err != nil {
+		return err
+	}
+
+	region, _ := parseLengthRegion(option.Region)
+	start, err := regionBound(region.start, false, packet, segments)
+	if err != nil {
+		return err
+	}
+	end, err := regionBound(region.end, true, packet, segments)
+	if err != nil {
+		return err
+	}
+	if end < start {
+		return fmt.Errorf("checksum region %q ends before it starts", option.Region)
+	}
+
+	offset := -1
+	for _, segment := range segments {
+		if segment.IsUserField && segment.FieldName == option.Field {
+			if segment.Field.Length != algorithm.width {
+				return fmt.Errorf("checksum field %s is %d bytes, %s needs %d", option.Field, segment.Field.Length, option.Checksum, algorithm.width)
+			}
+			offset = segment.NewOffset
+		}
+	}
+	if offset < 0 {
+		return fmt.Errorf("field not found: %s", option.Field)
+	}
+	if offset+algorithm.width > len(packet) {
+		return fmt.Errorf("checksum field %s is outside the packet", option.Field)
+	}
+
+	value := algorithm.compute(packet[start:end])
+	for i := 0; i < algorithm.width; i++ {
+		shift := 8 * i
+		if !algorithm.littleEndian {
+			shift = 8 * (algorithm.width - 1 - i)
+		}
+		packet[offset+i] = byte(value >> shift)
+	}
+	return nil
+}
+
+// crc16Reflected computes a reflected CRC-16 with the given reversed polynomial
+func crc16Reflected(data []byte, poly, init, xorOut uint16) uint16 {
+	crc := init
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc ^ xorOut
+}
+
+// crc16CCITT computes CRC-16/CCITT-FALSE (polynomial 0x1021, init 0xffff)
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func byteSum(data []byte) uint32 {
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+func xor8(data []byte) uint32 {
+	var x byte
+	for _, b := range data {
+		x ^= b
+	}
+	return uint32(x)
+}
+
+func fletcher16(data []byte) uint32 {
+	var sum1, sum2 uint32
+	for _, b := range data {
+		sum1 = (sum1 + uint32(b)) % 255
+		sum2 = (sum2 + sum1) % 255
+	}
+	return sum2<<8 | sum1
+}
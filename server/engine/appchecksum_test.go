@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"encoding/json"
+	"packet-repackage/models"
+	"testing"
+)
+
+func TestChecksumCheckValues(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      uint32
+	}{
+		{"crc16_modbus", 0x4b37},
+		{"crc16_ccitt", 0x29b1},
+		{"crc16_dnp", 0xea82},
+		{"crc32", 0xcbf43926},
+	}
+
+	for _, tt := range tests {
+		algorithm, ok := checksumAlgorithms[tt.algorithm]
+		if !ok {
+			t.Fatalf("%s: algorithm not registered", tt.algorithm)
+		}
+		if got := algorithm.compute([]byte("123456789")); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumOptionEndian(t *testing.T) {
+	data := models.Field{Name: "data", Offset: 0, Length: 9, Type: "string"}
+	crc := models.Field{Name: "crc", Offset: 9, Length: 2, Type: "hex"}
+	segments := []FieldSegment{
+		{Offset: 0, Length: 9, IsUserField: true, FieldName: "data", Field: &data, NewOffset: 0, NewLength: 9},
+		{Offset: 9, Length: 2, IsUserField: true, FieldName: "crc", Field: &crc, NewOffset: 9, NewLength: 2},
+	}
+
+	tests := []struct {
+		name   string
+		option string
+		want   [2]byte
+	}{
+		{"modbus default little", `{"checksum": "crc16_modbus", "field": "crc", "region": "data"}`, [2]byte{0x37, 0x4b}},
+		{"modbus big", `{"checksum": "crc16_modbus", "field": "crc", "region": "data", "endian": "big"}`, [2]byte{0x4b, 0x37}},
+		{"ccitt default big", `{"checksum": "crc16_ccitt", "field": "crc", "region": "data"}`, [2]byte{0x29, 0xb1}},
+		{"ccitt little", `{"checksum": "crc16_ccitt", "field": "crc", "region": "0..9", "endian": "little"}`, [2]byte{0xb1, 0x29}},
+	}
+
+	for _, tt := range tests {
+		packet := append([]byte("123456789"), 0, 0)
+		if err := applyChecksumOption(packet, json.RawMessage(tt.option), segments); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := [2]byte{packet[9], packet[10]}; got != tt.want {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateOutputOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		valid   bool
+	}{
+		{``, true},
+		{`["compute_checksum"]`, true},
+		{`[{"checksum": "crc32", "field": "crc", "region": "0..end"}, "compute_checksum"]`, true},
+		{`[{"checksum": "crc64", "field": "crc", "region": "0..end"}]`, false},
+		{`[{"checksum": "crc32", "region": "0..end"}]`, false},
+		{`[{"checksum": "crc32", "field": "crc", "region": "0..end", "endian": "middle"}]`, false},
+		{`[{"checksum": "crc32", "field": "crc", "region": ""}]`, false},
+		{`compute_checksum`, false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateOutputOptions(tt.options)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: got error %v, want valid %v", tt.options, err, tt.valid)
+		}
+	}
+}
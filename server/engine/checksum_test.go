@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// serializeTest builds a packet with gopacket, which computes every checksum, innermost first
+func serializeTest(t *testing.T, serializable ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, serializable...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testIPv4(protocol layers.IPProtocol, src, dst byte) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Id: 0x1234, Protocol: protocol,
+		SrcIP: net.IP{10, 0, 0, src}, DstIP: net.IP{10, 0, 0, dst}}
+}
+
+func TestRecalculateChecksums(t *testing.T) {
+	// Destination unreachable quoting the IP header and first bytes of a UDP datagram
+	quotedIP := testIPv4(layers.IPProtocolUDP, 2, 3)
+	quotedUDP := &layers.UDP{SrcPort: 5000, DstPort: 53}
+	quotedUDP.SetNetworkLayerForChecksum(quotedIP)
+	quoted := serializeTest(t, quotedIP, quotedUDP, gopacket.Payload("query"))[:28]
+	icmp := serializeTest(t, testIPv4(layers.IPProtocolICMPv4, 1, 2),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)},
+		gopacket.Payload(quoted))
+
+	sctpIP := testIPv4(layers.IPProtocolSCTP, 1, 2)
+	sctp := serializeTest(t, sctpIP,
+		&layers.SCTP{SrcPort: 2905, DstPort: 2905, VerificationTag: 0xdeadbeef},
+		&layers.SCTPData{SCTPChunk: layers.SCTPChunk{Type: layers.SCTPChunkTypeData}, BeginFragment: true, EndFragment: true, TSN: 1, PayloadProtocol: 3},
+		gopacket.Payload("m3ua"))
+
+	greIP := &layers.GRE{ChecksumPresent: true, Protocol: layers.EthernetTypeIPv4}
+	gre := serializeTest(t, testIPv4(layers.IPProtocolGRE, 1, 2), greIP, gopacket.Payload("not an ip packet"))
+
+	innerIP := testIPv4(layers.IPProtocolUDP, 3, 4)
+	innerUDP := &layers.UDP{SrcPort: 1234, DstPort: 4321}
+	innerUDP.SetNetworkLayerForChecksum(innerIP)
+	udpInGRE := serializeTest(t, testIPv4(layers.IPProtocolGRE, 1, 2),
+		&layers.GRE{ChecksumPresent: true, Protocol: layers.EthernetTypeIPv4},
+		innerIP, innerUDP, gopacket.Payload("tunneled payload"))
+
+	tests := []struct {
+		name    string
+		want    []byte
+		corrupt []int // Offsets of checksum bytes to break
+	}{
+		// Outer IP, ICMP and quoted IP header checksums
+		{"ICMP quoted header", icmp, []int{10, 22, 38}},
+		// CRC32c, stored least significant byte first
+		{"SCTP", sctp, []int{10, 28, 29, 30, 31}},
+		{"GRE", gre, []int{10, 24}},
+		// The GRE checksum covers the inner UDP checksum, so it must be computed after it
+		{"UDP in GRE", udpInGRE, []int{24, 38, 54}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := append([]byte(nil), tt.want...)
+			for _, offset := range tt.corrupt {
+				packet[offset] ^= 0x5a
+			}
+			got, err := recalculateChecksums(packet, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got  % x\nwant % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSCTPChecksumByteOrder(t *testing.T) {
+	// CRC-32C check value
+	if got := crc32.Checksum([]byte("123456789"), castagnoli); got != 0xe3069283 {
+		t.Fatalf("castagnoli check value %#x", got)
+	}
+
+	packet := serializeTest(t, testIPv4(layers.IPProtocolSCTP, 1, 2),
+		&layers.SCTP{SrcPort: 1, DstPort: 2, VerificationTag: 1},
+		&layers.SCTPData{SCTPChunk: layers.SCTPChunk{Type: layers.SCTPChunkTypeData}, BeginFragment: true, EndFragment: true, TSN: 7},
+		gopacket.Payload("x"))
+	binary.BigEndian.PutUint32(packet[28:], 0)
+	want := crc32.Checksum(packet[20:], castagnoli)
+
+	got, err := recalculateChecksums(packet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := binary.LittleEndian.Uint32(got[28:]); stored != want {
+		t.Errorf("stored %#x, want %#x little-endian", stored, want)
+	}
+}
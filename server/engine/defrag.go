@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A field of a large application message may sit in a fragment without a transport header,
+// or straddle two fragments. With defragmentation enabled, IPv4 fragments are held until
+// their datagram is complete and the reassembled packet is matched and rewritten as a whole.
+// Like the kernel, incomplete datagrams are discarded when they time out or when the held
+// fragments exceed the memory limit, oldest first.
+//
+// The stage only sees fragments when conntrack is not loaded: nf_defrag_ipv4 reassembles
+// before the queue hooks otherwise, and would reassemble the fragments sent in place of a
+// datagram again on output. Those fragments go through a raw socket, so they are routed by
+// this host's table rather than continuing on the path the queued fragment took.
+
+// DefragConfig controls the defragmentation stage
+type DefragConfig struct {
+	Enabled   bool
+	Timeout   time.Duration // How long an incomplete datagram is kept
+	MaxMemory int           // Bytes of fragments held across all datagrams
+}
+
+var defaultDefragConfig = DefragConfig{Timeout: 30 * time.Second, MaxMemory: 4 << 20}
+
+type defragKey struct {
+	src, dst [4]byte
+	id       uint16
+	protocol uint8
+}
+
+type fragmentPiece struct {
+	offset int
+	data   []byte
+}
+
+// fragmentSet collects the fragments of one datagram
+type fragmentSet struct {
+	header    []byte // Header of the first fragment, nil until it arrives
+	total     int    // Payload length of the datagram, -1 until the last fragment arrives
+	pieces    []fragmentPiece
+	fragments [][]byte // Fragments as they arrived
+	size      int      // Bytes held, counted against MaxMemory
+	firstSeen time.Time
+}
+
+var defragState = struct {
+	sync.Mutex
+	config    DefragConfig
+	datagrams map[defragKey]*fragmentSet
+	memory    int
+	lastSweep time.Time
+}{config: defaultDefragConfig, datagrams: map[defragKey]*fragmentSet{}}
+
+// Datagram is an IPv4 packet reassembled from fragments
+type Datagram struct {
+	Packet    []byte   // Reassembled packet, starting at the IP header
+	Fragments [][]byte // Fragments as they arrived
+}
+
+// FragmentSize returns the size of the largest fragment, the MTU the datagram arrived with
+func (d *Datagram) FragmentSize() int {
+	size := 0
+	for _, fragment := range d.Fragments {
+		if len(fragment) > size {
+			size = len(fragment)
+		}
+	}
+	return size
+}
+
+// SetDefragConfig replaces the defragmentation settings, discarding held fragments
+func SetDefragConfig(cfg DefragConfig) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultDefragConfig.Timeout
+	}
+	if cfg.MaxMemory <= 0 {
+		cfg.MaxMemory = defaultDefragConfig.MaxMemory
+	}
+
+	defragState.Lock()
+	defragState.config = cfg
+	defragState.datagrams = map[defragKey]*fragmentSet{}
+	defragState.memory = 0
+	defragState.Unlock()
+}
+
+// DefragEnabled reports whether fragments should go through DefragIPv4
+func DefragEnabled() bool {
+	defragState.Lock()
+	defer defragState.Unlock()
+	return defragState.config.Enabled
+}
+
+// IsIPv4Fragment reports whether the packet, starting at the IP header, is an IPv4 fragment
+func IsIPv4Fragment(packet []byte) bool {
+	return len(packet) >= 20 && packet[0]>>4 == 4 && binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0
+}
+
+// DefragIPv4 adds an IPv4 fragment, starting at the IP header, to its datagram. It returns
+// the reassembled datagram once all fragments are in and nil until then. Fragments that
+// can't be reassembled (overlaps, inconsistent lengths, no memory) return an error; an
+// overlap or inconsistency also discards the fragments held for the datagram.
+func DefragIPv4(fragment []byte) (*Datagram, error) {
+	if !IsIPv4Fragment(fragment) {
+		return nil, fmt.Errorf("not an IPv4 fragment")
+	}
+	headerLen := int(fragment[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(fragment[2:4]))
+	if headerLen < 20 || total < headerLen || total > len(fragment) {
+		return nil, fmt.Errorf("invalid IPv4 header (header %d bytes, total length %d, %d bytes captured)", headerLen, total, len(fragment))
+	}
+
+	flags := binary.BigEndian.Uint16(fragment[6:8])
+	offset := int(flags&0x1fff) * 8
+	moreFragments := flags&0x2000 != 0
+	end := offset + total - headerLen
+	if moreFragments && (total-headerLen)%8 != 0 {
+		return nil, fmt.Errorf("fragment at offset %d has %d data bytes, not a multiple of 8", offset, total-headerLen)
+	}
+	if end+headerLen > 0xffff {
+		return nil, fmt.Errorf("fragment at offset %d would make the datagram exceed 65535 bytes", offset)
+	}
+
+	var key defragKey
+	copy(key.src[:], fragment[12:16])
+	copy(key.dst[:], fragment[16:20])
+	key.id = binary.BigEndian.Uint16(fragment[4:6])
+	key.protocol = fragment[9]
+
+	defragState.Lock()
+	defer defragState.Unlock()
+
+	now := time.Now()
+	sweepDatagrams(now)
+
+	set := defragState.datagrams[key]
+	if set == nil {
+		set = &fragmentSet{total: -1, firstSeen: now}
+	}
+
+	for _, piece := range set.pieces {
+		if offset < piece.offset+len(piece.data) && end > piece.offset {
+			if offset == piece.offset && end == piece.offset+len(piece.data) {
+				// Retransmitted fragment, already held
+				return nil, nil
+			}
+			discardDatagram(key)
+			return nil, fmt.Errorf("fragment at offset %d overlaps data already received", offset)
+		}
+	}
+	if !moreFragments {
+		if set.total >= 0 && set.total != end {
+			discardDatagram(key)
+			return nil, fmt.Errorf("last fragment conflicts with the datagram length already known")
+		}
+		for _, piece := range set.pieces {
+			if piece.offset+len(piece.data) > end {
+				discardDatagram(key)
+				return nil, fmt.Errorf("last fragment ends before data already received")
+			}
+		}
+		set.total = end
+	}
+	if set.total >= 0 && end > set.total {
+		discardDatagram(key)
+		return nil, fmt.Errorf("fragment at offset %d ends past the last fragment", offset)
+	}
+
+	// Make room by giving up on the oldest incomplete datagrams
+	for defragState.memory+total > defragState.config.MaxMemory {
+		if !discardOldestDatagram(key) {
+			return nil, fmt.Errorf("fragment of %d bytes exceeds the defragmentation memory limit", total)
+		}
+	}
+
+	held := append([]byte(nil), fragment[:total]...)
+	if offset == 0 {
+		set.header = held[:headerLen]
+	}
+	set.pieces = append(set.pieces, fragmentPiece{offset: offset, data: held[headerLen:]})
+	set.fragments = append(set.fragments, held)
+	set.size += len(held)
+	defragState.memory += len(held)
+	defragState.datagrams[key] = set
+
+	// Pieces don't overlap, so they cover the datagram once their lengths add up
+	received := 0
+	for _, piece := range set.pieces {
+		received += len(piece.data)
+	}
+	if set.header == nil || set.total < 0 || received != set.total {
+		return nil, nil
+	}
+
+	discardDatagram(key)
+	return &Datagram{Packet: set.reassemble(), Fragments: set.fragments}, nil
+}
+
+// reassemble joins the pieces behind the first fragment's header
+func (set *fragmentSet) reassemble() []byte {
+	headerLen := len(set.header)
+	packet := make([]byte, headerLen+set.total)
+	copy(packet, set.header)
+	for _, piece := range set.pieces {
+		copy(packet[headerLen+piece.offset:], piece.data)
+	}
+
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	// Keep DF and the reserved bit, clear more-fragments and the offset
+	binary.BigEndian.PutUint16(packet[6:8], binary.BigEndian.Uint16(packet[6:8])&0xc000)
+	setIPv4HeaderChecksum(packet, 0)
+	return packet
+}
+
+// discardDatagram forgets the fragments of a datagram; called with the lock held
+func discardDatagram(key defragKey) {
+	if set := defragState.datagrams[key]; set != nil {
+		defragState.memory -= set.size
+		delete(defragState.datagrams, key)
+	}
+}
+
+// discardOldestDatagram frees the datagram waiting longest other than keep, reporting false
+// if there is none; called with the lock held
+func discardOldestDatagram(keep defragKey) bool {
+	var oldest *defragKey
+	var oldestSeen time.Time
+	for key, set := range defragState.datagrams {
+		if key == keep {
+			continue
+		}
+		if oldest == nil || set.firstSeen.Before(oldestSeen) {
+			k := key
+			oldest, oldestSeen = &k, set.firstSeen
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	discardDatagram(*oldest)
+	return true
+}
+
+// sweepDatagrams discards datagrams not completed within the timeout; called with the lock held
+func sweepDatagrams(now time.Time) {
+	timeout := defragState.config.Timeout
+	if now.Sub(defragState.lastSweep) < timeout/10 {
+		return
+	}
+	for key, set := range defragState.datagrams {
+		if now.Sub(set.firstSeen) > timeout {
+			discardDatagram(key)
+		}
+	}
+	defragState.lastSweep = now
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testFragments fragments a packet with the given IP ID into pieces of at most mtu bytes
+func testFragments(t *testing.T, id uint16, payloadLen, mtu int) ([]byte, [][]byte) {
+	t.Helper()
+	packet := ipv4TestPacket(nil, 0, payloadLen)
+	binary.BigEndian.PutUint16(packet[4:6], id)
+	setIPv4HeaderChecksum(packet, 0)
+	fragments, err := FragmentIPv4(packet, mtu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet, fragments
+}
+
+func resetDefrag(timeout time.Duration, maxMemory int) {
+	SetDefragConfig(DefragConfig{Enabled: true, Timeout: timeout, MaxMemory: maxMemory})
+	defragState.Lock()
+	defragState.lastSweep = time.Time{}
+	defragState.Unlock()
+}
+
+func heldDatagrams() (int, int) {
+	defragState.Lock()
+	defer defragState.Unlock()
+	return len(defragState.datagrams), defragState.memory
+}
+
+func TestDefragIPv4RoundTrip(t *testing.T) {
+	recordRoute := []byte{0x07, 0x07, 0x04, 0, 0, 0, 0}
+	routerAlert := []byte{0x94, 0x04, 0, 0}
+	options := append(append(append([]byte(nil), recordRoute...), routerAlert...), 0)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		order  []int // Indexes of the fragments in arrival order; nil = as produced
+	}{
+		{"in order", ipv4TestPacket(nil, 0, 1400), nil},
+		{"out of order", ipv4TestPacket(nil, 0, 1400), []int{3, 1, 0, 4, 2}},
+		{"options", ipv4TestPacket(options, 0, 1400), []int{4, 3, 2, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetDefrag(time.Minute, 1<<20)
+			fragments, err := FragmentIPv4(tt.packet, 320)
+			if err != nil {
+				t.Fatal(err)
+			}
+			order := tt.order
+			if order == nil {
+				for i := range fragments {
+					order = append(order, i)
+				}
+			}
+			if len(order) != len(fragments) {
+				t.Fatalf("%d fragments, order lists %d", len(fragments), len(order))
+			}
+
+			var datagram *Datagram
+			for i, index := range order {
+				datagram, err = DefragIPv4(fragments[index])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (datagram != nil) != (i == len(order)-1) {
+					t.Fatalf("fragment %d of %d: datagram %v", i+1, len(order), datagram != nil)
+				}
+			}
+			if !bytes.Equal(datagram.Packet, tt.packet) {
+				t.Errorf("reassembled packet of %d bytes differs from the %d byte original", len(datagram.Packet), len(tt.packet))
+			}
+			if len(datagram.Fragments) != len(fragments) || datagram.FragmentSize() > 320 {
+				t.Errorf("got %d fragments of up to %d bytes", len(datagram.Fragments), datagram.FragmentSize())
+			}
+			if held, memory := heldDatagrams(); held != 0 || memory != 0 {
+				t.Errorf("%d datagrams and %d bytes still held", held, memory)
+			}
+		})
+	}
+}
+
+func TestDefragIPv4Duplicate(t *testing.T) {
+	resetDefrag(time.Minute, 1<<20)
+	packet, fragments := testFragments(t, 1, 600, 320)
+
+	for _, fragment := range [][]byte{fragments[0], fragments[0], fragments[1]} {
+		if datagram, err := DefragIPv4(fragment); datagram != nil || err != nil {
+			t.Fatalf("got datagram %v, error %v before the last fragment", datagram != nil, err)
+		}
+	}
+	if _, memory := heldDatagrams(); memory != len(fragments[0])+len(fragments[1]) {
+		t.Errorf("duplicate counted: %d bytes held", memory)
+	}
+
+	datagram, err := DefragIPv4(fragments[2])
+	if err != nil || datagram == nil || !bytes.Equal(datagram.Packet, packet) {
+		t.Fatalf("got datagram %v, error %v", datagram != nil, err)
+	}
+	if len(datagram.Fragments) != 3 {
+		t.Errorf("got %d fragments, want 3", len(datagram.Fragments))
+	}
+}
+
+func TestDefragIPv4Overlap(t *testing.T) {
+	resetDefrag(time.Minute, 1<<20)
+	_, fragments := testFragments(t, 1, 600, 320)
+
+	if _, err := DefragIPv4(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Move the second fragment 8 bytes back, into the first
+	overlapping := append([]byte(nil), fragments[1]...)
+	flags := binary.BigEndian.Uint16(overlapping[6:8])
+	binary.BigEndian.PutUint16(overlapping[6:8], flags-1)
+	setIPv4HeaderChecksum(overlapping, 0)
+
+	if _, err := DefragIPv4(overlapping); err == nil {
+		t.Fatal("overlap accepted")
+	}
+	if held, memory := heldDatagrams(); held != 0 || memory != 0 {
+		t.Errorf("%d datagrams and %d bytes still held after an overlap", held, memory)
+	}
+}
+
+func TestDefragIPv4Timeout(t *testing.T) {
+	resetDefrag(20*time.Millisecond, 1<<20)
+	_, stale := testFragments(t, 1, 600, 320)
+	_, fresh := testFragments(t, 2, 600, 320)
+
+	if _, err := DefragIPv4(stale[0]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := DefragIPv4(fresh[0]); err != nil {
+		t.Fatal(err)
+	}
+	if held, memory := heldDatagrams(); held != 1 || memory != len(fresh[0]) {
+		t.Fatalf("got %d datagrams, %d bytes; want only the fresh one", held, memory)
+	}
+
+	// The rest of the stale datagram can't complete it any more
+	for _, fragment := range stale[1:] {
+		if datagram, err := DefragIPv4(fragment); datagram != nil || err != nil {
+			t.Fatalf("timed out datagram completed: %v, %v", datagram != nil, err)
+		}
+	}
+}
+
+func TestDefragIPv4Memory(t *testing.T) {
+	_, first := testFragments(t, 1, 600, 320)
+	_, second := testFragments(t, 2, 600, 320)
+	resetDefrag(time.Minute, len(first[0])+len(second[0]))
+
+	if _, err := DefragIPv4(first[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DefragIPv4(second[0]); err != nil {
+		t.Fatal(err)
+	}
+	// No room left: the oldest datagram gives way
+	if _, err := DefragIPv4(second[1]); err != nil {
+		t.Fatal(err)
+	}
+	if held, memory := heldDatagrams(); held != 1 || memory != len(second[0])+len(second[1]) {
+		t.Errorf("got %d datagrams, %d bytes; want the second datagram only", held, memory)
+	}
+
+	// A fragment larger than the limit is refused when there is nothing to evict
+	resetDefrag(time.Minute, 100)
+	if _, err := DefragIPv4(first[0]); err == nil {
+		t.Error("fragment larger than the memory limit accepted")
+	}
+}
+
+func TestDefragIPv4TrailingBytes(t *testing.T) {
+	_, fragments := testFragments(t, 1, 600, 320)
+	resetDefrag(time.Minute, len(fragments[0]))
+
+	// Link-layer padding after the datagram isn't held or counted against the limit
+	padded := append(append([]byte(nil), fragments[0]...), make([]byte, 64)...)
+	if _, err := DefragIPv4(padded); err != nil {
+		t.Fatal(err)
+	}
+	if _, memory := heldDatagrams(); memory != len(fragments[0]) {
+		t.Errorf("%d bytes held, want %d", memory, len(fragments[0]))
+	}
+}
@@ -8,7 +8,8 @@ import (
 )
 
 // EvaluateCondition evaluates a condition expression against packet context
-// Supports: field == "value", field != "value", &&, ||, !, ()
+// Supports: field == "value", field != "value", &&, ||, !, () and comparisons
+// (==, !=, <, <=, >, >=) between value expressions such as counter("seen") < 10
 func EvaluateCondition(condition string, ctx *PacketContext, fields []models.Field) (bool, error) {
 	if strings.TrimSpace(condition) == "" {
 		return true, nil
@@ -24,6 +25,21 @@ func EvaluateCondition(condition string, ctx *PacketContext, fields []models.Fie
 	return evaluateExpression(condition, ctx, fieldMap)
 }
 
+// MatchRule checks both the match condition and the optional Starlark condition script of a rule
+func MatchRule(rule models.Rule, ctx *PacketContext, fields []models.Field) (bool, error) {
+	ctx.RuleID = rule.ID
+
+	matched, err := EvaluateCondition(rule.MatchCondition, ctx, fields)
+	if err != nil || !matched {
+		return false, err
+	}
+
+	if strings.TrimSpace(rule.ConditionScript) == "" {
+		return true, nil
+	}
+	return EvaluateScriptCondition(rule.ConditionScript, ctx)
+}
+
 func evaluateExpression(expr string, ctx *PacketContext, fieldMap map[string]models.Field) (bool, error) {
 	expr = strings.TrimSpace(expr)
 
@@ -78,23 +94,96 @@ func evaluateExpression(expr string, ctx *PacketContext, fieldMap map[string]mod
 func evaluateComparison(expr string, ctx *PacketContext, fieldMap map[string]models.Field) (bool, error) {
 	expr = strings.TrimSpace(expr)
 
-	// Match pattern: fieldName == "value" or fieldName != "value"
-	eqRegex := regexp.MustCompile(`(\w+)\s*==\s*"([^"]*)"`)
-	neRegex := regexp.MustCompile(`(\w+)\s*!=\s*"([^"]*)"`)
+	left, op, right, ok := splitComparison(expr)
+	if !ok {
+		return false, fmt.Errorf("invalid comparison expression: %s", expr)
+	}
+
+	// Match pattern: fieldName == "value" or fieldName != "value", compared by field type
+	if identRegex.MatchString(left) && quotedRegex.MatchString(right) && (op == "==" || op == "!=") {
+		return compareField(left, right[1:len(right)-1], op == "==", ctx, fieldMap)
+	}
+
+	// Anything else compares two value expressions, e.g. counter("seen") < 10
+	leftValue, err := EvaluateExpression(left, ctx)
+	if err != nil {
+		return false, err
+	}
+	rightValue, err := EvaluateExpression(right, ctx)
+	if err != nil {
+		return false, err
+	}
+	return compareValues(leftValue, op, rightValue)
+}
+
+var (
+	identRegex  = regexp.MustCompile(`^\w+$`)
+	quotedRegex = regexp.MustCompile(`^"[^"]*"$`)
+)
 
-	if matches := eqRegex.FindStringSubmatch(expr); matches != nil {
-		fieldName := matches[1]
-		expectedValue := matches[2]
-		return compareField(fieldName, expectedValue, true, ctx, fieldMap)
+// splitComparison finds the comparison operator outside of strings and parentheses
+func splitComparison(expr string) (string, string, string, bool) {
+	depth := 0
+	inString := false
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == '=' || c == '!' || c == '<' || c == '>'):
+			op := string(c)
+			if i+1 < len(expr) && expr[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				continue
+			}
+			return strings.TrimSpace(expr[:i]), op, strings.TrimSpace(expr[i+len(op):]), true
+		}
 	}
+	return "", "", "", false
+}
 
-	if matches := neRegex.FindStringSubmatch(expr); matches != nil {
-		fieldName := matches[1]
-		expectedValue := matches[2]
-		return compareField(fieldName, expectedValue, false, ctx, fieldMap)
+// compareValues compares numerically when both sides are numbers, otherwise as strings
+func compareValues(left interface{}, op string, right interface{}) (bool, error) {
+	l, lok := toInt64(left)
+	r, rok := toInt64(right)
+
+	if lok && rok {
+		switch op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
 	}
 
-	return false, fmt.Errorf("invalid comparison expression: %s", expr)
+	switch op {
+	case "==":
+		return toString(left) == toString(right), nil
+	case "!=":
+		return toString(left) != toString(right), nil
+	}
+	return false, fmt.Errorf("operator %s needs numbers, got %v and %v", op, left, right)
 }
 
 func compareField(fieldName, expectedValue string, equality bool, ctx *PacketContext, fieldMap map[string]models.Field) (bool, error) {
@@ -2,20 +2,63 @@ package engine
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
 	"strconv"
 	"strings"
 )
 
 // Action represents a modification action
 type Action struct {
-	Field string `json:"field"` // Field name to modify
-	Op    string `json:"op"`    // Operation: set, add, sub, mul, div, shell
-	Value string `json:"value"` // Value or shell command
+	Field     string  `json:"field"`               // Field name to modify (variable name for var_*)
+	Op        string  `json:"op"`                  // Operation: set, add, sub, mul, div, expr, var_set, var_add, if, shell, processor, starlark, wasm, map, mirror, anonymize, delay, ratelimit, bitflip, duplicate, truncate, bad_checksum, mark, drop, reject-*
+	Value     string  `json:"value"`               // Value, expression, shell command, processor socket path, script, plugin, table, key name, mirror target or mark
+	Timeout   int     `json:"timeout,omitempty"`   // Shell/processor/plugin timeout in milliseconds (0 = default)
+	Fuel      int64   `json:"fuel,omitempty"`      // Plugin: fuel units per call (0 = default)
+	Default   *string `json:"default,omitempty"`   // Fallback value if the shell command fails or times out
+	Scope     string  `json:"scope,omitempty"`     // Variable scope: global (default), rule or flow; ratelimit: rule (default) or source
+	Persist   bool    `json:"persist,omitempty"`   // Keep the variable across restarts
+	Copy      string  `json:"copy,omitempty"`      // Mirror: original, modified (default) or both
+	Burst     int     `json:"burst,omitempty"`     // Ratelimit: bucket size (0 = one second's worth)
+	Exceed    string  `json:"exceed,omitempty"`    // Ratelimit: drop (default) or pass the packet unmodified
+	Percent   float64 `json:"percent,omitempty"`   // Fault injection: share of packets affected (0 = all)
+	Region    string  `json:"region,omitempty"`    // Bitflip: "offset:length" byte range instead of a field
+	Conntrack bool    `json:"conntrack,omitempty"` // Mark: also set the conntrack mark
+	OnError   string  `json:"on_error,omitempty"`  // On failure: skip, abort (default) or drop
+
+	// Branching (op "if"): the first branch whose condition holds runs, otherwise Else
+	Condition string         `json:"condition,omitempty"` // Condition in match-condition syntax
+	Then      []Action       `json:"then,omitempty"`
+	Elif      []ActionBranch `json:"elif,omitempty"`
+	Else      []Action       `json:"else,omitempty"`
+}
+
+// ActionBranch is an elif block of an "if" action
+type ActionBranch struct {
+	Condition string   `json:"condition"`
+	Then      []Action `json:"then"`
+}
+
+// Error policies of an action (on_error)
+const (
+	OnErrorSkip  = "skip"  // Ignore the failed action and continue with the next one
+	OnErrorAbort = "abort" // Discard all changes of the rule and accept the original packet
+	OnErrorDrop  = "drop"  // Discard all changes of the rule and drop the packet
+)
+
+// ActionError is returned by ExecuteActions when an action fails with policy abort or drop
+type ActionError struct {
+	Policy string
+	Err    error
 }
 
-// ExecuteActions executes all actions on the packet context
+func (e *ActionError) Error() string { return e.Err.Error() }
+func (e *ActionError) Unwrap() error { return e.Err }
+
+// ExecuteActions executes all actions on the packet context. Actions run on a copy of the
+// context which replaces ctx only when they all succeed (or fail with policy skip), so a
+// failing rule leaves the fields, verdict and variables untouched. Effects outside the
+// packet, such as shell commands and consumed rate limit tokens, are not undone.
 func ExecuteActions(actionsJSON string, ctx *PacketContext) error {
 	if strings.TrimSpace(actionsJSON) == "" {
 		return nil
@@ -24,19 +67,104 @@ func ExecuteActions(actionsJSON string, ctx *PacketContext) error {
 	var actions []Action
 	err := json.Unmarshal([]byte(actionsJSON), &actions)
 	if err != nil {
-		return fmt.Errorf("failed to parse actions: %w", err)
+		return &ActionError{Policy: OnErrorAbort, Err: fmt.Errorf("failed to parse actions: %w", err)}
+	}
+
+	work := ctx.clone()
+	if err := executeActionList(actions, work); err != nil {
+		return err
 	}
 
+	work.commitVariables()
+	*ctx = *work
+	return nil
+}
+
+// clone copies the context so actions can modify it without touching the original.
+// Packet bytes and layers are shared; actions replace them rather than write into them.
+func (ctx *PacketContext) clone() *PacketContext {
+	c := *ctx
+
+	c.Fields = make(map[string]interface{}, len(ctx.Fields))
+	for k, v := range ctx.Fields {
+		c.Fields[k] = v
+	}
+	if ctx.variableOverlay != nil {
+		c.variableOverlay = make(map[variableKey]interface{}, len(ctx.variableOverlay))
+		for k, v := range ctx.variableOverlay {
+			c.variableOverlay[k] = v
+		}
+	}
+	if ctx.Mark != nil {
+		mark := *ctx.Mark
+		c.Mark = &mark
+	}
+	c.Mirrors = append([]MirrorRequest(nil), ctx.Mirrors...)
+	c.Skipped = append([]string(nil), ctx.Skipped...)
+	c.pendingVariables = append([]pendingVariable(nil), ctx.pendingVariables...)
+	c.faults = append([]Action(nil), ctx.faults...)
+
+	return &c
+}
+
+func executeActionList(actions []Action, ctx *PacketContext) error {
 	for _, action := range actions {
-		err = executeAction(action, ctx)
+		var err error
+		if action.Op == "if" {
+			err = executeBranch(action, ctx)
+		} else if err = executeAction(action, ctx); err != nil {
+			err = fmt.Errorf("failed to execute action on %s: %w", action.Field, err)
+		}
+
 		if err != nil {
-			return fmt.Errorf("failed to execute action on %s: %w", action.Field, err)
+			// Failures inside a branch carry the policy of the nested action
+			var actionErr *ActionError
+			if errors.As(err, &actionErr) {
+				return err
+			}
+
+			switch action.OnError {
+			case OnErrorSkip:
+				ctx.Skipped = append(ctx.Skipped, err.Error())
+				continue
+			case "", OnErrorAbort:
+				return &ActionError{Policy: OnErrorAbort, Err: err}
+			case OnErrorDrop:
+				return &ActionError{Policy: OnErrorDrop, Err: err}
+			default:
+				return &ActionError{Policy: OnErrorAbort, Err: fmt.Errorf("unknown on_error policy %q: %w", action.OnError, err)}
+			}
+		}
+
+		// Nothing left to modify once the packet is dropped
+		if ctx.Verdict != VerdictAccept {
+			break
 		}
 	}
 
 	return nil
 }
 
+// executeBranch runs the actions of the first if/elif branch whose condition holds, or the else actions
+func executeBranch(action Action, ctx *PacketContext) error {
+	branches := append([]ActionBranch{{Condition: action.Condition, Then: action.Then}}, action.Elif...)
+
+	for _, branch := range branches {
+		if strings.TrimSpace(branch.Condition) == "" {
+			return fmt.Errorf("if/elif block without a condition")
+		}
+		matched, err := EvaluateCondition(branch.Condition, ctx, ctx.fieldDefs)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate condition %q: %w", branch.Condition, err)
+		}
+		if matched {
+			return executeActionList(branch.Then, ctx)
+		}
+	}
+
+	return executeActionList(action.Else, ctx)
+}
+
 func executeAction(action Action, ctx *PacketContext) error {
 	currentValue := ctx.Fields[action.Field]
 
@@ -44,7 +172,7 @@ func executeAction(action Action, ctx *PacketContext) error {
 	case "set":
 		// Direct value assignment
 		ctx.Fields[action.Field] = action.Value
-		
+
 	case "add", "sub", "mul", "div":
 		// Arithmetic operations
 		result, err := performArithmetic(currentValue, action.Value, action.Op)
@@ -52,15 +180,97 @@ func executeAction(action Action, ctx *PacketContext) error {
 			return err
 		}
 		ctx.Fields[action.Field] = result
-		
+
+	case "expr":
+		// Compute the value from fields, variables and functions
+		result, err := EvaluateExpression(action.Value, ctx)
+		if err != nil {
+			return err
+		}
+		ctx.Fields[action.Field] = result
+
+	case "var_set", "var_add":
+		// Update a variable shared across packets
+		if err := executeVariable(action, ctx); err != nil {
+			return err
+		}
+
 	case "shell":
 		// Execute shell command and use output
-		result, err := executeShellCommand(action.Value)
+		result, err := executeShellCommand(action, ctx)
 		if err != nil {
+			if action.Default == nil {
+				return err
+			}
+			ctx.Fields[action.Field] = *action.Default
+			return nil
+		}
+		applyShellOutput(action.Field, result, ctx)
+
+	case "processor":
+		// Hand the packet to a long-running program over a Unix socket
+		if err := executeProcessor(action, ctx); err != nil {
+			return err
+		}
+
+	case "starlark":
+		// Run a sandboxed Starlark script over the packet
+		if err := executeStarlark(action, ctx); err != nil {
+			return err
+		}
+
+	case "wasm":
+		// Run an uploaded WebAssembly plugin
+		if err := executeWasm(action, ctx); err != nil {
+			return err
+		}
+
+	case "map":
+		// Replace the value with its entry in a lookup table
+		if err := executeMap(action, ctx); err != nil {
+			return err
+		}
+
+	case "anonymize":
+		// Replace an address with its keyed, prefix-preserving pseudonym
+		if err := executeAnonymize(action, ctx); err != nil {
+			return err
+		}
+
+	case "delay":
+		// Hold the packet before it is forwarded
+		if err := executeDelay(action, ctx); err != nil {
+			return err
+		}
+
+	case "ratelimit":
+		// Drop or pass through packets over the rate
+		if err := executeRateLimit(action, ctx); err != nil {
+			return err
+		}
+
+	case FaultBitflip, FaultDuplicate, FaultTruncate, FaultBadChecksum:
+		// Damage a share of packets on purpose
+		if err := executeFault(action, ctx); err != nil {
+			return err
+		}
+
+	case "mark":
+		// Set the netfilter mark for downstream rules
+		if err := executeMark(action, ctx); err != nil {
 			return err
 		}
-		ctx.Fields[action.Field] = strings.TrimSpace(result)
-		
+
+	case "mirror":
+		// Copy the packet to an interface or pcap file
+		if err := executeMirror(action, ctx); err != nil {
+			return err
+		}
+
+	case VerdictDrop, VerdictRejectTCPRST, VerdictRejectICMP:
+		// Block the packet; reject also answers the sender
+		ctx.Verdict = action.Op
+
 	default:
 		return fmt.Errorf("unknown operation: %s", action.Op)
 	}
@@ -109,12 +319,3 @@ func performArithmetic(currentValue interface{}, valueStr string, op string) (in
 		return nil, fmt.Errorf("unknown arithmetic operation: %s", op)
 	}
 }
-
-func executeShellCommand(command string) (string, error) {
-	cmd := exec.Command("sh", "-c", command)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("shell command failed: %w", err)
-	}
-	return string(output), nil
-}
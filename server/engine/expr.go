@@ -0,0 +1,390 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Value expressions are used by the "expr" and "var_set" actions and by comparisons in conditions.
+//
+// Grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = [ "-" ] primary
+//	primary = number | string | identifier | call | "(" expr ")"
+//	call    = identifier "(" [ expr { "," expr } ] ")"
+//
+// Identifiers are field names. Numbers may be decimal or 0x-prefixed hex.
+// "+" concatenates when either side is a string that isn't a number.
+
+// exprFunc implements a function callable from expressions
+type exprFunc func(ctx *PacketContext, args []interface{}) (interface{}, error)
+
+var exprFunctions = map[string]exprFunc{}
+
+func init() {
+	exprFunctions["var"] = exprVar
+	exprFunctions["counter"] = exprCounter
+	exprFunctions["int"] = exprInt
+	exprFunctions["str"] = exprStr
+	exprFunctions["len"] = exprLen
+}
+
+// EvaluateExpression evaluates a value expression against the packet context
+func EvaluateExpression(expr string, ctx *PacketContext) (interface{}, error) {
+	p := &exprParser{src: expr, ctx: ctx}
+	p.next()
+
+	value, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tok.text)
+	}
+	return value, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type exprParser struct {
+	src string
+	pos int
+	tok token
+	ctx *PacketContext
+	err error
+}
+
+// next advances to the next token
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF}
+		return
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"':
+		p.pos++
+		var sb strings.Builder
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			sb.WriteByte(p.src[p.pos])
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			p.err = fmt.Errorf("unterminated string in expression")
+			p.tok = token{kind: tokEOF}
+			return
+		}
+		p.pos++
+		p.tok = token{kind: tokString, text: sb.String()}
+
+	case c >= '0' && c <= '9':
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokNumber, text: p.src[start:p.pos]}
+
+	case isIdentChar(c):
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokIdent, text: p.src[start:p.pos]}
+
+	default:
+		p.pos++
+		p.tok = token{kind: tokOp, text: string(c)}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *exprParser) parseExpr() (interface{}, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokOp && (p.tok.text == "+" || p.tok.text == "-") {
+		op := p.tok.text
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left, err = applyBinary(op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, p.err
+}
+
+func (p *exprParser) parseTerm() (interface{}, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokOp && (p.tok.text == "*" || p.tok.text == "/" || p.tok.text == "%") {
+		op := p.tok.text
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left, err = applyBinary(op, left, right)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (interface{}, error) {
+	if p.tok.kind == tokOp && p.tok.text == "-" {
+		p.next()
+		value, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return applyBinary("-", int64(0), value)
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (interface{}, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		n, err := parseNumberLiteral(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", tok.text)
+		}
+		return n, nil
+
+	case tokString:
+		p.next()
+		return tok.text, nil
+
+	case tokIdent:
+		p.next()
+		if p.tok.kind == tokOp && p.tok.text == "(" {
+			return p.parseCall(tok.text)
+		}
+		value, ok := p.ctx.Fields[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown field in expression: %s", tok.text)
+		}
+		return value, nil
+
+	case tokOp:
+		if tok.text == "(" {
+			p.next()
+			value, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokOp || p.tok.text != ")" {
+				return nil, fmt.Errorf("missing ) in expression")
+			}
+			p.next()
+			return value, nil
+		}
+	}
+
+	if tok.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", tok.text)
+}
+
+// parseNumberLiteral parses a decimal or 0x-prefixed hex literal; a leading 0 is still
+// decimal and Go's 0b, 0o and _ forms are rejected
+func parseNumberLiteral(text string) (int64, error) {
+	if len(text) > 2 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X') {
+		return strconv.ParseInt(text[2:], 16, 64)
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+func (p *exprParser) parseCall(name string) (interface{}, error) {
+	fn, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function: %s", name)
+	}
+
+	p.next() // consume "("
+	var args []interface{}
+	if !(p.tok.kind == tokOp && p.tok.text == ")") {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if p.tok.kind == tokOp && p.tok.text == "," {
+				p.next()
+				continue
+			}
+			break
+		}
+	}
+	if p.tok.kind != tokOp || p.tok.text != ")" {
+		return nil, fmt.Errorf("missing ) after arguments of %s", name)
+	}
+	p.next()
+
+	value, err := fn(p.ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return value, nil
+}
+
+// applyBinary applies an arithmetic operator; "+" falls back to concatenation for non-numbers
+func applyBinary(op string, left, right interface{}) (interface{}, error) {
+	l, lok := toInt64(left)
+	r, rok := toInt64(right)
+
+	if !lok || !rok {
+		if op == "+" {
+			return toString(left) + toString(right), nil
+		}
+		return nil, fmt.Errorf("operator %s needs numbers, got %v and %v", op, left, right)
+	}
+
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	}
+	return nil, fmt.Errorf("unknown operator: %s", op)
+}
+
+// toInt64 converts numbers and decimal strings; field values like "010" are decimal, not octal
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func exprVar(ctx *PacketContext, args []interface{}) (interface{}, error) {
+	name, scope, err := variableArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := ctx.GetVariable(scope, name)
+	return value, nil
+}
+
+func exprCounter(ctx *PacketContext, args []interface{}) (interface{}, error) {
+	name, scope, err := variableArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := ctx.GetVariable(scope, name)
+	if value == nil {
+		return int64(0), nil
+	}
+	n, ok := toInt64(value)
+	if !ok {
+		return nil, fmt.Errorf("variable %s is not a number", name)
+	}
+	return n, nil
+}
+
+// variableArgs unpacks (name[, scope]) arguments
+func variableArgs(args []interface{}) (string, string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", "", fmt.Errorf("expected (name[, scope])")
+	}
+	scope := ScopeGlobal
+	if len(args) == 2 {
+		scope = toString(args[1])
+	}
+	return toString(args[0]), scope, nil
+}
+
+func exprInt(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	n, ok := toInt64(args[0])
+	if !ok {
+		return nil, fmt.Errorf("not a number: %v", args[0])
+	}
+	return n, nil
+}
+
+func exprStr(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	return toString(args[0]), nil
+}
+
+func exprLen(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	return int64(len(toString(args[0]))), nil
+}
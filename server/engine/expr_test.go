@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	ctx := &PacketContext{Fields: map[string]interface{}{
+		"port":  int64(8080),
+		"code":  "010",
+		"name":  "abc",
+		"ratio": 2.9,
+		"empty": nil,
+	}}
+
+	tests := []struct {
+		expr    string
+		want    interface{}
+		wantErr string
+	}{
+		// precedence and associativity
+		{"1 + 2 * 3", int64(7), ""},
+		{"(1 + 2) * 3", int64(9), ""},
+		{"10 - 4 - 3", int64(3), ""},
+		{"20 / 2 / 5", int64(2), ""},
+		{"7 % 4 * 2", int64(6), ""},
+		{"-2 * 3", int64(-6), ""},
+		{"2 - -3", int64(5), ""},
+		{"-(1 + 2)", int64(-3), ""},
+
+		// literals
+		{"010", int64(10), ""},
+		{"0x1F + 0X01", int64(32), ""},
+		{"0", int64(0), ""},
+		{`"a\"b"`, `a"b`, ""},
+		{"9223372036854775807", int64(9223372036854775807), ""},
+		{"0b101", nil, "invalid number: 0b101"},
+		{"0o17", nil, "invalid number: 0o17"},
+		{"1_000", nil, "invalid number: 1_000"},
+		{"0x", nil, "invalid number: 0x"},
+		{"0xfg", nil, "invalid number: 0xfg"},
+		{"9223372036854775808", nil, "invalid number"},
+
+		// fields and concatenation
+		{"port + 1", int64(8081), ""},
+		{"code + 1", int64(11), ""},
+		{"ratio * 2", int64(4), ""},
+		{`name + "d"`, "abcd", ""},
+		{`"x" + 1`, "x1", ""},
+		{"empty + 1", "1", ""},
+		{`len(name) * 2`, int64(6), ""},
+		{`int("42") + 1`, int64(43), ""},
+		{`str(7) + str(8)`, int64(15), ""}, // numeric strings add
+
+		// missing variables: var() yields nothing, counter() starts at 0
+		{`counter("expr_test_missing") + 1`, int64(1), ""},
+		{`var("expr_test_missing") + 1`, "1", ""},
+		{`var("expr_test_missing") * 2`, nil, "operator * needs numbers"},
+
+		// errors
+		{"missing + 1", nil, "unknown field in expression: missing"},
+		{"nope(1)", nil, "unknown function: nope"},
+		{"1 / 0", nil, "division by zero"},
+		{"1 % 0", nil, "division by zero"},
+		{`name * 2`, nil, "operator * needs numbers"},
+		{"(1 + 2", nil, "missing )"},
+		{"len(1, 2)", nil, "len: expected 1 argument"},
+		{"len(1", nil, "missing ) after arguments of len"},
+		{"1 +", nil, "unexpected end of expression"},
+		{"1 2", nil, `unexpected "2"`},
+		{`"open`, nil, "unterminated string"},
+		{"", nil, "unexpected end of expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := EvaluateExpression(tt.expr, ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
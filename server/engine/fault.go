@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection actions. Each action fires on action.Percent of matched packets (default 100)
+// and is applied to the final bytes after repackaging, so corrupted checksums stay corrupted.
+// All randomness comes from a per-packet seed recorded in the process log; running the same
+// packet through the test API with that seed reproduces the same faults.
+
+// Fault operations
+const (
+	FaultBitflip     = "bitflip"      // Flip action.Value random bits (default 1) in the field or region
+	FaultDuplicate   = "duplicate"    // Send action.Value extra copies (default 1)
+	FaultTruncate    = "truncate"     // Cut the packet to action.Value bytes (default random)
+	FaultBadChecksum = "bad_checksum" // Corrupt the ip, tcp or udp checksum (default: transport if present)
+)
+
+var (
+	faultBaseSeed int64
+	faultCounter  atomic.Int64
+)
+
+// SetFaultSeed sets the base from which per-packet seeds are derived; 0 picks one from the clock.
+// Returns the base seed in use.
+func SetFaultSeed(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	faultBaseSeed = seed
+	faultCounter.Store(0)
+	return seed
+}
+
+// nextFaultSeed derives the seed of the next packet (splitmix64 of base + counter)
+func nextFaultSeed() int64 {
+	z := uint64(faultBaseSeed) + uint64(faultCounter.Add(1))*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	seed := int64(z ^ z>>31)
+	if seed == 0 {
+		seed = 1
+	}
+	return seed
+}
+
+// random returns the packet's random source, assigning a seed on first use
+func (ctx *PacketContext) random() *rand.Rand {
+	if ctx.rng == nil {
+		if ctx.FaultSeed == 0 {
+			ctx.FaultSeed = nextFaultSeed()
+		}
+		ctx.rng = rand.New(rand.NewSource(ctx.FaultSeed))
+	}
+	return ctx.rng
+}
+
+// HasFaults reports whether fault actions fired for this packet
+func (ctx *PacketContext) HasFaults() bool {
+	return len(ctx.faults) > 0
+}
+
+// executeFault rolls the action's percentage and queues it for ApplyFaults
+func executeFault(action Action, ctx *PacketContext) error {
+	// Validate before rolling so misconfigured rules fail on every packet
+	if action.Op == FaultBitflip {
+		if _, _, err := faultRegion(action, ctx); err != nil {
+			return err
+		}
+	}
+
+	percent := action.Percent
+	if percent == 0 {
+		percent = 100
+	}
+	if ctx.random().Float64()*100 >= percent {
+		return nil
+	}
+
+	ctx.faults = append(ctx.faults, action)
+	return nil
+}
+
+// FaultResult is the outcome of ApplyFaults
+type FaultResult struct {
+	Packet     []byte
+	Duplicates int      // Extra copies to send
+	Applied    []string // Descriptions for the log
+}
+
+// ApplyFaults applies the faults that fired to the final packet bytes
+func ApplyFaults(ctx *PacketContext, packet []byte) (FaultResult, error) {
+	result := FaultResult{Packet: append([]byte(nil), packet...)}
+	rng := ctx.random()
+
+	for _, action := range ctx.faults {
+		switch action.Op {
+		case FaultBitflip:
+			offset, length, err := faultRegion(action, ctx)
+			if err != nil {
+				return result, err
+			}
+			if offset+length > len(result.Packet) {
+				length = len(result.Packet) - offset
+			}
+			if length <= 0 {
+				continue
+			}
+			bits, err := faultCount(action.Value)
+			if err != nil {
+				return result, err
+			}
+			for i := 0; i < bits; i++ {
+				bit := rng.Intn(length * 8)
+				result.Packet[offset+bit/8] ^= 0x80 >> (bit % 8)
+				result.Applied = append(result.Applied, fmt.Sprintf("bitflip byte %d bit %d", offset+bit/8, bit%8))
+			}
+
+		case FaultDuplicate:
+			copies, err := faultCount(action.Value)
+			if err != nil {
+				return result, err
+			}
+			result.Duplicates += copies
+			result.Applied = append(result.Applied, fmt.Sprintf("duplicate x%d", copies))
+
+		case FaultTruncate:
+			if len(result.Packet) < 2 {
+				continue
+			}
+			length := 1 + rng.Intn(len(result.Packet)-1)
+			if action.Value != "" {
+				n, err := strconv.Atoi(action.Value)
+				if err != nil || n < 0 {
+					return result, fmt.Errorf("invalid truncate length: %s", action.Value)
+				}
+				length = n
+			}
+			if length < len(result.Packet) {
+				result.Packet = result.Packet[:length]
+				result.Applied = append(result.Applied, fmt.Sprintf("truncate to %d bytes", length))
+			}
+
+		case FaultBadChecksum:
+			desc, err := corruptChecksum(result.Packet, action.Value, rng)
+			if err != nil {
+				return result, err
+			}
+			result.Applied = append(result.Applied, desc)
+		}
+	}
+
+	return result, nil
+}
+
+// faultRegion returns the byte range a bitflip works on: action.Region ("offset:length"),
+// the field named by action.Field, or the whole packet
+func faultRegion(action Action, ctx *PacketContext) (int, int, error) {
+	if action.Region != "" {
+		offsetStr, lengthStr, ok := strings.Cut(action.Region, ":")
+		offset, err1 := strconv.Atoi(offsetStr)
+		length, err2 := strconv.Atoi(lengthStr)
+		if !ok || err1 != nil || err2 != nil || offset < 0 || length <= 0 {
+			return 0, 0, fmt.Errorf("region must be offset:length, got %q", action.Region)
+		}
+		return offset, length, nil
+	}
+
+	if action.Field != "" {
+		field, ok := ctx.fieldDef(action.Field)
+		if !ok || field.Type == "builtin" {
+			return 0, 0, fmt.Errorf("bitflip needs a custom field or a region: %s", action.Field)
+		}
+		// Fields before a grown or shrunk one have moved in the repackaged packet
+		for _, segment := range ctx.segments {
+			if segment.IsUserField && segment.FieldName == action.Field {
+				return segment.NewOffset, segment.NewLength, nil
+			}
+		}
+		return field.Offset, field.Length, nil
+	}
+
+	return 0, len(ctx.RawPacket), nil
+}
+
+func faultCount(value string) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid count: %s", value)
+	}
+	return n, nil
+}
+
+// corruptChecksum XORs a checksum of the final packet with a random non-zero value
+func corruptChecksum(packet []byte, which string, rng *rand.Rand) (string, error) {
+	parsed, err := ParsePacket(packet)
+	if err != nil {
+		return "", err
+	}
+
+	if which == "" {
+		switch {
+		case parsed.TCPLayer != nil:
+			which = "tcp"
+		case parsed.UDPLayer != nil:
+			which = "udp"
+		default:
+			which = "ip"
+		}
+	}
+
+	offset := -1
+	switch which {
+	case "ip":
+		if o := parsed.LayerOffset(parsed.IPv4Layer); o >= 0 {
+			offset = o + 10
+		}
+	case "tcp":
+		if o := parsed.LayerOffset(parsed.TCPLayer); o >= 0 {
+			offset = o + 16
+		}
+	case "udp":
+		if o := parsed.LayerOffset(parsed.UDPLayer); o >= 0 {
+			offset = o + 6
+		}
+	default:
+		return "", fmt.Errorf("bad_checksum target must be ip, tcp or udp")
+	}
+	if offset < 0 || offset+2 > len(packet) {
+		return "", fmt.Errorf("packet has no %s checksum", which)
+	}
+
+	noise := uint16(rng.Intn(0xffff) + 1)
+	binary.BigEndian.PutUint16(packet[offset:], binary.BigEndian.Uint16(packet[offset:])^noise)
+	return fmt.Sprintf("bad %s checksum", which), nil
+}
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+)
+
+// Rewrites can grow a packet past the MTU of the port it leaves on. ApplyMTU runs on the
+// final bytes: oversized IPv4 packets are split into fragments (RFC 791), or refused with
+// an ICMP fragmentation-needed reply when DF is set (RFC 1191).
+
+// minIPv4MTU is the MTU every IPv4 link must support
+const minIPv4MTU = 68
+
+// FragmentResult says how to send a packet larger than the egress MTU
+type FragmentResult struct {
+	Fragments [][]byte // Fragments to send instead of the packet
+	Reply     []byte   // ICMP fragmentation-needed reply (starting at the IP header); the packet is dropped
+}
+
+// ApplyMTU checks the final packet against ctx.MTU. The result is empty when the packet fits,
+// ctx.MTU is 0 or the packet isn't IPv4; oversized IPv6 packets only get a warning.
+func ApplyMTU(ctx *PacketContext, packet []byte) (FragmentResult, error) {
+	var result FragmentResult
+	if ctx.MTU <= 0 {
+		return result, nil
+	}
+
+	if ctx.IPv4Layer == nil {
+		// Only the sender may fragment IPv6
+		if offset := ctx.LayerOffset(ctx.IPv6Layer); offset >= 0 && len(packet)-offset > ctx.MTU {
+			ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("IPv6 packet of %d bytes exceeds MTU %d", len(packet)-offset, ctx.MTU))
+		}
+		return result, nil
+	}
+
+	offset := ctx.LayerOffset(ctx.IPv4Layer)
+	if offset < 0 || offset+20 > len(packet) {
+		return result, fmt.Errorf("IPv4 header not found")
+	}
+	ip := packet[offset:]
+	size := int(binary.BigEndian.Uint16(ip[2:4]))
+	if size <= ctx.MTU {
+		return result, nil
+	}
+	if ctx.MTU < minIPv4MTU {
+		return result, fmt.Errorf("MTU %d is below the IPv4 minimum of %d", ctx.MTU, minIPv4MTU)
+	}
+
+	if binary.BigEndian.Uint16(ip[6:8])&0x4000 != 0 {
+		// The sender knows its packet before our rewrite, so ask for room for the growth too
+		nextHop := ctx.MTU - (size - int(ctx.IPv4Layer.Length))
+		if nextHop < minIPv4MTU {
+			nextHop = minIPv4MTU
+		}
+		reply, err := buildFragmentationNeeded(ctx, nextHop)
+		if err != nil {
+			return result, fmt.Errorf("failed to build fragmentation-needed reply: %w", err)
+		}
+		result.Reply = reply
+		return result, nil
+	}
+
+	fragments, err := FragmentIPv4(ip, ctx.MTU)
+	if err != nil {
+		return result, err
+	}
+	// Fragments keep the link-layer header, if any, so test mode shows complete frames
+	for i, fragment := range fragments {
+		fragments[i] = append(append([]byte(nil), packet[:offset]...), fragment...)
+	}
+	result.Fragments = fragments
+	return result, nil
+}
+
+// FragmentIPv4 splits the IPv4 packet at the start of ip into fragments of at most mtu bytes,
+// ignoring DF. Fragments of a fragment keep its offset and more-fragments flag.
+func FragmentIPv4(ip []byte, mtu int) ([][]byte, error) {
+	headerLen := int(ip[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:4]))
+	if headerLen < 20 || total < headerLen || total > len(ip) {
+		return nil, fmt.Errorf("invalid IPv4 header (header %d bytes, total length %d, %d bytes captured)", headerLen, total, len(ip))
+	}
+
+	header := ip[:headerLen]
+	laterHeader := copiedOptionsHeader(header)
+	payload := ip[headerLen:total]
+
+	flags := binary.BigEndian.Uint16(ip[6:8])
+	fragOffset := int(flags&0x1fff) * 8
+	moreFragments := flags&0x2000 != 0
+
+	// The kernel picks a new ID for each raw packet with ID 0, which would break reassembly
+	id := binary.BigEndian.Uint16(ip[4:6])
+	for id == 0 {
+		id = uint16(rand.Uint32())
+	}
+
+	var fragments [][]byte
+	for len(payload) > 0 {
+		hdr := header
+		if fragments != nil {
+			hdr = laterHeader
+		}
+		chunk := (mtu - len(hdr)) &^ 7
+		if chunk <= 0 {
+			return nil, fmt.Errorf("MTU %d leaves no room for data after a %d byte header", mtu, len(hdr))
+		}
+		last := chunk >= len(payload)
+		if last {
+			chunk = len(payload)
+		}
+
+		fragment := make([]byte, len(hdr)+chunk)
+		copy(fragment, hdr)
+		copy(fragment[len(hdr):], payload[:chunk])
+
+		fragment[0] = 0x40 | byte(len(hdr)/4)
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		binary.BigEndian.PutUint16(fragment[4:6], id)
+		fragFlags := uint16(fragOffset/8) | flags&0x8000
+		if !last || moreFragments {
+			fragFlags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(fragment[6:8], fragFlags)
+		setIPv4HeaderChecksum(fragment, 0)
+
+		fragments = append(fragments, fragment)
+		payload = payload[chunk:]
+		fragOffset += chunk
+	}
+	return fragments, nil
+}
+
+// copiedOptionsHeader returns the header for fragments after the first: only options with
+// the copied flag are repeated, padded with end-of-options to a multiple of 4 bytes
+func copiedOptionsHeader(header []byte) []byte {
+	result := append([]byte(nil), header[:20]...)
+	options := header[20:]
+	for len(options) > 0 {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			break
+		}
+		length := int(options[1])
+		if kind&0x80 != 0 {
+			result = append(result, options[:length]...)
+		}
+		options = options[length:]
+	}
+	for len(result)%4 != 0 {
+		result = append(result, 0)
+	}
+	return result
+}
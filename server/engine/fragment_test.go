@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// ipv4TestPacket builds an IPv4 packet by hand with the given options, flags/offset word and payload size
+func ipv4TestPacket(options []byte, flags uint16, payloadLen int) []byte {
+	headerLen := 20 + len(options)
+	packet := make([]byte, headerLen+payloadLen)
+	packet[0] = 0x40 | byte(headerLen/4)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], 0x4242)
+	binary.BigEndian.PutUint16(packet[6:8], flags)
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], []byte{10, 0, 0, 1})
+	copy(packet[16:20], []byte{10, 0, 0, 2})
+	copy(packet[20:], options)
+	for i := headerLen; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	setIPv4HeaderChecksum(packet, 0)
+	return packet
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	recordRoute := []byte{0x07, 0x07, 0x04, 0, 0, 0, 0} // Not copied
+	routerAlert := []byte{0x94, 0x04, 0, 0}             // Copied
+	withCopied := append(append(append([]byte(nil), recordRoute...), routerAlert...), 0)
+	withoutCopied := append(append([]byte(nil), recordRoute...), 0)
+
+	tests := []struct {
+		name        string
+		packet      []byte
+		mtu         int
+		laterHeader []byte // Options of fragments after the first
+		wantOffset  int    // Offset of the first fragment
+		wantLastMF  bool
+	}{
+		{"no options", ipv4TestPacket(nil, 0, 1000), 300, nil, 0, false},
+		{"copied option", ipv4TestPacket(withCopied, 0, 1000), 300, routerAlert, 0, false},
+		{"no copied option", ipv4TestPacket(withoutCopied, 0, 1000), 300, nil, 0, false},
+		{"fragment with more fragments", ipv4TestPacket(nil, 0x2000|100, 1000), 500, nil, 800, true},
+		{"last fragment", ipv4TestPacket(nil, 100, 1000), 500, nil, 800, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fragments, err := FragmentIPv4(tt.packet, tt.mtu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fragments) < 2 {
+				t.Fatalf("got %d fragments", len(fragments))
+			}
+
+			headerLen := int(tt.packet[0]&0x0f) * 4
+			payload := tt.packet[headerLen:]
+			offset := tt.wantOffset
+			for i, fragment := range fragments {
+				if len(fragment) > tt.mtu {
+					t.Errorf("fragment %d: %d bytes exceeds MTU %d", i, len(fragment), tt.mtu)
+				}
+				if internetChecksum(fragment[:int(fragment[0]&0x0f)*4], 0) != 0 {
+					t.Errorf("fragment %d: bad header checksum", i)
+				}
+				if binary.BigEndian.Uint16(fragment[4:6]) != 0x4242 {
+					t.Errorf("fragment %d: ID changed", i)
+				}
+
+				fragHeaderLen := int(fragment[0]&0x0f) * 4
+				wantHeader := tt.packet[:headerLen]
+				if i > 0 {
+					wantHeader = append(append([]byte(nil), tt.packet[:20]...), tt.laterHeader...)
+				}
+				if fragHeaderLen != len(wantHeader) || !bytes.Equal(fragment[20:fragHeaderLen], wantHeader[20:]) {
+					t.Errorf("fragment %d: options % x, want % x", i, fragment[20:fragHeaderLen], wantHeader[20:])
+				}
+
+				flags := binary.BigEndian.Uint16(fragment[6:8])
+				if got := int(flags&0x1fff) * 8; got != offset {
+					t.Errorf("fragment %d: offset %d, want %d", i, got, offset)
+				}
+				last := i == len(fragments)-1
+				wantMF := !last || tt.wantLastMF
+				if got := flags&0x2000 != 0; got != wantMF {
+					t.Errorf("fragment %d: more fragments %v, want %v", i, got, wantMF)
+				}
+
+				data := fragment[fragHeaderLen:]
+				if !last && len(data)%8 != 0 {
+					t.Errorf("fragment %d: %d data bytes, not a multiple of 8", i, len(data))
+				}
+				start := offset - tt.wantOffset
+				if !bytes.Equal(data, payload[start:start+len(data)]) {
+					t.Errorf("fragment %d: data doesn't match the payload at %d", i, start)
+				}
+				offset += len(data)
+			}
+			if offset-tt.wantOffset != len(payload) {
+				t.Errorf("fragments carry %d bytes, want %d", offset-tt.wantOffset, len(payload))
+			}
+		})
+	}
+}
+
+func TestApplyMTUFragmentationNeeded(t *testing.T) {
+	tests := []struct {
+		name        string
+		received    int // Payload size as received
+		rewritten   int // Payload size after the rewrite
+		mtu         int
+		wantNextHop int
+	}{
+		// The sender must leave room for the 100 bytes the rewrite adds
+		{"room for growth", 980, 1080, 1050, 950},
+		{"clamped to the IPv4 minimum", 20, 120, 100, 68},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := ParsePacket(ipv4TestPacket(nil, 0x4000, tt.received))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx.MTU = tt.mtu
+
+			result, err := ApplyMTU(ctx, ipv4TestPacket(nil, 0x4000, tt.rewritten))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Fragments != nil || result.Reply == nil {
+				t.Fatalf("got %d fragments and reply %v, want a reply only", len(result.Fragments), result.Reply != nil)
+			}
+
+			reply := result.Reply
+			icmp := reply[int(reply[0]&0x0f)*4:]
+			if icmp[0] != 3 || icmp[1] != 4 {
+				t.Errorf("got ICMP type %d code %d, want 3/4", icmp[0], icmp[1])
+			}
+			if got := int(binary.BigEndian.Uint16(icmp[6:8])); got != tt.wantNextHop {
+				t.Errorf("next-hop MTU %d, want %d", got, tt.wantNextHop)
+			}
+			if !bytes.Equal(reply[12:16], []byte{10, 0, 0, 2}) || !bytes.Equal(reply[16:20], []byte{10, 0, 0, 1}) {
+				t.Errorf("reply goes from %v to %v", reply[12:16], reply[16:20])
+			}
+		})
+	}
+}
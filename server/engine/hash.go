@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync"
+)
+
+// Hash and encoding functions for expressions. Arguments are used as their string
+// form, so hex fields are hashed as hex text; use hex_decode(field) to hash raw bytes.
+// Digests are returned as lowercase hex, crc32 as a number.
+
+var (
+	keysMu sync.RWMutex
+	keys   = map[string][]byte{}
+)
+
+// SetKeys replaces the secret keys available to hmac_sha256 and anonymize (name -> key)
+func SetKeys(k map[string][]byte) {
+	keysMu.Lock()
+	keys = k
+	keysMu.Unlock()
+	resetAnonymizers()
+}
+
+func init() {
+	exprFunctions["md5"] = digestFunc(md5.New)
+	exprFunctions["sha1"] = digestFunc(sha1.New)
+	exprFunctions["sha256"] = digestFunc(sha256.New)
+	exprFunctions["hmac_sha256"] = exprHMACSHA256
+	exprFunctions["crc32"] = exprCRC32
+	exprFunctions["base64_encode"] = exprBase64Encode
+	exprFunctions["base64_decode"] = exprBase64Decode
+	exprFunctions["hex_encode"] = exprHexEncode
+	exprFunctions["hex_decode"] = exprHexDecode
+}
+
+// digestFunc hashes the concatenation of all arguments
+func digestFunc(newHash func() hash.Hash) exprFunc {
+	return func(_ *PacketContext, args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expected at least 1 argument")
+		}
+		h := newHash()
+		for _, arg := range args {
+			h.Write([]byte(toString(arg)))
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+// exprHMACSHA256 signs the concatenation of the arguments after the key name
+func exprHMACSHA256(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("expected (key_name, value...)")
+	}
+
+	name := toString(args[0])
+	keysMu.RLock()
+	key, ok := keys[name]
+	keysMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key not found: %s", name)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	for _, arg := range args[1:] {
+		mac.Write([]byte(toString(arg)))
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func exprCRC32(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	return int64(crc32.ChecksumIEEE([]byte(toString(args[0])))), nil
+}
+
+func exprBase64Encode(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	return base64.StdEncoding.EncodeToString([]byte(toString(args[0]))), nil
+}
+
+func exprBase64Decode(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(toString(args[0])))
+	if err != nil {
+		return nil, err
+	}
+	return string(decoded), nil
+}
+
+func exprHexEncode(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	return hex.EncodeToString([]byte(toString(args[0]))), nil
+}
+
+func exprHexDecode(_ *PacketContext, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument")
+	}
+	decoded, err := hex.DecodeString(strings.ReplaceAll(toString(args[0]), " ", ""))
+	if err != nil {
+		return nil, err
+	}
+	return string(decoded), nil
+}
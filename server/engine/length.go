@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Length fields declare the size of a region of the packet (Field.LengthOf), e.g. the length
+// word of an application header. They are recomputed after the packet is reassembled, so
+// growing a string field keeps the lengths around it truthful.
+
+// lengthRegion is a parsed LengthOf: each end is a field name, an original offset or "end"
+type lengthRegion struct {
+	start, end string
+}
+
+// ValidateLengthRegion checks the syntax of a Field.LengthOf
+func ValidateLengthRegion(s string) error {
+	_, err := parseLengthRegion(s)
+	return err
+}
+
+// parseLengthRegion parses "field", "first..last", "field..end" or "0x2a..end".
+// Field names measure from the start of the first to the end of the last field; numeric
+// offsets refer to the packet as received.
+func parseLengthRegion(s string) (lengthRegion, error) {
+	startStr, endStr, isRange := strings.Cut(strings.TrimSpace(s), "..")
+	region := lengthRegion{start: strings.TrimSpace(startStr), end: strings.TrimSpace(endStr)}
+	if !isRange {
+		region.end = region.start
+	}
+
+	if region.start == "" || region.end == "" || region.start == "end" {
+		return lengthRegion{}, fmt.Errorf("length region must be field, first..last or start..end, got %q", s)
+	}
+	if !isRange && isOffset(region.start) {
+		return lengthRegion{}, fmt.Errorf("length region of a single offset is empty: %q", s)
+	}
+	return region, nil
+}
+
+func isOffset(s string) bool {
+	_, err := strconv.ParseInt(s, 0, 64)
+	return err == nil
+}
+
+// applyLengthFields writes the length fields into the reassembled packet. segments must
+// carry the positions filled in by reassemblePacket.
+func applyLengthFields(packet []byte, segments []FieldSegment, ctx *PacketContext) {
+	for _, segment := range segments {
+		if !segment.IsUserField || segment.Field.LengthOf == "" {
+			continue
+		}
+		field := segment.Field
+
+		region, err := parseLengthRegion(field.LengthOf)
+		if err != nil {
+			ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("length field %s: %v", field.Name, err))
+			continue
+		}
+		start, err := regionBound(region.start, false, packet, segments)
+		if err == nil {
+			var end int
+			end, err = regionBound(region.end, true, packet, segments)
+			if err == nil && end < start {
+				err = fmt.Errorf("region %q ends before it starts", field.LengthOf)
+			}
+			if err == nil {
+				err = writeLength(packet, segment, end-start+field.LengthAdjust)
+			}
+		}
+		if err != nil {
+			ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("length field %s not updated: %v", field.Name, err))
+		}
+	}
+}
+
+// regionBound returns the position of a region start or end in the reassembled packet
+func regionBound(bound string, isEnd bool, packet []byte, segments []FieldSegment) (int, error) {
+	if bound == "end" {
+		return len(packet), nil
+	}
+
+	if offset, err := strconv.ParseInt(bound, 0, 64); err == nil {
+		return mapOffset(int(offset), packet, segments)
+	}
+
+	for _, segment := range segments {
+		if segment.IsUserField && segment.FieldName == bound {
+			if isEnd {
+				return segment.NewOffset + segment.NewLength, nil
+			}
+			return segment.NewOffset, nil
+		}
+	}
+	return 0, fmt.Errorf("field not found: %s", bound)
+}
+
+// mapOffset translates an offset of the received packet to the reassembled one. Offsets
+// inside a resized field stick to its end if the field shrank past them.
+func mapOffset(offset int, packet []byte, segments []FieldSegment) (int, error) {
+	for _, segment := range segments {
+		if offset >= segment.Offset && offset < segment.Offset+segment.Length {
+			delta := offset - segment.Offset
+			if delta > segment.NewLength {
+				delta = segment.NewLength
+			}
+			return segment.NewOffset + delta, nil
+		}
+	}
+
+	if n := len(segments); n > 0 && offset == segments[n-1].Offset+segments[n-1].Length {
+		return len(packet), nil
+	}
+	return 0, fmt.Errorf("offset %d is outside the packet", offset)
+}
+
+// writeLength stores length in the field's bytes, big-endian unless the field says otherwise
+func writeLength(packet []byte, segment FieldSegment, length int) error {
+	width := segment.Field.Length
+	if width <= 0 || width > 8 || segment.NewOffset+width > len(packet) {
+		return fmt.Errorf("field is %d bytes", width)
+	}
+	if length < 0 || (width < 8 && uint64(length) >= 1<<(8*width)) {
+		return fmt.Errorf("length %d does not fit in %d bytes", length, width)
+	}
+
+	encoded := intToBytes(int64(length), width)
+	if segment.Field.LittleEndian {
+		for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+			encoded[i], encoded[j] = encoded[j], encoded[i]
+		}
+	}
+	copy(packet[segment.NewOffset:], encoded)
+	return nil
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Lookup miss actions
+const (
+	LookupMissKeep    = "keep"
+	LookupMissDefault = "default"
+	LookupMissDrop    = "drop"
+)
+
+// LookupTable is the in-memory form of a mapping table
+type LookupTable struct {
+	MissAction   string
+	DefaultValue string
+	Entries      map[string]string
+}
+
+var (
+	lookupMu     sync.RWMutex
+	lookupTables = map[string]*LookupTable{}
+)
+
+// SetLookupTables replaces the loaded lookup tables (name -> table)
+func SetLookupTables(tables map[string]*LookupTable) {
+	lookupMu.Lock()
+	lookupTables = tables
+	lookupMu.Unlock()
+}
+
+// executeMap replaces the field value with its mapping from the table named by action.Value
+func executeMap(action Action, ctx *PacketContext) error {
+	lookupMu.RLock()
+	table, ok := lookupTables[action.Value]
+	lookupMu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("lookup table not found: %s", action.Value)
+	}
+
+	current := ctx.Fields[action.Field]
+	if current == nil {
+		return fmt.Errorf("field %s has no value", action.Field)
+	}
+
+	if mapped, found := table.Entries[fmt.Sprintf("%v", current)]; found {
+		ctx.Fields[action.Field] = mapped
+		return nil
+	}
+
+	switch table.MissAction {
+	case LookupMissDefault:
+		ctx.Fields[action.Field] = table.DefaultValue
+	case LookupMissDrop:
+		ctx.Verdict = VerdictDrop
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PacketMark is the netfilter mark a rule sets on accepted packets
+type PacketMark struct {
+	Value     uint32 `json:"value"`
+	Mask      uint32 `json:"mask"`      // Bits of the mark that are set; other bits keep their value
+	Conntrack bool   `json:"conntrack"` // Also set the connection's conntrack mark
+}
+
+// Apply returns the mark resulting from setting m on a packet currently marked current
+func (m PacketMark) Apply(current uint32) uint32 {
+	return current&^m.Mask | m.Value&m.Mask
+}
+
+func (m PacketMark) String() string {
+	s := fmt.Sprintf("0x%x/0x%x", m.Value, m.Mask)
+	if m.Conntrack {
+		s += " (conntrack)"
+	}
+	return s
+}
+
+// executeMark records the mark given as "value" or "value/mask" (decimal or 0x hex).
+// Marks of several actions combine, later actions winning for overlapping bits.
+func executeMark(action Action, ctx *PacketContext) error {
+	value, mask, err := parseMark(action.Value)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Mark == nil {
+		ctx.Mark = &PacketMark{}
+	}
+	ctx.Mark.Value = ctx.Mark.Value&^mask | value&mask
+	ctx.Mark.Mask |= mask
+	ctx.Mark.Conntrack = ctx.Mark.Conntrack || action.Conntrack
+	return nil
+}
+
+func parseMark(s string) (uint32, uint32, error) {
+	valueStr, maskStr, hasMask := strings.Cut(strings.TrimSpace(s), "/")
+
+	value, err := strconv.ParseUint(strings.TrimSpace(valueStr), 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid mark: %s", s)
+	}
+
+	mask := uint64(0xffffffff)
+	if hasMask {
+		mask, err = strconv.ParseUint(strings.TrimSpace(maskStr), 0, 32)
+		if err != nil || mask == 0 {
+			return 0, 0, fmt.Errorf("invalid mark mask: %s", s)
+		}
+	}
+
+	return uint32(value), uint32(mask), nil
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Which packet a mirror action copies
+const (
+	MirrorModified = "modified"
+	MirrorOriginal = "original"
+	MirrorBoth     = "both"
+)
+
+// Mirror target kinds, written as "iface:<name>" or "pcap:<path>"
+const (
+	MirrorTargetInterface = "iface"
+	MirrorTargetPcap      = "pcap"
+)
+
+// mirrorPcapDir is the directory pcap mirror targets are written under
+var mirrorPcapDir = "./mirror"
+
+// SetMirrorPcapDir sets the directory pcap mirror targets are confined to; call at startup
+func SetMirrorPcapDir(dir string) {
+	if dir != "" {
+		mirrorPcapDir = dir
+	}
+}
+
+// MirrorRequest asks the packet handler to copy the packet somewhere once its verdict is set
+type MirrorRequest struct {
+	Kind        string `json:"kind"`        // iface or pcap
+	Destination string `json:"destination"` // Interface name or pcap file path
+	Copy        string `json:"copy"`        // original, modified or both
+}
+
+// ParseMirrorTarget splits a mirror target into its kind and destination
+func ParseMirrorTarget(target string) (string, string, error) {
+	kind, destination, ok := strings.Cut(target, ":")
+	if !ok || destination == "" {
+		return "", "", fmt.Errorf("mirror target must be iface:<name> or pcap:<path>, got %q", target)
+	}
+
+	switch kind {
+	case MirrorTargetInterface:
+		return kind, destination, nil
+	case MirrorTargetPcap:
+		path, err := pcapPath(destination)
+		if err != nil {
+			return "", "", err
+		}
+		return kind, path, nil
+	default:
+		return "", "", fmt.Errorf("unknown mirror target kind: %s", kind)
+	}
+}
+
+// pcapPath resolves a pcap target against the pcap directory. Relative paths are taken
+// from the directory; absolute paths must lie inside it. ".." is never allowed.
+func pcapPath(destination string) (string, error) {
+	for _, element := range strings.Split(filepath.ToSlash(destination), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("pcap path must not contain \"..\": %s", destination)
+		}
+	}
+
+	dir, err := filepath.Abs(mirrorPcapDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid pcap directory: %w", err)
+	}
+	if !filepath.IsAbs(destination) {
+		return filepath.Join(dir, destination), nil
+	}
+
+	path := filepath.Clean(destination)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("pcap path must be inside %s: %s", dir, destination)
+	}
+	return path, nil
+}
+
+// executeMirror records a mirror request; the copy is sent after the verdict so it never delays the packet
+func executeMirror(action Action, ctx *PacketContext) error {
+	kind, destination, err := ParseMirrorTarget(action.Value)
+	if err != nil {
+		return err
+	}
+
+	copyOf := action.Copy
+	switch copyOf {
+	case "":
+		copyOf = MirrorModified
+	case MirrorModified, MirrorOriginal, MirrorBoth:
+	default:
+		return fmt.Errorf("mirror copy must be original, modified or both")
+	}
+
+	ctx.Mirrors = append(ctx.Mirrors, MirrorRequest{Kind: kind, Destination: destination, Copy: copyOf})
+	return nil
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPcapPath(t *testing.T) {
+	saved := mirrorPcapDir
+	t.Cleanup(func() { mirrorPcapDir = saved })
+	root := t.TempDir()
+	dir := filepath.Join(root, "mirror")
+	SetMirrorPcapDir(dir)
+
+	tests := []struct {
+		destination string
+		want        string // empty: rejected
+	}{
+		{"capture.pcap", filepath.Join(dir, "capture.pcap")},
+		{"..capture.pcap", filepath.Join(dir, "..capture.pcap")},
+		{"sub/capture.pcap", filepath.Join(dir, "sub", "capture.pcap")},
+		{filepath.Join(dir, "capture.pcap"), filepath.Join(dir, "capture.pcap")},
+		{filepath.Join(dir, "..capture.pcap"), filepath.Join(dir, "..capture.pcap")},
+		{"../capture.pcap", ""},
+		{"sub/../../capture.pcap", ""},
+		{dir, ""},
+		{root, ""},
+		{filepath.Join(root, "capture.pcap"), ""},
+		{filepath.Join(root, "mirror2", "capture.pcap"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			got, err := pcapPath(tt.destination)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("accepted as %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
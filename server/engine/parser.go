@@ -4,9 +4,12 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"packet-repackage/models"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -19,37 +22,89 @@ type PacketContext struct {
 	Packet     gopacket.Packet
 	EtherLayer *layers.Ethernet
 	IPv4Layer  *layers.IPv4
+	IPv6Layer  *layers.IPv6
 	TCPLayer   *layers.TCP
 	UDPLayer   *layers.UDP
+	Verdict    string          // Set by drop/reject actions, empty to forward the packet
+	RuleID     uint            // Rule being evaluated, owner of rule-scoped variables
+	DryRun     bool            // Test mode: variable changes stay local to this packet
+	Mirrors    []MirrorRequest // Copies to send once the verdict is set
+	Delay      time.Duration   // Hold the packet this long before issuing the verdict
+	FaultSeed  int64           // Seed of the packet's fault injection randomness, 0 until first used
+	Mark       *PacketMark     // Netfilter mark to set when the packet is accepted
+	Skipped    []string        // Errors of actions skipped by their on_error policy
+	Warnings   []string        // Problems that didn't stop processing, e.g. a length that couldn't be fixed
+	MTU        int             // Egress MTU the final packet is checked against (0 = unchecked)
+
+	fieldDefs        []models.Field // Definitions used by ExtractAllFields, reused when the packet is replaced
+	variableOverlay  map[variableKey]interface{}
+	pendingVariables []pendingVariable // Variable updates applied when the actions commit
+	fixChecksums     bool              // Set by actions that change checksummed bytes, e.g. anonymize
+	rng              *rand.Rand
+	faults           []Action       // Fault actions that fired, applied after repackaging
+	segments         []FieldSegment // Field positions in the repackaged packet, for faults
 }
 
-// Get5Tuple returns a string representation of the 5-tuple
-func (ctx *PacketContext) Get5Tuple() string {
-	var srcIP, dstIP string
-	var srcPort, dstPort int
-	proto := "unknown"
+// FiveTuple holds the addressing information of a packet
+type FiveTuple struct {
+	SrcIP    string `json:"src_ip"`
+	DstIP    string `json:"dst_ip"`
+	SrcPort  int    `json:"src_port"`
+	DstPort  int    `json:"dst_port"`
+	Protocol string `json:"protocol"`
+}
+
+// FiveTuple returns the 5-tuple of the packet (empty addresses for non-IP packets)
+func (ctx *PacketContext) FiveTuple() FiveTuple {
+	var tuple FiveTuple
+	tuple.Protocol = "unknown"
 
 	if ctx.IPv4Layer != nil {
-		srcIP = ctx.IPv4Layer.SrcIP.String()
-		dstIP = ctx.IPv4Layer.DstIP.String()
-		proto = ctx.IPv4Layer.Protocol.String()
+		tuple.SrcIP = ctx.IPv4Layer.SrcIP.String()
+		tuple.DstIP = ctx.IPv4Layer.DstIP.String()
+		tuple.Protocol = ctx.IPv4Layer.Protocol.String()
+	} else if ctx.IPv6Layer != nil {
+		tuple.SrcIP = ctx.IPv6Layer.SrcIP.String()
+		tuple.DstIP = ctx.IPv6Layer.DstIP.String()
+		tuple.Protocol = ctx.UpperProtocol().String()
 	}
 
 	if ctx.TCPLayer != nil {
-		srcPort = int(ctx.TCPLayer.SrcPort)
-		dstPort = int(ctx.TCPLayer.DstPort)
-		proto = "TCP"
+		tuple.SrcPort = int(ctx.TCPLayer.SrcPort)
+		tuple.DstPort = int(ctx.TCPLayer.DstPort)
+		tuple.Protocol = "TCP"
 	} else if ctx.UDPLayer != nil {
-		srcPort = int(ctx.UDPLayer.SrcPort)
-		dstPort = int(ctx.UDPLayer.DstPort)
-		proto = "UDP"
+		tuple.SrcPort = int(ctx.UDPLayer.SrcPort)
+		tuple.DstPort = int(ctx.UDPLayer.DstPort)
+		tuple.Protocol = "UDP"
 	}
 
-	if srcIP == "" {
+	return tuple
+}
+
+// Get5Tuple returns a string representation of the 5-tuple
+func (ctx *PacketContext) Get5Tuple() string {
+	tuple := ctx.FiveTuple()
+	if tuple.SrcIP == "" {
 		return "Non-IP Packet"
 	}
 
-	return fmt.Sprintf("%s:%d -> %s:%d [%s]", srcIP, srcPort, dstIP, dstPort, proto)
+	return fmt.Sprintf("%s:%d -> %s:%d [%s]", tuple.SrcIP, tuple.SrcPort, tuple.DstIP, tuple.DstPort, tuple.Protocol)
+}
+
+// firstLayerType determines whether a packet starts with an Ethernet or an IP header.
+// The queue delivers IP packets, test input is usually a captured Ethernet frame.
+func firstLayerType(rawPacket []byte) gopacket.LayerType {
+	// IPv4 starts with 0x45-0x4f (version 4)
+	// IPv6 starts with 0x6x (version 6)
+	switch rawPacket[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	default:
+		return layers.LayerTypeEthernet
+	}
 }
 
 // ParsePacket parses a raw packet and extracts basic layers
@@ -63,19 +118,7 @@ func ParsePacket(rawPacket []byte) (*PacketContext, error) {
 		Fields:    make(map[string]interface{}),
 	}
 
-	// Try to determine if it's Ethernet or IP
-	// IPv4 starts with 0x45-0x4f (version 4)
-	// IPv6 starts with 0x6x (version 6)
-	var packet gopacket.Packet
-	version := rawPacket[0] >> 4
-	if version == 4 {
-		packet = gopacket.NewPacket(rawPacket, layers.LayerTypeIPv4, gopacket.Default)
-	} else if version == 6 {
-		packet = gopacket.NewPacket(rawPacket, layers.LayerTypeIPv6, gopacket.Default)
-	} else {
-		packet = gopacket.NewPacket(rawPacket, layers.LayerTypeEthernet, gopacket.Default)
-	}
-
+	packet := gopacket.NewPacket(rawPacket, firstLayerType(rawPacket), gopacket.Default)
 	ctx.Packet = packet
 
 	// Extract common layers
@@ -87,6 +130,10 @@ func ParsePacket(rawPacket []byte) (*PacketContext, error) {
 		ctx.IPv4Layer = ipLayer.(*layers.IPv4)
 	}
 
+	if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ctx.IPv6Layer = ipLayer.(*layers.IPv6)
+	}
+
 	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 		ctx.TCPLayer = tcpLayer.(*layers.TCP)
 	}
@@ -98,6 +145,42 @@ func ParsePacket(rawPacket []byte) (*PacketContext, error) {
 	return ctx, nil
 }
 
+// LayerOffset returns the byte offset of a decoded layer within RawPacket, or -1 if unknown
+func (ctx *PacketContext) LayerOffset(layer gopacket.Layer) int {
+	// Callers pass typed layer pointers, which may be nil for absent layers
+	if ctx.Packet == nil || layer == nil || reflect.ValueOf(layer).IsNil() {
+		return -1
+	}
+
+	// Decoded layers are slices into the packet's data, so the remaining
+	// capacity tells us how far from the end of the packet they start
+	offset := len(ctx.Packet.Data()) - cap(layer.LayerContents())
+	if offset < 0 || offset > len(ctx.RawPacket) {
+		return -1
+	}
+	return offset
+}
+
+// ReplacePacket swaps in new raw bytes, re-decoding the layers and re-extracting all fields.
+// Field values set by earlier actions are replaced by the values found in the new bytes.
+func (ctx *PacketContext) ReplacePacket(rawPacket []byte) error {
+	parsed, err := ParsePacket(rawPacket)
+	if err != nil {
+		return err
+	}
+
+	ctx.RawPacket = parsed.RawPacket
+	ctx.Packet = parsed.Packet
+	ctx.EtherLayer = parsed.EtherLayer
+	ctx.IPv4Layer = parsed.IPv4Layer
+	ctx.IPv6Layer = parsed.IPv6Layer
+	ctx.TCPLayer = parsed.TCPLayer
+	ctx.UDPLayer = parsed.UDPLayer
+
+	ctx.Fields = make(map[string]interface{})
+	return ExtractAllFields(ctx, ctx.fieldDefs)
+}
+
 // ExtractField extracts a field value from the packet based on field definition
 func ExtractField(ctx *PacketContext, field models.Field) (interface{}, error) {
 	// Handle built-in 5-tuple fields
@@ -106,6 +189,10 @@ func ExtractField(ctx *PacketContext, field models.Field) (interface{}, error) {
 	}
 
 	// Handle offset-based fields
+	field, ok := ctx.resolveField(field)
+	if !ok {
+		return nil, fmt.Errorf("anchor %s of field %s not present", field.Anchor, field.Name)
+	}
 	offset := field.Offset
 	length := field.Length
 
@@ -133,10 +220,16 @@ func extractBuiltinField(ctx *PacketContext, fieldName string) (interface{}, err
 		if ctx.IPv4Layer != nil {
 			return ctx.IPv4Layer.SrcIP.String(), nil
 		}
+		if ctx.IPv6Layer != nil {
+			return ctx.IPv6Layer.SrcIP.String(), nil
+		}
 	case "dst_ip":
 		if ctx.IPv4Layer != nil {
 			return ctx.IPv4Layer.DstIP.String(), nil
 		}
+		if ctx.IPv6Layer != nil {
+			return ctx.IPv6Layer.DstIP.String(), nil
+		}
 	case "src_port":
 		if ctx.TCPLayer != nil {
 			return int(ctx.TCPLayer.SrcPort), nil
@@ -152,8 +245,16 @@ func extractBuiltinField(ctx *PacketContext, fieldName string) (interface{}, err
 			return int(ctx.UDPLayer.DstPort), nil
 		}
 	case "protocol":
-		if ctx.IPv4Layer != nil {
-			return int(ctx.IPv4Layer.Protocol), nil
+		if ctx.IPv4Layer != nil || ctx.IPv6Layer != nil {
+			return int(ctx.UpperProtocol()), nil
+		}
+	case "src_mac":
+		if ctx.EtherLayer != nil {
+			return ctx.EtherLayer.SrcMAC.String(), nil
+		}
+	case "dst_mac":
+		if ctx.EtherLayer != nil {
+			return ctx.EtherLayer.DstMAC.String(), nil
 		}
 	}
 	return nil, fmt.Errorf("builtin field %s not available", fieldName)
@@ -179,8 +280,20 @@ func bytesToDecimal(data []byte) int64 {
 	}
 }
 
+// fieldDef returns the definition of a field extracted into this context, its offset resolved
+// against this packet
+func (ctx *PacketContext) fieldDef(name string) (models.Field, bool) {
+	for _, f := range ctx.fieldDefs {
+		if f.Name == name {
+			return ctx.resolveField(f)
+		}
+	}
+	return models.Field{}, false
+}
+
 // ExtractAllFields extracts all defined fields from packet
 func ExtractAllFields(ctx *PacketContext, fields []models.Field) error {
+	ctx.fieldDefs = fields
 	for _, field := range fields {
 		value, err := ExtractField(ctx, field)
 		if err != nil {
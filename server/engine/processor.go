@@ -0,0 +1,214 @@
+package engine
+
+// Processor actions hand the packet to a long-running local program over a Unix domain socket.
+//
+// Protocol: every message in either direction is a 4-byte big-endian length followed by
+// that many bytes of UTF-8 JSON. Connections are kept open and reused; the program must
+// answer each request with exactly one response, in order.
+//
+// Request:
+//
+//	{
+//	  "version": 1,
+//	  "field": "tagName",              // Field named by the action (may be empty)
+//	  "value": "...",                  // Extra argument from the action (may be empty)
+//	  "packet": "0004000100...",       // Current packet bytes, hex encoded
+//	  "fields": {"tagName": "..."},    // Current field values
+//	  "src_ip": "...", "dst_ip": "...", "src_port": 0, "dst_port": 0, "protocol": "UDP"
+//	}
+//
+// Response (all keys optional):
+//
+//	{
+//	  "packet": "0004000100...",       // Replacement packet bytes, hex encoded
+//	  "fields": {"tagName": "..."},    // Field values to set (applied after "packet")
+//	  "error": "..."                   // Non-empty aborts the rule, the original packet is accepted
+//	}
+//
+// Any failure (connect, timeout, malformed reply) fails the action, so the handler
+// accepts the original packet unchanged.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	processorProtocolVersion = 1
+	processorDefaultTimeout  = 100 * time.Millisecond
+	processorMaxIdleConns    = 8
+	processorMaxMessageSize  = 16 << 20
+)
+
+type processorRequest struct {
+	FiveTuple
+	Version int                    `json:"version"`
+	Field   string                 `json:"field"`
+	Value   string                 `json:"value"`
+	Packet  string                 `json:"packet"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+type processorResponse struct {
+	Packet string                 `json:"packet"`
+	Fields map[string]interface{} `json:"fields"`
+	Error  string                 `json:"error"`
+}
+
+// processorPool keeps idle connections to one processor socket
+type processorPool struct {
+	path string
+	idle chan net.Conn
+}
+
+var processorPools sync.Map // socket path -> *processorPool
+
+func getProcessorPool(path string) *processorPool {
+	if pool, ok := processorPools.Load(path); ok {
+		return pool.(*processorPool)
+	}
+	pool, _ := processorPools.LoadOrStore(path, &processorPool{
+		path: path,
+		idle: make(chan net.Conn, processorMaxIdleConns),
+	})
+	return pool.(*processorPool)
+}
+
+// call sends one request and waits for the reply before the deadline.
+// A reused connection that fails is assumed stale and the call is retried once on a fresh one.
+func (p *processorPool) call(request []byte, deadline time.Time) ([]byte, error) {
+	conn, reused, err := p.get(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := roundTrip(conn, request, deadline)
+	if err != nil && reused && time.Now().Before(deadline) {
+		conn.Close()
+		conn, err = p.dial(deadline)
+		if err != nil {
+			return nil, err
+		}
+		response, err = roundTrip(conn, request, deadline)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.put(conn)
+	return response, nil
+}
+
+func (p *processorPool) get(deadline time.Time) (net.Conn, bool, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, true, nil
+	default:
+		conn, err := p.dial(deadline)
+		return conn, false, err
+	}
+}
+
+func (p *processorPool) put(conn net.Conn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *processorPool) dial(deadline time.Time) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", p.path, time.Until(deadline))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to processor %s: %w", p.path, err)
+	}
+	return conn, nil
+}
+
+func roundTrip(conn net.Conn, request []byte, deadline time.Time) ([]byte, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(request)))
+	if _, err := conn.Write(append(header, request...)); err != nil {
+		return nil, fmt.Errorf("failed to send to processor: %w", err)
+	}
+
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read processor response: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > processorMaxMessageSize {
+		return nil, fmt.Errorf("processor response too large: %d bytes", size)
+	}
+
+	response := make([]byte, size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("failed to read processor response: %w", err)
+	}
+	return response, nil
+}
+
+// executeProcessor runs a processor action; action.Value is "socket path[ argument]"
+func executeProcessor(action Action, ctx *PacketContext) error {
+	path, argument, _ := strings.Cut(strings.TrimSpace(action.Value), " ")
+	if path == "" {
+		return fmt.Errorf("processor socket path is empty")
+	}
+
+	timeout := processorDefaultTimeout
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout) * time.Millisecond
+	}
+
+	request, err := json.Marshal(processorRequest{
+		FiveTuple: ctx.FiveTuple(),
+		Version:   processorProtocolVersion,
+		Field:     action.Field,
+		Value:     argument,
+		Packet:    hex.EncodeToString(ctx.RawPacket),
+		Fields:    ctx.Fields,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode processor request: %w", err)
+	}
+
+	raw, err := getProcessorPool(path).call(request, time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+
+	var response processorResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return fmt.Errorf("invalid processor response: %w", err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("processor error: %s", response.Error)
+	}
+
+	if response.Packet != "" {
+		packet, err := hex.DecodeString(response.Packet)
+		if err != nil {
+			return fmt.Errorf("invalid packet in processor response: %w", err)
+		}
+		if err := ctx.ReplacePacket(packet); err != nil {
+			return fmt.Errorf("invalid packet in processor response: %w", err)
+		}
+	}
+
+	for name, value := range response.Fields {
+		ctx.Fields[name] = normalizeJSONValue(value)
+	}
+
+	return nil
+}
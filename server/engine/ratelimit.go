@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDelay caps delay actions; held packets occupy the kernel queue
+const maxDelay = 60 * time.Second
+
+// Rate limit keys
+const (
+	RateLimitPerRule   = "rule"
+	RateLimitPerSource = "source"
+)
+
+// bucketIdle is how long an unused token bucket is kept; an idle bucket is full anyway
+const bucketIdle = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateLimiters = struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}{buckets: map[string]*tokenBucket{}}
+
+// executeDelay holds the packet for action.Value milliseconds before its verdict is issued.
+// Delays of several actions add up.
+func executeDelay(action Action, ctx *PacketContext) error {
+	ms, err := strconv.Atoi(action.Value)
+	if err != nil || ms < 0 {
+		return fmt.Errorf("invalid delay: %s", action.Value)
+	}
+
+	ctx.Delay += time.Duration(ms) * time.Millisecond
+	if ctx.Delay > maxDelay {
+		ctx.Delay = maxDelay
+	}
+	return nil
+}
+
+// executeRateLimit allows action.Value packets per second (burst action.Burst) per rule or
+// per source address. Excess packets are dropped, or passed unmodified with exceed "pass".
+func executeRateLimit(action Action, ctx *PacketContext) error {
+	rate, err := strconv.ParseFloat(action.Value, 64)
+	if err != nil || rate <= 0 {
+		return fmt.Errorf("invalid rate: %s", action.Value)
+	}
+
+	burst := float64(action.Burst)
+	if burst <= 0 {
+		burst = rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+
+	key := strconv.FormatUint(uint64(ctx.RuleID), 10)
+	switch action.Scope {
+	case "", RateLimitPerRule:
+	case RateLimitPerSource:
+		key += "/" + ctx.FiveTuple().SrcIP
+	default:
+		return fmt.Errorf("rate limit scope must be rule or source")
+	}
+
+	exceed := action.Exceed
+	switch exceed {
+	case "":
+		exceed = VerdictDrop
+	case VerdictDrop, VerdictPass:
+	default:
+		return fmt.Errorf("rate limit exceed must be drop or pass")
+	}
+
+	if !takeToken(key, rate, burst, !ctx.DryRun) {
+		ctx.Verdict = exceed
+	}
+	return nil
+}
+
+// takeToken refills the bucket for key and takes a token if one is available.
+// With consume false (test mode) the bucket is only inspected.
+func takeToken(key string, rate, burst float64, consume bool) bool {
+	now := time.Now()
+
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+
+	if now.Sub(rateLimiters.lastSweep) > bucketIdle {
+		for k, b := range rateLimiters.buckets {
+			if now.Sub(b.last) > bucketIdle {
+				delete(rateLimiters.buckets, k)
+			}
+		}
+		rateLimiters.lastSweep = now
+	}
+
+	b, ok := rateLimiters.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		if consume {
+			rateLimiters.buckets[key] = b
+		}
+	}
+
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rate
+	if tokens > burst {
+		tokens = burst
+	}
+	if tokens < 1 {
+		if consume {
+			b.tokens, b.last = tokens, now
+		}
+		return false
+	}
+
+	if consume {
+		b.tokens, b.last = tokens-1, now
+	}
+	return true
+}
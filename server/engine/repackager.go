@@ -1,11 +1,16 @@
 package engine
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"net"
 	"packet-repackage/models"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -18,6 +23,8 @@ type FieldSegment struct {
 	IsUserField bool
 	FieldName   string // Empty for built-in fields
 	Field       *models.Field
+	NewOffset   int // Position in the reassembled packet
+	NewLength   int // Length in the reassembled packet
 }
 
 // RepackagePacket rebuilds the packet by preserving built-in fields and updating user-defined fields
@@ -27,18 +34,42 @@ func RepackagePacket(outputOptions string, ctx *PacketContext, fields []models.F
 		return ctx.RawPacket, nil
 	}
 
+	// Anchored offsets become packet offsets; fields whose anchor is missing are left alone
+	fields = ctx.resolveFields(fields)
+
+	// Write back changed builtin fields (addresses, ports) before reassembly, while offsets still match
+	packet := append([]byte(nil), ctx.RawPacket...)
+	if err := writeBuiltinFields(packet, ctx, fields); err != nil {
+		return nil, err
+	}
+
 	// Extract built-in fields (gaps between user-defined fields)
-	segments := extractFieldSegments(ctx.RawPacket, fields)
+	segments := extractFieldSegments(packet, fields)
 
 	// Reassemble packet with modified user fields and preserved built-in fields
-	reassembled := reassemblePacket(ctx.RawPacket, segments, ctx)
+	reassembled := reassemblePacket(packet, segments, ctx)
+	ctx.segments = segments
+
+	// Length fields measure the modified packet
+	applyLengthFields(reassembled, segments, ctx)
+
+	// Grown or shrunk fields change the size the IP and UDP headers declare
+	fixLengths(reassembled, ctx)
 
 	// Apply output options (e.g., compute checksum)
-	result, err := applyOutputOptions(reassembled, outputOptions, ctx)
+	result, err := applyOutputOptions(reassembled, outputOptions, segments, ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to apply output options: %w", err)
 	}
 
+	// Anonymized fields change checksummed bytes, so fix checksums even if not requested
+	if ctx.fixChecksums && !hasOutputOption(outputOptions, "compute_checksum") {
+		result, err = recalculateChecksums(result, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute checksum: %w", err)
+		}
+	}
+
 	return result, nil
 }
 
@@ -91,11 +122,13 @@ func extractFieldSegments(rawPacket []byte, userFields []models.Field) []FieldSe
 	return segments
 }
 
-// reassemblePacket reconstructs the packet from segments
+// reassemblePacket reconstructs the packet from segments and records each segment's new position in it
 func reassemblePacket(rawPacket []byte, segments []FieldSegment, ctx *PacketContext) []byte {
 	var output []byte
 
-	for _, segment := range segments {
+	for i := range segments {
+		segment := &segments[i]
+		segment.NewOffset = len(output)
 		if segment.IsUserField {
 			// Use modified value from context
 			value := ctx.Fields[segment.FieldName]
@@ -113,18 +146,20 @@ func reassemblePacket(rawPacket []byte, segments []FieldSegment, ctx *PacketCont
 				output = append(output, rawPacket[segment.Offset:endOffset]...)
 			}
 		}
+		segment.NewLength = len(output) - segment.NewOffset
 	}
 
 	return output
 }
 
 // applyOutputOptions processes output options like checksum computation
-func applyOutputOptions(packetData []byte, optionsJSON string, ctx *PacketContext) ([]byte, error) {
+func applyOutputOptions(packetData []byte, optionsJSON string, segments []FieldSegment, ctx *PacketContext) ([]byte, error) {
 	if optionsJSON == "" {
 		return packetData, nil
 	}
 
-	var options []string
+	// Options are names like "compute_checksum" or objects like application checksums
+	var options []json.RawMessage
 	err := json.Unmarshal([]byte(optionsJSON), &options)
 	if err != nil {
 		// If not valid JSON, treat as no options
@@ -132,7 +167,15 @@ func applyOutputOptions(packetData []byte, optionsJSON string, ctx *PacketContex
 	}
 
 	result := packetData
-	for _, option := range options {
+	for _, raw := range options {
+		var option string
+		if json.Unmarshal(raw, &option) != nil {
+			if err := applyChecksumOption(result, raw, segments); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		switch option {
 		case "compute_checksum":
 			result, err = recalculateChecksums(result, ctx)
@@ -145,6 +188,21 @@ func applyOutputOptions(packetData []byte, optionsJSON string, ctx *PacketContex
 	return result, nil
 }
 
+// hasOutputOption reports whether the output options JSON array contains option
+func hasOutputOption(optionsJSON, option string) bool {
+	var options []json.RawMessage
+	if json.Unmarshal([]byte(optionsJSON), &options) != nil {
+		return false
+	}
+	for _, raw := range options {
+		var name string
+		if json.Unmarshal(raw, &name) == nil && name == option {
+			return true
+		}
+	}
+	return false
+}
+
 func valueToBytes(value interface{}, field models.Field) ([]byte, error) {
 	if value == nil {
 		return make([]byte, field.Length), nil
@@ -197,6 +255,174 @@ func valueToBytes(value interface{}, field models.Field) ([]byte, error) {
 	}
 }
 
+// setBuiltinValue writes a builtin field into packet, which must share the layout of ctx.RawPacket.
+// IPv4 header and TCP/UDP checksums are updated incrementally for the changed bytes.
+// Addresses are written to the IPv4 header, or the IPv6 header of IPv6 packets.
+func setBuiltinValue(packet []byte, ctx *PacketContext, name string, value interface{}) error {
+	var offset int
+	var newBytes []byte
+
+	switch strings.ToLower(name) {
+	case "src_ip", "dst_ip":
+		if ctx.IPv6Layer != nil && ctx.IPv4Layer == nil {
+			offset = ctx.LayerOffset(ctx.IPv6Layer)
+			ip := net.ParseIP(fmt.Sprintf("%v", value))
+			if offset < 0 || ip == nil || ip.To4() != nil {
+				return fmt.Errorf("invalid IPv6 address for %s: %v", name, value)
+			}
+			if strings.ToLower(name) == "src_ip" {
+				offset += 8
+			} else {
+				offset += 24
+			}
+			newBytes = ip.To16()
+			break
+		}
+
+		offset = ctx.LayerOffset(ctx.IPv4Layer)
+		if offset < 0 {
+			return fmt.Errorf("builtin field %s not available", name)
+		}
+		ip := net.ParseIP(fmt.Sprintf("%v", value)).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid IPv4 address for %s: %v", name, value)
+		}
+		if strings.ToLower(name) == "src_ip" {
+			offset += 12
+		} else {
+			offset += 16
+		}
+		newBytes = ip
+
+	case "src_port", "dst_port":
+		var transport gopacket.Layer
+		if ctx.TCPLayer != nil {
+			transport = ctx.TCPLayer
+		} else if ctx.UDPLayer != nil {
+			transport = ctx.UDPLayer
+		}
+		offset = ctx.LayerOffset(transport)
+		if offset < 0 {
+			return fmt.Errorf("builtin field %s not available", name)
+		}
+		port, err := strconv.ParseUint(fmt.Sprintf("%v", value), 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port for %s: %v", name, value)
+		}
+		if strings.ToLower(name) == "dst_port" {
+			offset += 2
+		}
+		newBytes = binary.BigEndian.AppendUint16(nil, uint16(port))
+
+	case "src_mac", "dst_mac":
+		offset = ctx.LayerOffset(ctx.EtherLayer)
+		if offset < 0 {
+			return fmt.Errorf("builtin field %s not available", name)
+		}
+		mac, err := net.ParseMAC(fmt.Sprintf("%v", value))
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("invalid MAC address for %s: %v", name, value)
+		}
+		if strings.ToLower(name) == "src_mac" {
+			offset += 6
+		}
+		newBytes = mac
+
+	default:
+		return fmt.Errorf("builtin field %s is read-only", name)
+	}
+
+	if offset+len(newBytes) > len(packet) {
+		return fmt.Errorf("builtin field %s is outside the packet", name)
+	}
+	oldBytes := append([]byte(nil), packet[offset:offset+len(newBytes)]...)
+	copy(packet[offset:], newBytes)
+	adjustChecksums(packet, ctx, offset, oldBytes, newBytes)
+
+	return nil
+}
+
+// writeBuiltinFields writes builtin fields whose value was changed by actions into packet
+func writeBuiltinFields(packet []byte, ctx *PacketContext, fields []models.Field) error {
+	for _, field := range fields {
+		if field.Type != "builtin" {
+			continue
+		}
+		current, err := extractBuiltinField(ctx, field.Name)
+		if err != nil || ctx.Fields[field.Name] == nil {
+			continue
+		}
+		if fmt.Sprintf("%v", current) == fmt.Sprintf("%v", ctx.Fields[field.Name]) {
+			continue
+		}
+		if err := setBuiltinValue(packet, ctx, field.Name, ctx.Fields[field.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjustChecksums updates the IPv4 header and TCP/UDP checksums after the bytes at offset
+// changed from oldBytes to newBytes (same length, 16-bit aligned within their header)
+func adjustChecksums(packet []byte, ctx *PacketContext, offset int, oldBytes, newBytes []byte) {
+	end := offset + len(newBytes)
+
+	// IPv4 header checksum; the addresses are also part of the transport pseudo-header
+	inPseudoHeader := false
+	if ipOffset := ctx.LayerOffset(ctx.IPv4Layer); ipOffset >= 0 && offset >= ipOffset && end <= ipOffset+int(ctx.IPv4Layer.IHL)*4 {
+		sum := ipOffset + 10
+		binary.BigEndian.PutUint16(packet[sum:], updateChecksum(binary.BigEndian.Uint16(packet[sum:]), oldBytes, newBytes))
+		inPseudoHeader = offset >= ipOffset+12
+	}
+
+	// IPv6 has no header checksum, but its addresses are in the pseudo-header too
+	if ipOffset := ctx.LayerOffset(ctx.IPv6Layer); ipOffset >= 0 && offset >= ipOffset+8 && end <= ipOffset+40 {
+		inPseudoHeader = true
+	}
+
+	var transportOffset, sum int
+	optional := false
+	if ctx.TCPLayer != nil {
+		transportOffset = ctx.LayerOffset(ctx.TCPLayer)
+		sum = transportOffset + 16
+	} else if ctx.UDPLayer != nil {
+		transportOffset = ctx.LayerOffset(ctx.UDPLayer)
+		sum = transportOffset + 6
+		optional = true
+	} else if icmp := ctx.Packet.Layer(layers.LayerTypeICMPv6); icmp != nil {
+		transportOffset = ctx.LayerOffset(icmp)
+		sum = transportOffset + 2
+	} else {
+		return
+	}
+	if transportOffset < 0 || sum+2 > len(packet) || (!inPseudoHeader && offset < transportOffset) {
+		return
+	}
+
+	current := binary.BigEndian.Uint16(packet[sum:])
+	if optional && current == 0 {
+		return // UDP checksum not in use
+	}
+	updated := updateChecksum(current, oldBytes, newBytes)
+	if optional && updated == 0 {
+		updated = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[sum:], updated)
+}
+
+// updateChecksum applies RFC 1624 incremental update: HC' = ~(~HC + ~m + m')
+func updateChecksum(checksum uint16, oldBytes, newBytes []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(oldBytes); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(oldBytes[i:]))
+		sum += uint32(binary.BigEndian.Uint16(newBytes[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
 func padOrTruncate(data []byte, length int) []byte {
 	if len(data) == length {
 		return data
@@ -219,73 +445,243 @@ func intToBytes(value int64, length int) []byte {
 	return bytes
 }
 
-func recalculateChecksums(packetData []byte, ctx *PacketContext) ([]byte, error) {
-	// Parse the modified packet
-	packet := gopacket.NewPacket(packetData, layers.LayerTypeEthernet, gopacket.Default)
+// fixLengths updates the IPv4 total length, IPv6 payload length and UDP length of the headers
+// enclosing the data after the packet changed size. The IPv4 header checksum is adjusted along;
+// transport checksums are left to compute_checksum. Headers that can't be fixed add a warning.
+func fixLengths(packet []byte, ctx *PacketContext) {
+	delta := len(packet) - len(ctx.RawPacket)
+	if delta == 0 || len(packet) == 0 {
+		return
+	}
+
+	decoded := gopacket.NewPacket(packet, firstLayerType(packet), gopacket.NoCopy)
+	for _, layer := range decoded.Layers() {
+		offset := cap(packet) - cap(layer.LayerContents())
+		if offset < 0 || offset >= len(packet) {
+			continue
+		}
+
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			if l.Flags&layers.IPv4MoreFragments != 0 || l.FragOffset != 0 {
+				ctx.Warnings = append(ctx.Warnings, "IPv4 fragment changed size, reassembly at the receiver will fail")
+			}
+			if setLength(packet, ctx, offset+2, int(l.Length)+delta, int(l.IHL)*4, "IPv4 total length") {
+				old := []byte{byte(l.Length >> 8), byte(l.Length)}
+				sum := offset + 10
+				binary.BigEndian.PutUint16(packet[sum:], updateChecksum(binary.BigEndian.Uint16(packet[sum:]), old, packet[offset+2:offset+4]))
+			}
+
+		case *layers.IPv6:
+			if l.Length == 0 {
+				ctx.Warnings = append(ctx.Warnings, "IPv6 jumbogram length not adjusted")
+			} else {
+				setLength(packet, ctx, offset+4, int(l.Length)+delta, 0, "IPv6 payload length")
+			}
 
-	// Create a buffer to serialize the packet with recalculated checksums
-	buffer := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+		case *layers.UDP:
+			setLength(packet, ctx, offset+4, int(l.Length)+delta, 8, "UDP length")
+		}
 	}
 
-	// Get layers and serialize with checksum computation
-	if etherLayer := packet.Layer(layers.LayerTypeEthernet); etherLayer != nil {
-		eth := etherLayer.(*layers.Ethernet)
+	if decoded.ErrorLayer() != nil {
+		ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("packet size changed by %d bytes but not all headers could be decoded: %v",
+			delta, decoded.ErrorLayer().Error()))
+	}
+}
 
-		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-			ip := ipLayer.(*layers.IPv4)
+// setLength writes a 16-bit length field, or adds a warning if the length is out of range
+func setLength(packet []byte, ctx *PacketContext, offset, length, min int, name string) bool {
+	if length < min || length > 0xffff || offset+2 > len(packet) {
+		ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("cannot set %s to %d", name, length))
+		return false
+	}
+	binary.BigEndian.PutUint16(packet[offset:], uint16(length))
+	return true
+}
 
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				tcp := tcpLayer.(*layers.TCP)
-				tcp.SetNetworkLayerForChecksum(ip)
+// recalculateChecksums recomputes the IPv4 header, TCP, UDP, ICMP, ICMPv6, SCTP and GRE
+// checksums of every IP packet in the data, including tunneled ones. The packet is decoded from
+// the same starting layer as ParsePacket, so Ethernet frames from test mode and IP packets from
+// the queue get identical bytes. Length fields are expected to be correct already (see fixLengths).
+func recalculateChecksums(packetData []byte, ctx *PacketContext) ([]byte, error) {
+	if len(packetData) == 0 {
+		return packetData, nil
+	}
 
-				payload := packet.ApplicationLayer()
-				var payloadBytes []byte
-				if payload != nil {
-					payloadBytes = payload.Payload()
-				}
+	result := append([]byte(nil), packetData...)
+	packet := gopacket.NewPacket(result, firstLayerType(result), gopacket.NoCopy)
 
-				err := gopacket.SerializeLayers(buffer, opts, eth, ip, tcp, gopacket.Payload(payloadBytes))
-				if err != nil {
-					return nil, err
-				}
-				return buffer.Bytes(), nil
+	// Network layer of the header being processed
+	var network gopacket.Layer
+	networkOffset := 0
+
+	// Outer checksums cover inner ones (GRE or UDP tunnels), so fixes run innermost first
+	var fixes []func()
+
+	for _, layer := range packet.Layers() {
+		offset := cap(result) - cap(layer.LayerContents())
+		if offset < 0 || offset >= len(result) {
+			continue
+		}
+
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			headerLen := int(l.IHL) * 4
+			if offset+headerLen > len(result) {
+				return nil, fmt.Errorf("truncated IPv4 header")
 			}
+			fixes = append(fixes, func() { setIPv4HeaderChecksum(result, offset) })
+			network, networkOffset = l, offset
+
+		case *layers.IPv6:
+			network, networkOffset = l, offset
+		}
 
-			if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-				udp := udpLayer.(*layers.UDP)
-				udp.SetNetworkLayerForChecksum(ip)
+		if network == nil {
+			continue
+		}
+		nw, nwOffset := network, networkOffset
+
+		switch l := layer.(type) {
+		case *layers.UDP:
+			fixes = append(fixes, func() {
+				setTransportChecksum(result, nw, nwOffset, offset, offset+6, layers.IPProtocolUDP)
+			})
+
+		case *layers.TCP:
+			fixes = append(fixes, func() {
+				setTransportChecksum(result, nw, nwOffset, offset, offset+16, layers.IPProtocolTCP)
+			})
+
+		case *layers.ICMPv6:
+			fixes = append(fixes, func() {
+				setTransportChecksum(result, nw, nwOffset, offset, offset+2, layers.IPProtocolICMPv6)
+			})
 
-				payload := packet.ApplicationLayer()
-				var payloadBytes []byte
-				if payload != nil {
-					payloadBytes = payload.Payload()
+		case *layers.ICMPv4:
+			fixes = append(fixes, func() {
+				end := networkEnd(result, nw, nwOffset)
+				if offset+4 > end {
+					return
+				}
+				// Error messages quote the offending IP header, whose checksum a rewrite may have broken
+				if isICMPv4Error(l.TypeCode.Type()) {
+					quoted := offset + 8
+					if quoted < end && result[quoted]>>4 == 4 && quoted+int(result[quoted]&0x0f)*4 <= end {
+						setIPv4HeaderChecksum(result, quoted)
+					}
 				}
+				binary.BigEndian.PutUint16(result[offset+2:], 0)
+				binary.BigEndian.PutUint16(result[offset+2:], internetChecksum(result[offset:end], 0))
+			})
 
-				err := gopacket.SerializeLayers(buffer, opts, eth, ip, udp, gopacket.Payload(payloadBytes))
-				if err != nil {
-					return nil, err
+		case *layers.SCTP:
+			fixes = append(fixes, func() {
+				end := networkEnd(result, nw, nwOffset)
+				if offset+12 > end {
+					return
 				}
-				return buffer.Bytes(), nil
-			}
+				// CRC32c over the whole packet, stored least significant byte first (RFC 4960 appendix B)
+				binary.LittleEndian.PutUint32(result[offset+8:], 0)
+				binary.LittleEndian.PutUint32(result[offset+8:], crc32.Checksum(result[offset:end], castagnoli))
+			})
 
-			// IP packet without TCP/UDP
-			payload := packet.ApplicationLayer()
-			var payloadBytes []byte
-			if payload != nil {
-				payloadBytes = payload.Payload()
+		case *layers.GRE:
+			if !l.ChecksumPresent {
+				continue
 			}
+			fixes = append(fixes, func() {
+				end := networkEnd(result, nw, nwOffset)
+				if offset+6 > end {
+					return
+				}
+				binary.BigEndian.PutUint16(result[offset+4:], 0)
+				binary.BigEndian.PutUint16(result[offset+4:], internetChecksum(result[offset:end], 0))
+			})
+		}
+	}
 
-			err := gopacket.SerializeLayers(buffer, opts, eth, ip, gopacket.Payload(payloadBytes))
-			if err != nil {
-				return nil, err
-			}
-			return buffer.Bytes(), nil
+	for i := len(fixes) - 1; i >= 0; i-- {
+		fixes[i]()
+	}
+	return result, nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// isICMPv4Error reports whether an ICMP type quotes the packet that caused it
+func isICMPv4Error(icmpType uint8) bool {
+	switch icmpType {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+		layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+func setIPv4HeaderChecksum(packet []byte, offset int) {
+	headerLen := int(packet[offset]&0x0f) * 4
+	binary.BigEndian.PutUint16(packet[offset+10:], 0)
+	binary.BigEndian.PutUint16(packet[offset+10:], internetChecksum(packet[offset:offset+headerLen], 0))
+}
+
+// networkEnd returns where the IP packet starting at networkOffset ends according to its header
+func networkEnd(packet []byte, network gopacket.Layer, networkOffset int) int {
+	var end int
+	switch network.(type) {
+	case *layers.IPv4:
+		end = networkOffset + int(binary.BigEndian.Uint16(packet[networkOffset+2:]))
+	case *layers.IPv6:
+		end = networkOffset + 40 + int(binary.BigEndian.Uint16(packet[networkOffset+4:]))
+	}
+	if end > len(packet) {
+		end = len(packet)
+	}
+	return end
+}
+
+// setTransportChecksum computes a checksum that includes the pseudo-header (TCP, UDP, ICMPv6)
+// over the data from transportOffset to the end of its network packet
+func setTransportChecksum(packet []byte, network gopacket.Layer, networkOffset, transportOffset, checksumOffset int, protocol layers.IPProtocol) {
+	var src, dst []byte
+	switch network.(type) {
+	case *layers.IPv4:
+		src, dst = packet[networkOffset+12:networkOffset+16], packet[networkOffset+16:networkOffset+20]
+	case *layers.IPv6:
+		src, dst = packet[networkOffset+8:networkOffset+24], packet[networkOffset+24:networkOffset+40]
+	}
+	end := networkEnd(packet, network, networkOffset)
+	if checksumOffset+2 > end {
+		return
+	}
+
+	var sum uint32
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(addr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(addr[i:]))
 		}
 	}
+	sum += uint32(protocol) + uint32(end-transportOffset)
+
+	binary.BigEndian.PutUint16(packet[checksumOffset:], 0)
+	checksum := internetChecksum(packet[transportOffset:end], sum)
+	if checksum == 0 && protocol == layers.IPProtocolUDP {
+		checksum = 0xffff // 0 means no checksum
+	}
+	binary.BigEndian.PutUint16(packet[checksumOffset:], checksum)
+}
 
-	// If we can't parse as IP packet, return as-is
-	return packetData, nil
+// internetChecksum computes the RFC 1071 checksum of data, starting from a partial sum
+func internetChecksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
 }
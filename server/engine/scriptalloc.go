@@ -0,0 +1,674 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Starlark has no allocation hook, so scripts are rewritten when compiled: operators,
+// slices, argument spreading, methods and builtins that can build large values go
+// through guards that estimate the size of the result and charge it to the run's
+// budget before doing the work. The step limit bounds everything that grows one
+// element per step (append, comprehensions, loops).
+
+// scriptAllocKey is the thread-local holding the run's *scriptAlloc
+const scriptAllocKey = "alloc"
+
+// scriptAlloc counts the bytes a script run has been charged for
+type scriptAlloc struct {
+	used  int
+	limit int
+}
+
+// remaining returns how many bytes the run may still allocate
+func (alloc *scriptAlloc) remaining() int {
+	if alloc == nil {
+		return math.MaxInt
+	}
+	return alloc.limit - alloc.used
+}
+
+func scriptAllocOf(thread *starlark.Thread) *scriptAlloc {
+	alloc, _ := thread.Local(scriptAllocKey).(*scriptAlloc)
+	return alloc
+}
+
+// chargeScript charges size bytes to the run, failing once the budget is spent
+func chargeScript(thread *starlark.Thread, size int) error {
+	alloc := scriptAllocOf(thread)
+	if alloc == nil {
+		return nil
+	}
+	if size > alloc.remaining() {
+		return fmt.Errorf("script exceeded allocation limit of %d bytes", alloc.limit)
+	}
+	alloc.used += size
+	return nil
+}
+
+// Guard names start with '$' so scripts can neither call nor shadow them
+var scriptBinaryGuards = map[syntax.Token]string{
+	syntax.PLUS:       "$add",
+	syntax.MINUS:      "$sub",
+	syntax.STAR:       "$mul",
+	syntax.PERCENT:    "$mod",
+	syntax.PIPE:       "$or",
+	syntax.AMP:        "$and",
+	syntax.CIRCUMFLEX: "$xor",
+	syntax.LTLT:       "$shl",
+}
+
+// Augmented assignments x op= y check the result size and then let the interpreter do the
+// update, so lists keep being extended in place
+var scriptAugmentGuards = map[syntax.Token]syntax.Token{
+	syntax.PLUS_EQ:       syntax.PLUS,
+	syntax.MINUS_EQ:      syntax.MINUS,
+	syntax.STAR_EQ:       syntax.STAR,
+	syntax.PERCENT_EQ:    syntax.PERCENT,
+	syntax.PIPE_EQ:       syntax.PIPE,
+	syntax.AMP_EQ:        syntax.AMP,
+	syntax.CIRCUMFLEX_EQ: syntax.CIRCUMFLEX,
+	syntax.LTLT_EQ:       syntax.LTLT,
+}
+
+// scriptMethodCosts estimates the result of methods that build new values
+var scriptMethodCosts = map[string]func(recv starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple, limit int) int{
+	"join":         joinCost,
+	"replace":      replaceCost,
+	"format":       formatCost,
+	"split":        splitCost,
+	"rsplit":       splitCost,
+	"splitlines":   splitCost,
+	"partition":    splitCost,
+	"rpartition":   splitCost,
+	"capitalize":   recvCost,
+	"lower":        recvCost,
+	"upper":        recvCost,
+	"title":        recvCost,
+	"strip":        recvCost,
+	"lstrip":       recvCost,
+	"rstrip":       recvCost,
+	"removeprefix": recvCost,
+	"removesuffix": recvCost,
+	"items":        recvCost,
+	"keys":         recvCost,
+	"values":       recvCost,
+	"extend":       argsCost,
+	"update":       argsCost,
+	"union":        setOpCost,
+	"difference":   setOpCost,
+	"intersection": setOpCost,
+
+	"symmetric_difference": setOpCost,
+}
+
+// scriptBuiltinCosts estimates the result of universal builtins that build new values;
+// scripts see guarded versions under the same names
+var scriptBuiltinCosts = map[string]func(args starlark.Tuple, kwargs []starlark.Tuple, limit int) int{
+	"list":      iterableCost,
+	"tuple":     iterableCost,
+	"sorted":    iterableCost,
+	"set":       iterableCost,
+	"reversed":  iterableCost,
+	"enumerate": iterableCost,
+	"zip":       zipCost,
+	"dict":      dictCost,
+	"bytes":     iterableCost,
+	"str":       reprCost,
+	"repr":      reprCost,
+	"print":     reprCost,
+	"fail":      reprCost,
+}
+
+// scriptGuards holds the guard builtins, predeclared in every script
+var scriptGuards = newScriptGuards()
+
+func newScriptGuards() starlark.StringDict {
+	guards := starlark.StringDict{
+		"$method": starlark.NewBuiltin("$method", guardMethod),
+		"$spread": starlark.NewBuiltin("$spread", guardSpread),
+		"$slice":  starlark.NewBuiltin("$slice", guardSlice),
+		"getattr": starlark.NewBuiltin("getattr", guardGetattr),
+	}
+
+	for op, name := range scriptBinaryGuards {
+		op := op
+		guards[name] = starlark.NewBuiltin(op.String(), func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+			x, y := args[0], args[1]
+			if err := chargeScript(thread, binaryCost(op, x, y, scriptAllocOf(thread).remaining())); err != nil {
+				return nil, err
+			}
+			return starlark.Binary(op, x, y)
+		})
+	}
+	for augment, op := range scriptAugmentGuards {
+		op := op
+		guards["$"+augment.String()] = starlark.NewBuiltin(augment.String(), func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+			x, y := args[0], args[1]
+			if err := chargeScript(thread, binaryCost(op, x, y, scriptAllocOf(thread).remaining())); err != nil {
+				return nil, err
+			}
+			return y, nil
+		})
+	}
+	for name, cost := range scriptBuiltinCosts {
+		name, cost := name, cost
+		builtin := starlark.Universe[name]
+		guards[name] = starlark.NewBuiltin(name, func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := chargeScript(thread, cost(args, kwargs, scriptAllocOf(thread).remaining())); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			return starlark.Call(thread, builtin, args, kwargs)
+		})
+	}
+
+	return guards
+}
+
+// guardMethod implements x.name for growing methods, charging the call before it runs
+func guardMethod(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	name, _ := starlark.AsString(args[1])
+	return guardedAttr(args[0], name)
+}
+
+func guardedAttr(recv starlark.Value, name string) (starlark.Value, error) {
+	var attr starlark.Value
+	if x, ok := recv.(starlark.HasAttrs); ok {
+		var err error
+		if attr, err = x.Attr(name); err != nil {
+			return nil, err
+		}
+	}
+	if attr == nil {
+		return nil, fmt.Errorf("%s has no .%s field or method", recv.Type(), name)
+	}
+
+	method, ok := attr.(*starlark.Builtin)
+	cost := scriptMethodCosts[name]
+	if !ok || cost == nil || method.Receiver() == nil {
+		return attr, nil
+	}
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := chargeScript(thread, cost(recv, args, kwargs, scriptAllocOf(thread).remaining())); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return starlark.Call(thread, method, args, kwargs)
+	}).BindReceiver(recv), nil
+}
+
+// guardGetattr is getattr(x, name[, default]) returning guarded methods
+func guardGetattr(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var recv, dflt starlark.Value
+	var name string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &recv, &name, &dflt); err != nil {
+		return nil, err
+	}
+	attr, err := guardedAttr(recv, name)
+	if err != nil && dflt != nil {
+		return dflt, nil
+	}
+	return attr, err
+}
+
+// guardSpread charges f(*x) and f(**x) for the argument copy and returns x
+func guardSpread(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	if err := chargeScript(thread, mulCost(iterCount(args[0]), 16)); err != nil {
+		return nil, err
+	}
+	return args[0], nil
+}
+
+// guardSlice charges x[i:j] for a copy of x and returns x
+func guardSlice(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	if err := chargeScript(thread, shallowCost(args[0])); err != nil {
+		return nil, err
+	}
+	return args[0], nil
+}
+
+// Size estimates are in bytes: string contents plus 16 per element or entry. They
+// saturate instead of overflowing.
+
+func addCost(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+func mulCost(a, b int) int {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	if a > math.MaxInt/b {
+		return math.MaxInt
+	}
+	return a * b
+}
+
+// shallowCost is the size of a copy of x that shares its elements
+func shallowCost(x starlark.Value) int {
+	switch v := x.(type) {
+	case starlark.String:
+		return len(v)
+	case starlark.Bytes:
+		return len(v)
+	case starlark.Int:
+		return v.BigInt().BitLen()/8 + 16
+	}
+	if x.Type() == "range" { // slices of a range are ranges too
+		return 16
+	}
+	if n := starlark.Len(x); n >= 0 {
+		return mulCost(n, 16)
+	}
+	return 16
+}
+
+// deepCost is the size of the text of x, as str and formatting produce it. It stops
+// counting once limit is passed, which also ends the walk of self-referencing values.
+func deepCost(x starlark.Value, limit int) int {
+	switch v := x.(type) {
+	case starlark.String:
+		return mulCost(len(v), 4) + 2
+	case starlark.Bytes:
+		return mulCost(len(v), 4) + 3
+	case starlark.Int:
+		return v.BigInt().BitLen()/3 + 2
+	case *starlark.Dict:
+		total := 2
+		for _, item := range v.Items() {
+			if total > limit {
+				break
+			}
+			total = addCost(total, addCost(deepCost(item[0], limit-total), deepCost(item[1], limit-total))+4)
+		}
+		return total
+	case *starlark.List, starlark.Tuple, *starlark.Set:
+		total := 2
+		iter := starlark.Iterate(v)
+		defer iter.Done()
+		var elem starlark.Value
+		for total <= limit && iter.Next(&elem) {
+			total = addCost(total, deepCost(elem, limit-total)+2)
+		}
+		return total
+	}
+	return 32
+}
+
+// iterCount is the number of elements of an iterable, counted if it has no length
+func iterCount(x starlark.Value) int {
+	if n := starlark.Len(x); n >= 0 {
+		return n
+	}
+	iter := starlark.Iterate(x)
+	if iter == nil {
+		return 0
+	}
+	defer iter.Done()
+	n := 0
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		n++
+	}
+	return n
+}
+
+func binaryCost(op syntax.Token, x, y starlark.Value, limit int) int {
+	switch op {
+	case syntax.STAR:
+		if n, ok := x.(starlark.Int); ok {
+			x, y = y, n
+		}
+		if n, ok := y.(starlark.Int); ok {
+			if _, isInt := x.(starlark.Int); !isInt {
+				count, ok := n.Int64()
+				if !ok || count > math.MaxInt32 {
+					count = math.MaxInt32
+				}
+				return mulCost(shallowCost(x), int(count))
+			}
+		}
+		return addCost(shallowCost(x), shallowCost(y))
+	case syntax.PERCENT:
+		if format, ok := x.(starlark.String); ok {
+			directives := strings.Count(string(format), "%")
+			return addCost(len(format), mulCost(directives, deepCost(y, limit)))
+		}
+	case syntax.LTLT:
+		return shallowCost(x) + 64
+	}
+	return addCost(shallowCost(x), shallowCost(y))
+}
+
+func recvCost(recv starlark.Value, _ starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	return shallowCost(recv)
+}
+
+func argsCost(_ starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple, _ int) int {
+	total := mulCost(len(kwargs), 16)
+	for _, arg := range args {
+		total = addCost(total, mulCost(iterCount(arg), 16))
+	}
+	return total
+}
+
+func setOpCost(recv starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple, limit int) int {
+	return addCost(shallowCost(recv), argsCost(recv, args, kwargs, limit))
+}
+
+func joinCost(recv starlark.Value, args starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	sep, ok := recv.(starlark.String)
+	if !ok || len(args) == 0 {
+		return 0
+	}
+	iter := starlark.Iterate(args[0])
+	if iter == nil {
+		return 0
+	}
+	defer iter.Done()
+	total := 0
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		if s, ok := elem.(starlark.String); ok {
+			total = addCost(total, len(s))
+		}
+		total = addCost(total, len(sep))
+	}
+	return total
+}
+
+func replaceCost(recv starlark.Value, args starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	s, ok := recv.(starlark.String)
+	if !ok || len(args) < 2 {
+		return shallowCost(recv)
+	}
+	old, _ := starlark.AsString(args[0])
+	repl, _ := starlark.AsString(args[1])
+	count := strings.Count(string(s), old)
+	if len(args) > 2 {
+		if n, err := starlark.AsInt32(args[2]); err == nil && n >= 0 && n < count {
+			count = n
+		}
+	}
+	return addCost(len(s), mulCost(count, len(repl)))
+}
+
+func formatCost(recv starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple, limit int) int {
+	format, ok := recv.(starlark.String)
+	if !ok {
+		return 0
+	}
+	values := 0
+	for _, arg := range args {
+		values = addCost(values, deepCost(arg, limit))
+	}
+	for _, kwarg := range kwargs {
+		values = addCost(values, deepCost(kwarg[1], limit))
+	}
+	return addCost(len(format), mulCost(strings.Count(string(format), "{"), values))
+}
+
+func splitCost(recv starlark.Value, _ starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	return mulCost(shallowCost(recv)+1, 17)
+}
+
+func iterableCost(args starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	if len(args) == 0 {
+		return 0
+	}
+	if s, ok := args[0].(starlark.String); ok {
+		return len(s)
+	}
+	return mulCost(iterCount(args[0]), 16)
+}
+
+func zipCost(args starlark.Tuple, _ []starlark.Tuple, _ int) int {
+	shortest := 0
+	for i, arg := range args {
+		if n := iterCount(arg); i == 0 || n < shortest {
+			shortest = n
+		}
+	}
+	return mulCost(shortest, 16*(len(args)+1))
+}
+
+func dictCost(args starlark.Tuple, kwargs []starlark.Tuple, limit int) int {
+	return mulCost(argsCost(nil, args, kwargs, limit), 2)
+}
+
+func reprCost(args starlark.Tuple, kwargs []starlark.Tuple, limit int) int {
+	total := 0
+	for _, arg := range args {
+		total = addCost(total, deepCost(arg, limit))
+	}
+	for _, kwarg := range kwargs {
+		total = addCost(total, deepCost(kwarg[1], limit))
+	}
+	return total
+}
+
+// guardScript rewrites a parsed script so that everything that can build large values
+// goes through the guards
+func guardScript(f *syntax.File) error {
+	var err error
+	f.Stmts, err = guardStmts(f.Stmts)
+	return err
+}
+
+func guardStmts(stmts []syntax.Stmt) ([]syntax.Stmt, error) {
+	for _, stmt := range stmts {
+		if err := guardStmt(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return stmts, nil
+}
+
+func guardStmt(stmt syntax.Stmt) error {
+	var err error
+	switch s := stmt.(type) {
+	case *syntax.AssignStmt:
+		if _, augmented := scriptAugmentGuards[s.Op]; !augmented {
+			guardTarget(s.LHS)
+			s.RHS = guardExpr(s.RHS)
+			return nil
+		}
+		if !pureExpr(s.LHS) {
+			return fmt.Errorf("%s: %s target must not call functions", s.OpPos, s.Op)
+		}
+		current := guardExpr(cloneExpr(s.LHS))
+		guardTarget(s.LHS)
+		s.RHS = guardCall(s.OpPos, "$"+s.Op.String(), current, guardExpr(s.RHS))
+	case *syntax.DefStmt:
+		guardParams(s.Params)
+		s.Body, err = guardStmts(s.Body)
+	case *syntax.ExprStmt:
+		s.X = guardExpr(s.X)
+	case *syntax.IfStmt:
+		s.Cond = guardExpr(s.Cond)
+		if s.True, err = guardStmts(s.True); err == nil {
+			s.False, err = guardStmts(s.False)
+		}
+	case *syntax.ForStmt:
+		guardTarget(s.Vars)
+		s.X = guardExpr(s.X)
+		s.Body, err = guardStmts(s.Body)
+	case *syntax.WhileStmt:
+		s.Cond = guardExpr(s.Cond)
+		s.Body, err = guardStmts(s.Body)
+	case *syntax.ReturnStmt:
+		if s.Result != nil {
+			s.Result = guardExpr(s.Result)
+		}
+	}
+	return err
+}
+
+// guardTarget guards the expressions inside an assignment target, leaving the target itself
+func guardTarget(target syntax.Expr) {
+	switch t := target.(type) {
+	case *syntax.ParenExpr:
+		guardTarget(t.X)
+	case *syntax.TupleExpr:
+		for _, elem := range t.List {
+			guardTarget(elem)
+		}
+	case *syntax.ListExpr:
+		for _, elem := range t.List {
+			guardTarget(elem)
+		}
+	case *syntax.IndexExpr:
+		t.X = guardExpr(t.X)
+		t.Y = guardExpr(t.Y)
+	case *syntax.DotExpr:
+		t.X = guardExpr(t.X)
+	}
+}
+
+func guardParams(params []syntax.Expr) {
+	for _, param := range params {
+		if def, ok := param.(*syntax.BinaryExpr); ok && def.Op == syntax.EQ {
+			def.Y = guardExpr(def.Y)
+		}
+	}
+}
+
+func guardExprs(exprs []syntax.Expr) {
+	for i, expr := range exprs {
+		exprs[i] = guardExpr(expr)
+	}
+}
+
+func guardExpr(expr syntax.Expr) syntax.Expr {
+	switch e := expr.(type) {
+	case *syntax.ParenExpr:
+		e.X = guardExpr(e.X)
+	case *syntax.CallExpr:
+		e.Fn = guardExpr(e.Fn)
+		for i, arg := range e.Args {
+			if a, ok := arg.(*syntax.BinaryExpr); ok && a.Op == syntax.EQ { // name=value
+				a.Y = guardExpr(a.Y)
+			} else if a, ok := arg.(*syntax.UnaryExpr); ok && (a.Op == syntax.STAR || a.Op == syntax.STARSTAR) {
+				a.X = guardCall(a.OpPos, "$spread", guardExpr(a.X))
+			} else {
+				e.Args[i] = guardExpr(arg)
+			}
+		}
+	case *syntax.DotExpr:
+		e.X = guardExpr(e.X)
+		if _, ok := scriptMethodCosts[e.Name.Name]; ok {
+			name := &syntax.Literal{Token: syntax.STRING, TokenPos: e.NamePos, Raw: strconv.Quote(e.Name.Name), Value: e.Name.Name}
+			return guardCall(e.Dot, "$method", e.X, name)
+		}
+	case *syntax.Comprehension:
+		for _, clause := range e.Clauses {
+			switch c := clause.(type) {
+			case *syntax.ForClause:
+				guardTarget(c.Vars)
+				c.X = guardExpr(c.X)
+			case *syntax.IfClause:
+				c.Cond = guardExpr(c.Cond)
+			}
+		}
+		e.Body = guardExpr(e.Body)
+	case *syntax.DictExpr:
+		for _, entry := range e.List {
+			entry := entry.(*syntax.DictEntry)
+			entry.Key = guardExpr(entry.Key)
+			entry.Value = guardExpr(entry.Value)
+		}
+	case *syntax.DictEntry:
+		e.Key = guardExpr(e.Key)
+		e.Value = guardExpr(e.Value)
+	case *syntax.LambdaExpr:
+		guardParams(e.Params)
+		e.Body = guardExpr(e.Body)
+	case *syntax.ListExpr:
+		guardExprs(e.List)
+	case *syntax.TupleExpr:
+		guardExprs(e.List)
+	case *syntax.CondExpr:
+		e.Cond = guardExpr(e.Cond)
+		e.True = guardExpr(e.True)
+		e.False = guardExpr(e.False)
+	case *syntax.UnaryExpr:
+		if e.X != nil {
+			e.X = guardExpr(e.X)
+		}
+	case *syntax.BinaryExpr:
+		e.X = guardExpr(e.X)
+		e.Y = guardExpr(e.Y)
+		if name, ok := scriptBinaryGuards[e.Op]; ok {
+			return guardCall(e.OpPos, name, e.X, e.Y)
+		}
+	case *syntax.SliceExpr:
+		e.X = guardCall(e.Lbrack, "$slice", guardExpr(e.X))
+		for _, part := range []*syntax.Expr{&e.Lo, &e.Hi, &e.Step} {
+			if *part != nil {
+				*part = guardExpr(*part)
+			}
+		}
+	case *syntax.IndexExpr:
+		e.X = guardExpr(e.X)
+		e.Y = guardExpr(e.Y)
+	}
+	return expr
+}
+
+func guardCall(pos syntax.Position, guard string, args ...syntax.Expr) syntax.Expr {
+	return &syntax.CallExpr{
+		Fn:     &syntax.Ident{NamePos: pos, Name: guard},
+		Lparen: pos,
+		Args:   args,
+		Rparen: pos,
+	}
+}
+
+// pureExpr reports whether evaluating expr twice has no side effects, so an augmented
+// assignment target can be read once more for the size check
+func pureExpr(expr syntax.Expr) bool {
+	switch e := expr.(type) {
+	case *syntax.Ident, *syntax.Literal:
+		return true
+	case *syntax.ParenExpr:
+		return pureExpr(e.X)
+	case *syntax.DotExpr:
+		return pureExpr(e.X)
+	case *syntax.IndexExpr:
+		return pureExpr(e.X) && pureExpr(e.Y)
+	case *syntax.UnaryExpr:
+		return e.X != nil && pureExpr(e.X)
+	case *syntax.BinaryExpr:
+		return pureExpr(e.X) && pureExpr(e.Y)
+	}
+	return false
+}
+
+// cloneExpr copies a pure expression
+func cloneExpr(expr syntax.Expr) syntax.Expr {
+	switch e := expr.(type) {
+	case *syntax.Ident:
+		return &syntax.Ident{NamePos: e.NamePos, Name: e.Name}
+	case *syntax.Literal:
+		c := *e
+		return &c
+	case *syntax.ParenExpr:
+		return &syntax.ParenExpr{Lparen: e.Lparen, X: cloneExpr(e.X), Rparen: e.Rparen}
+	case *syntax.DotExpr:
+		return &syntax.DotExpr{X: cloneExpr(e.X), Dot: e.Dot, NamePos: e.NamePos, Name: &syntax.Ident{NamePos: e.Name.NamePos, Name: e.Name.Name}}
+	case *syntax.IndexExpr:
+		return &syntax.IndexExpr{X: cloneExpr(e.X), Lbrack: e.Lbrack, Y: cloneExpr(e.Y), Rbrack: e.Rbrack}
+	case *syntax.UnaryExpr:
+		return &syntax.UnaryExpr{OpPos: e.OpPos, Op: e.Op, X: cloneExpr(e.X)}
+	case *syntax.BinaryExpr:
+		return &syntax.BinaryExpr{X: cloneExpr(e.X), OpPos: e.OpPos, Op: e.Op, Y: cloneExpr(e.Y)}
+	}
+	return expr
+}
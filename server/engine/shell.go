@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShellConfig controls how shell actions are executed
+type ShellConfig struct {
+	Timeout   time.Duration // Default timeout for actions that don't set their own
+	Allowlist []string      // Permitted executables; empty keeps the plain "sh -c" behaviour
+}
+
+var (
+	shellMu     sync.RWMutex
+	shellConfig = ShellConfig{Timeout: 2 * time.Second}
+)
+
+// SetShellConfig replaces the shell action configuration
+func SetShellConfig(cfg ShellConfig) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+
+	shellMu.Lock()
+	shellConfig = cfg
+	shellMu.Unlock()
+}
+
+func getShellConfig() ShellConfig {
+	shellMu.RLock()
+	defer shellMu.RUnlock()
+	return shellConfig
+}
+
+// shellInput is the JSON document written to the command's stdin
+type shellInput struct {
+	FiveTuple
+	Packet string                 `json:"packet"` // Hex string
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// executeShellCommand runs the action command with the packet context on stdin and in the environment.
+// With an allowlist configured, the command is split on whitespace and run directly (no shell),
+// so only allowlisted executables can be started.
+func executeShellCommand(action Action, ctx *PacketContext) (string, error) {
+	cfg := getShellConfig()
+
+	timeout := cfg.Timeout
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout) * time.Millisecond
+	}
+
+	execCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if len(cfg.Allowlist) > 0 {
+		argv := strings.Fields(action.Value)
+		if len(argv) == 0 {
+			return "", fmt.Errorf("empty shell command")
+		}
+		if !isExecutableAllowed(argv[0], cfg.Allowlist) {
+			return "", fmt.Errorf("executable not allowed: %s", argv[0])
+		}
+		cmd = exec.CommandContext(execCtx, argv[0], argv[1:]...)
+	} else {
+		cmd = exec.CommandContext(execCtx, "sh", "-c", action.Value)
+	}
+
+	// Don't wait forever on pipes held open by orphaned children
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	input, err := json.Marshal(shellInput{
+		FiveTuple: ctx.FiveTuple(),
+		Packet:    hex.EncodeToString(ctx.RawPacket),
+		Fields:    ctx.Fields,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode shell input: %w", err)
+	}
+
+	cmd.Env = append(os.Environ(), shellEnv(ctx)...)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("shell command timed out after %s", timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("shell command failed: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("shell command failed: %w", err)
+	}
+	return string(output), nil
+}
+
+// isExecutableAllowed checks an executable against the allowlist.
+// Entries containing a slash must match the path exactly, bare names must match the bare name.
+func isExecutableAllowed(executable string, allowlist []string) bool {
+	for _, allowed := range allowlist {
+		if strings.Contains(allowed, "/") {
+			if filepath.Clean(executable) == filepath.Clean(allowed) {
+				return true
+			}
+		} else if executable == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// shellEnv exposes the packet and its fields as environment variables
+func shellEnv(ctx *PacketContext) []string {
+	tuple := ctx.FiveTuple()
+	env := []string{
+		"PACKET_HEX=" + hex.EncodeToString(ctx.RawPacket),
+		"PACKET_LEN=" + strconv.Itoa(len(ctx.RawPacket)),
+		"SRC_IP=" + tuple.SrcIP,
+		"DST_IP=" + tuple.DstIP,
+		"SRC_PORT=" + strconv.Itoa(tuple.SrcPort),
+		"DST_PORT=" + strconv.Itoa(tuple.DstPort),
+		"PROTOCOL=" + tuple.Protocol,
+	}
+
+	for name, value := range ctx.Fields {
+		if value == nil {
+			continue
+		}
+		env = append(env, "FIELD_"+envName(name)+"="+fmt.Sprintf("%v", value))
+	}
+
+	return env
+}
+
+// envName replaces characters that are not valid in environment variable names
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// applyShellOutput stores the command output. A JSON object sets every field it names,
+// anything else is assigned to the action's field.
+func applyShellOutput(fieldName string, output string, ctx *PacketContext) {
+	output = strings.TrimSpace(output)
+
+	if strings.HasPrefix(output, "{") {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(output), &values); err == nil {
+			for name, value := range values {
+				ctx.Fields[name] = normalizeJSONValue(value)
+			}
+			return
+		}
+	}
+
+	ctx.Fields[fieldName] = output
+}
+
+// normalizeJSONValue converts whole JSON numbers to int64 to match extracted decimal fields
+func normalizeJSONValue(value interface{}) interface{} {
+	if f, ok := value.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return int64(f)
+	}
+	return value
+}
@@ -0,0 +1,402 @@
+package engine
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"packet-repackage/models"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Starlark scripts see these predeclared names:
+//
+//	fields      dict of field name -> value (writable in actions)
+//	packet      current packet bytes
+//	tuple       dict with src_ip, dst_ip, src_port, dst_port, protocol (writable in actions)
+//	set_packet  set_packet(b) replaces the packet bytes (actions only)
+//
+// A condition script is either a single expression or a program that assigns
+// a boolean to the global "result".
+
+// ScriptConfig limits the resources a single script run may use. Allocation is counted
+// by the guards scripts are compiled with (see scriptalloc.go), and values handed back to
+// the packet are capped at maxScriptValue.
+type ScriptConfig struct {
+	MaxSteps uint64 // Starlark execution steps per run
+	MaxAlloc int    // bytes of values a run may build, 0 for no limit
+}
+
+// maxScriptValue is the largest packet, string or bytes value a script may hand back
+const maxScriptValue = 0xffff
+
+var (
+	scriptMu     sync.RWMutex
+	scriptConfig = ScriptConfig{MaxSteps: 100000, MaxAlloc: 8 << 20}
+
+	// compiled holds programs compiled at reload, keyed by source
+	compiled = map[string]*starlark.Program{}
+)
+
+// Loops are allowed at top level; the step limit keeps them bounded
+var scriptFileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+}
+
+var scriptPredeclared = starlark.StringDict{
+	"fields":     starlark.None,
+	"packet":     starlark.None,
+	"tuple":      starlark.None,
+	"set_packet": starlark.None,
+}
+
+// SetScriptConfig replaces the script resource limits
+func SetScriptConfig(cfg ScriptConfig) {
+	scriptMu.Lock()
+	scriptConfig = cfg
+	scriptMu.Unlock()
+}
+
+// CompileScripts compiles every Starlark condition and action of the rules, replacing
+// the previously compiled set. Rules that fail to compile are reported but don't stop the others.
+func CompileScripts(rules []models.Rule) error {
+	programs := make(map[string]*starlark.Program)
+	var errs []error
+
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.ConditionScript) != "" {
+			prog, err := compileScript(rule.ConditionScript, true)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule %s condition: %w", rule.Name, err))
+			} else {
+				programs[conditionKey(rule.ConditionScript)] = prog
+			}
+		}
+
+		var actions []Action
+		if err := json.Unmarshal([]byte(rule.Actions), &actions); err != nil {
+			continue
+		}
+		errs = compileActionScripts(rule.Name, actions, programs, errs)
+	}
+
+	scriptMu.Lock()
+	compiled = programs
+	scriptMu.Unlock()
+
+	return errors.Join(errs...)
+}
+
+// compileActionScripts compiles the Starlark actions of a list, including those nested in
+// "if" branches, into programs
+func compileActionScripts(ruleName string, actions []Action, programs map[string]*starlark.Program, errs []error) []error {
+	for _, action := range actions {
+		if action.Op == "if" {
+			errs = compileActionScripts(ruleName, action.Then, programs, errs)
+			for _, branch := range action.Elif {
+				errs = compileActionScripts(ruleName, branch.Then, programs, errs)
+			}
+			errs = compileActionScripts(ruleName, action.Else, programs, errs)
+			continue
+		}
+		if action.Op != "starlark" {
+			continue
+		}
+		prog, err := compileScript(action.Value, false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s action on %s: %w", ruleName, action.Field, err))
+			continue
+		}
+		programs[action.Value] = prog
+	}
+	return errs
+}
+
+func conditionKey(src string) string {
+	return "condition:" + src
+}
+
+func compileScript(src string, condition bool) (*starlark.Program, error) {
+	if condition {
+		// A bare expression is the result
+		if _, err := syntax.ParseExpr("condition", src, 0); err == nil {
+			src = "result = (\n" + src + "\n)"
+		}
+	}
+
+	f, err := scriptFileOptions.Parse("script", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := guardScript(f); err != nil {
+		return nil, err
+	}
+	return starlark.FileProgram(f, isScriptPredeclared)
+}
+
+func isScriptPredeclared(name string) bool {
+	return scriptPredeclared.Has(name) || scriptGuards.Has(name)
+}
+
+// lookupScript returns the program compiled at reload, compiling on demand for
+// scripts that weren't part of the loaded rules (e.g. test mode)
+func lookupScript(src string, condition bool) (*starlark.Program, ScriptConfig, error) {
+	key := src
+	if condition {
+		key = conditionKey(src)
+	}
+
+	scriptMu.RLock()
+	prog := compiled[key]
+	cfg := scriptConfig
+	scriptMu.RUnlock()
+
+	if prog != nil {
+		return prog, cfg, nil
+	}
+	prog, err := compileScript(src, condition)
+	return prog, cfg, err
+}
+
+// EvaluateScriptCondition runs a Starlark condition script against the packet
+func EvaluateScriptCondition(src string, ctx *PacketContext) (bool, error) {
+	prog, cfg, err := lookupScript(src, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to compile condition script: %w", err)
+	}
+
+	env := newScriptEnv(ctx, true)
+	globals, err := runScript(prog, cfg, env.predeclared())
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := globals["result"]
+	if !ok {
+		return false, fmt.Errorf("condition script did not set result")
+	}
+	return bool(result.Truth()), nil
+}
+
+// executeStarlark runs a Starlark action script and applies its changes to the context
+func executeStarlark(action Action, ctx *PacketContext) error {
+	prog, cfg, err := lookupScript(action.Value, false)
+	if err != nil {
+		return fmt.Errorf("failed to compile script: %w", err)
+	}
+
+	env := newScriptEnv(ctx, false)
+	if _, err := runScript(prog, cfg, env.predeclared()); err != nil {
+		return err
+	}
+
+	return env.apply(ctx)
+}
+
+func runScript(prog *starlark.Program, cfg ScriptConfig, predeclared starlark.StringDict) (starlark.StringDict, error) {
+	thread := &starlark.Thread{
+		Name:  "script",
+		Print: func(*starlark.Thread, string) {},
+	}
+
+	if cfg.MaxSteps > 0 {
+		thread.SetMaxExecutionSteps(cfg.MaxSteps)
+	}
+	if cfg.MaxAlloc > 0 {
+		thread.SetLocal(scriptAllocKey, &scriptAlloc{limit: cfg.MaxAlloc})
+	}
+	for name, guard := range scriptGuards {
+		predeclared[name] = guard
+	}
+
+	globals, err := prog.Init(thread, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("script failed: %w", err)
+	}
+	return globals, nil
+}
+
+// scriptEnv holds the values handed to one script run
+type scriptEnv struct {
+	fields    *starlark.Dict
+	tuple     *starlark.Dict
+	packet    starlark.Bytes
+	newPacket []byte
+	before    map[string]starlark.Value
+	origTuple FiveTuple
+}
+
+func newScriptEnv(ctx *PacketContext, readOnly bool) *scriptEnv {
+	env := &scriptEnv{
+		fields:    starlark.NewDict(len(ctx.Fields)),
+		tuple:     starlark.NewDict(5),
+		packet:    starlark.Bytes(ctx.RawPacket),
+		before:    make(map[string]starlark.Value),
+		origTuple: ctx.FiveTuple(),
+	}
+
+	for name, value := range ctx.Fields {
+		sv := toStarlark(value)
+		env.fields.SetKey(starlark.String(name), sv)
+		env.before[name] = sv
+	}
+
+	env.tuple.SetKey(starlark.String("src_ip"), starlark.String(env.origTuple.SrcIP))
+	env.tuple.SetKey(starlark.String("dst_ip"), starlark.String(env.origTuple.DstIP))
+	env.tuple.SetKey(starlark.String("src_port"), starlark.MakeInt(env.origTuple.SrcPort))
+	env.tuple.SetKey(starlark.String("dst_port"), starlark.MakeInt(env.origTuple.DstPort))
+	env.tuple.SetKey(starlark.String("protocol"), starlark.String(env.origTuple.Protocol))
+
+	if readOnly {
+		env.fields.Freeze()
+		env.tuple.Freeze()
+	}
+
+	return env
+}
+
+func (env *scriptEnv) predeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"fields": env.fields,
+		"packet": env.packet,
+		"tuple":  env.tuple,
+		"set_packet": starlark.NewBuiltin("set_packet", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var data starlark.Bytes
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &data); err != nil {
+				return nil, err
+			}
+			if len(data) > maxScriptValue {
+				return nil, fmt.Errorf("%s: packet of %d bytes exceeds %d", fn.Name(), len(data), maxScriptValue)
+			}
+			env.newPacket = []byte(data)
+			return starlark.None, nil
+		}),
+	}
+}
+
+// apply writes packet, 5-tuple and field changes made by the script back to the context
+func (env *scriptEnv) apply(ctx *PacketContext) error {
+	if env.newPacket != nil {
+		if err := ctx.ReplacePacket(env.newPacket); err != nil {
+			return fmt.Errorf("script set an invalid packet: %w", err)
+		}
+	}
+
+	// 5-tuple changes are patched into the raw bytes
+	tupleChanged := false
+	patched := make([]byte, len(ctx.RawPacket))
+	copy(patched, ctx.RawPacket)
+	for _, name := range []string{"src_ip", "dst_ip", "src_port", "dst_port"} {
+		value, _, err := env.tuple.Get(starlark.String(name))
+		if err != nil || value == nil {
+			continue
+		}
+		goValue := fromStarlark(value)
+		if fmt.Sprintf("%v", goValue) == fmt.Sprintf("%v", tupleValue(env.origTuple, name)) {
+			continue
+		}
+		if err := setBuiltinValue(patched, ctx, name, goValue); err != nil {
+			return err
+		}
+		tupleChanged = true
+	}
+	if tupleChanged {
+		if err := ctx.ReplacePacket(patched); err != nil {
+			return err
+		}
+	}
+
+	// Field values: only changed ones are written, so re-extracted values survive
+	for _, item := range env.fields.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			continue
+		}
+		if before, seen := env.before[name]; seen {
+			if equal, err := starlark.Equal(before, item[1]); err == nil && equal {
+				continue
+			}
+		}
+		if size := scriptValueSize(item[1]); size > maxScriptValue {
+			return fmt.Errorf("script set field %s to %d bytes, more than %d", name, size, maxScriptValue)
+		}
+		ctx.Fields[name] = fromStarlark(item[1])
+	}
+
+	return nil
+}
+
+// scriptValueSize returns the length of string and bytes values, 0 for others
+func scriptValueSize(value starlark.Value) int {
+	switch v := value.(type) {
+	case starlark.String:
+		return len(v)
+	case starlark.Bytes:
+		return len(v)
+	}
+	return 0
+}
+
+func tupleValue(tuple FiveTuple, name string) interface{} {
+	switch name {
+	case "src_ip":
+		return tuple.SrcIP
+	case "dst_ip":
+		return tuple.DstIP
+	case "src_port":
+		return tuple.SrcPort
+	case "dst_port":
+		return tuple.DstPort
+	}
+	return nil
+}
+
+func toStarlark(value interface{}) starlark.Value {
+	switch v := value.(type) {
+	case nil:
+		return starlark.None
+	case string:
+		return starlark.String(v)
+	case int:
+		return starlark.MakeInt(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case float64:
+		return starlark.Float(v)
+	case bool:
+		return starlark.Bool(v)
+	case []byte:
+		return starlark.Bytes(v)
+	default:
+		return starlark.String(fmt.Sprintf("%v", v))
+	}
+}
+
+func fromStarlark(value starlark.Value) interface{} {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.String:
+		return string(v)
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i
+		}
+		return v.String()
+	case starlark.Float:
+		return float64(v)
+	case starlark.Bool:
+		return bool(v)
+	case starlark.Bytes:
+		return hex.EncodeToString([]byte(v))
+	default:
+		return v.String()
+	}
+}
@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScriptAllocationLimit(t *testing.T) {
+	SetScriptConfig(ScriptConfig{MaxSteps: 100000, MaxAlloc: 1 << 20})
+	t.Cleanup(func() { SetScriptConfig(ScriptConfig{MaxSteps: 100000, MaxAlloc: 8 << 20}) })
+
+	const limited = "allocation limit"
+	tests := []struct {
+		name    string
+		src     string
+		want    bool
+		wantErr string
+	}{
+		{"repeat string", `"x" * (1 << 30)`, false, limited},
+		{"repeat string reversed", `(1 << 30) * "x"`, false, limited},
+		{"repeat list", `len([0] * (1 << 30)) > 0`, false, limited},
+		{"double by concatenation", "s = 'x'\nfor i in range(40):\n    s = s + s\nresult = True", false, limited},
+		{"double in place", "s = 'x'\nfor i in range(40):\n    s += s\nresult = True", false, limited},
+		{"double list in place", "l = [0]\nfor i in range(40):\n    l += l\nresult = True", false, limited},
+		{"extend with itself", "l = [0]\nfor i in range(40):\n    l.extend(l)\nresult = True", false, limited},
+		{"materialize range", `len(list(range(1 << 30))) > 0`, false, limited},
+		{"spread range", "def f(*args):\n    return len(args)\nresult = f(*range(1 << 30)) > 0", false, limited},
+		{"join", `len("".join(["x" * 60000] * 100)) > 0`, false, limited},
+		{"replace", "s = 'x' * 1000\nfor i in range(5):\n    s = s.replace('x', 'xxxx')\nresult = True", false, limited},
+		{"format repeated value", "s = 'x' * 10000\nresult = len(str([s] * 1000)) > 0", false, limited},
+		{"getattr method", "s = 'x' * 1000\nfor i in range(5):\n    s = getattr(s, 'replace')('x', 'xxxx')\nresult = True", false, limited},
+		{"big int", "x = 3\nfor i in range(40):\n    x = x * x\nresult = x > 0", false, limited},
+
+		{"concatenation", `[1, 2] + [3] == [1, 2, 3]`, true, ""},
+		{"formatting", `"%s-%d" % ("ab", 7) == "ab-7"`, true, ""},
+		{"methods", `"a,b".split(",") == ["a", "b"] and "-".join(["a", "b"]) == "a-b"`, true, ""},
+		{"getattr", `getattr("ab", "upper")() == "AB" and getattr("ab", "nope", 1) == 1`, true, ""},
+		{"slice", `"abcdef"[1:3] == "bc" and range(10)[2:4] == range(2, 4)`, true, ""},
+		{"augmented index", "d = {'a': 1}\nd['a'] += 2\nresult = d['a'] == 3", true, ""},
+		{"comprehension", "l = [str(i) for i in range(1000)]\nresult = len(l) == 1000", true, ""},
+		{"packet", `len(packet) > 20 and packet[:1] == b"\x45"`, true, ""},
+
+		{"type error", `1 + "a"`, false, "unknown binary op: int + string"},
+		{"impure augmented target", "l = [1]\ndef f():\n    return 0\nl[f()] += 1\nresult = True", false, "must not call functions"},
+	}
+
+	ctx, err := ParsePacket(tcpTestPacket(t, true, 1000, 2000, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EvaluateScriptCondition(tt.src, ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("result = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,540 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Application messages over TCP can span segments, and one segment can carry several. For rules
+// in stream mode the payload of a connection is reassembled per direction and cut into messages
+// by a length field. Each message is matched and rewritten on its own as a packet carrying just
+// that message, and the rewritten messages go out as new segments whose sequence numbers are
+// kept consistent by AdjustTCPSequence. Data is held until its message is complete, segments
+// arriving out of order are dropped for the sender to retransmit, and a connection whose framing
+// is lost falls back to per-packet processing.
+//
+// A sender waiting for the acknowledgement of held data before it sends the rest (Nagle) only
+// retransmits. After maxHoldRetransmits such retransmissions the held bytes are forwarded
+// unmodified; framing resumes after their message when its length is known, else it is lost.
+//
+// Held bytes and the outputs kept for retransmissions count against a memory limit across all
+// connections. Past it the connections seen least recently lose their framing, oldest first.
+
+// StreamConfig describes how a stream-mode rule finds messages in a TCP connection
+type StreamConfig struct {
+	Ports        []int  `json:"ports"`         // Connections to reassemble, by either port
+	Start        string `json:"start"`         // Hex bytes every message starts with, e.g. "68" (optional)
+	LengthOffset int    `json:"length_offset"` // Position of the length field within a message
+	LengthSize   int    `json:"length_size"`   // Width of the length field: 1, 2 or 4 bytes
+	LengthAdjust int    `json:"length_adjust"` // Added to the length field to get the message size
+	LittleEndian bool   `json:"little_endian"`
+	MaxLength    int    `json:"max_length"` // Larger messages mean the framing was lost (default 65535)
+
+	start []byte
+}
+
+// Stream statuses returned by FeedStream
+const (
+	StreamPass   = "pass"   // Not stream data: process the segment as a packet
+	StreamHold   = "hold"   // Data held or discarded: drop the segment
+	StreamEmit   = "emit"   // Messages complete: rewrite them and send EmitStream's segments instead
+	StreamResend = "resend" // Retransmission of data already sent: send Segments instead
+)
+
+// streamIdle is how long the state of a connection is kept without segments
+const streamIdle = 10 * time.Minute
+
+// maxSentOutputs bounds the unacknowledged outputs kept per direction for retransmissions
+const maxSentOutputs = 64
+
+// minStreamSegment is the payload size output segments may always use (the default TCP MSS)
+const minStreamSegment = 536
+
+// maxHoldRetransmits is how many retransmissions of held data are dropped before it is forwarded
+const maxHoldRetransmits = 2
+
+// defaultStreamMaxMemory is the default limit on bytes held across all connections
+const defaultStreamMaxMemory = 16 << 20
+
+// StreamChunk is what FeedStream makes of a segment
+type StreamChunk struct {
+	Status   string
+	Lead     []byte   // Bytes forwarded unmodified before the messages: the rest of a released message
+	Messages [][]byte // Complete messages (StreamEmit)
+	Raw      []byte   // Bytes forwarded unmodified after the messages: a flush on FIN, lost framing or release
+	Segments [][]byte // Segments to resend (StreamResend)
+
+	key        seqKey
+	seq        uint32 // Sequence number of Lead, or of the first message
+	template   []byte // Segment that completed the messages; output segments copy its headers
+	maxSegment int
+}
+
+type tcpStream struct {
+	next        uint32         // Sequence number of the next byte expected
+	buffer      []byte         // Held bytes, starting at next - len(buffer)
+	skip        int            // Bytes of a released message still to forward before framing resumes
+	retransmits int            // Retransmissions of held data since the stream last advanced
+	maxSegment  int            // Largest payload seen
+	lost        bool           // Framing lost or connection closing: segments pass as packets
+	sent        []sentSegments // Outputs not yet acknowledged by the peer, oldest first
+	size        int            // Bytes of buffer and sent, counted against the memory limit
+	lastSeen    time.Time
+}
+
+// sentSegments remembers an output so retransmissions of its data get the same bytes
+type sentSegments struct {
+	start, end uint32 // Original sequence range the segments replaced, counting FIN
+	ackedBy    uint32 // Acknowledgement number, as the peer sends it, that covers the segments
+	segments   [][]byte
+}
+
+var tcpStreams = struct {
+	sync.Mutex
+	flows     map[seqKey]*tcpStream
+	memory    int
+	maxMemory int
+	lastSweep time.Time
+}{flows: map[seqKey]*tcpStream{}, maxMemory: defaultStreamMaxMemory}
+
+// SetStreamMaxMemory sets the bytes held and kept for retransmissions across all connections
+func SetStreamMaxMemory(maxMemory int) {
+	if maxMemory <= 0 {
+		maxMemory = defaultStreamMaxMemory
+	}
+	tcpStreams.Lock()
+	tcpStreams.maxMemory = maxMemory
+	limitStreamMemory()
+	tcpStreams.Unlock()
+}
+
+// ParseStreamConfig parses and validates the stream settings of a rule
+func ParseStreamConfig(configJSON string) (*StreamConfig, error) {
+	var cfg StreamConfig
+	if err := json.Unmarshal([]byte(configJSON), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid stream config: %w", err)
+	}
+
+	if len(cfg.Ports) == 0 {
+		return nil, fmt.Errorf("stream config needs at least one port")
+	}
+	for _, port := range cfg.Ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid stream port %d", port)
+		}
+	}
+	if cfg.LengthSize != 1 && cfg.LengthSize != 2 && cfg.LengthSize != 4 {
+		return nil, fmt.Errorf("stream length_size must be 1, 2 or 4")
+	}
+	if cfg.LengthOffset < 0 {
+		return nil, fmt.Errorf("stream length_offset must not be negative")
+	}
+	if cfg.MaxLength == 0 {
+		cfg.MaxLength = 65535
+	}
+	if cfg.MaxLength < cfg.LengthOffset+cfg.LengthSize {
+		return nil, fmt.Errorf("stream max_length %d is shorter than the length field", cfg.MaxLength)
+	}
+
+	start, err := hex.DecodeString(cfg.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream start bytes: %w", err)
+	}
+	cfg.start = start
+	return &cfg, nil
+}
+
+// MatchesPort reports whether connections with these ports are reassembled
+func (cfg *StreamConfig) MatchesPort(srcPort, dstPort int) bool {
+	for _, port := range cfg.Ports {
+		if port == srcPort || port == dstPort {
+			return true
+		}
+	}
+	return false
+}
+
+// messageLength returns the size of the message at the start of data, or 0 if more bytes are
+// needed to tell
+func (cfg *StreamConfig) messageLength(data []byte) (int, error) {
+	for i, b := range cfg.start {
+		if i < len(data) && data[i] != b {
+			return 0, fmt.Errorf("message starts with %#02x instead of %#02x at byte %d", data[i], b, i)
+		}
+	}
+
+	fieldEnd := cfg.LengthOffset + cfg.LengthSize
+	if len(data) < fieldEnd || len(data) < len(cfg.start) {
+		return 0, nil
+	}
+
+	field := append([]byte(nil), data[cfg.LengthOffset:fieldEnd]...)
+	if cfg.LittleEndian {
+		for i, j := 0, len(field)-1; i < j; i, j = i+1, j-1 {
+			field[i], field[j] = field[j], field[i]
+		}
+	}
+	length := int(bytesToDecimal(field)) + cfg.LengthAdjust
+	if length < fieldEnd || length < len(cfg.start) || length > cfg.MaxLength {
+		return 0, fmt.Errorf("message length %d out of range", length)
+	}
+	return length, nil
+}
+
+// FeedStream adds a TCP segment to the stream of its connection and direction. Segments must be
+// fed in the order they arrive. An error means the framing was lost; the returned chunk is still
+// valid and flushes the held data.
+func FeedStream(packet []byte, cfg *StreamConfig) (StreamChunk, error) {
+	chunk := StreamChunk{Status: StreamPass}
+
+	seg, ok := findTCPSegment(packet)
+	if !ok || !cfg.MatchesPort(int(seg.key.srcPort), int(seg.key.dstPort)) {
+		return chunk, nil
+	}
+	tcp := seg.tcp
+	payloadStart := seg.offset + int(tcp.DataOffset)*4
+	payload := packet[payloadStart : payloadStart+seg.payloadLen]
+
+	now := time.Now()
+	tcpStreams.Lock()
+	defer tcpStreams.Unlock()
+	sweepStreams(now)
+
+	var stream *tcpStream
+	defer func() {
+		if stream != nil && tcpStreams.flows[seg.key] == stream {
+			stream.account()
+		}
+		limitStreamMemory()
+	}()
+
+	// The peer acknowledging our output means it no longer needs resending
+	if tcp.ACK {
+		reverse := seqKey{src: seg.key.dst, dst: seg.key.src, srcPort: seg.key.dstPort, dstPort: seg.key.srcPort}
+		if other := tcpStreams.flows[reverse]; other != nil {
+			for len(other.sent) > 0 && !seqAfter(other.sent[0].ackedBy, tcp.Ack) {
+				other.sent = other.sent[1:]
+			}
+			other.account()
+		}
+	}
+
+	stream = tcpStreams.flows[seg.key]
+	if tcp.RST || tcp.SYN {
+		discardStream(seg.key)
+		return chunk, nil
+	}
+	if stream == nil {
+		if len(payload) == 0 {
+			return chunk, nil
+		}
+		stream = &tcpStream{next: tcp.Seq}
+		tcpStreams.flows[seg.key] = stream
+	}
+	stream.lastSeen = now
+
+	end := tcp.Seq + uint32(len(payload))
+	reach := end // End of the sequence space the segment uses, counting FIN
+	if tcp.FIN {
+		reach++
+	}
+
+	// Retransmissions of data already taken from the stream get the segments sent for it
+	if len(payload) > 0 && !seqAfter(end, stream.next) || stream.lost && tcp.FIN && end == stream.next {
+		for _, sent := range stream.sent {
+			if seqAfter(sent.end, tcp.Seq) && seqAfter(reach, sent.start) {
+				chunk.Segments = append(chunk.Segments, sent.segments...)
+			}
+		}
+		if chunk.Segments != nil {
+			chunk.Status = StreamResend
+			return chunk, nil
+		}
+		if stream.lost {
+			return chunk, nil
+		}
+		chunk.Status = StreamHold
+		if len(stream.buffer) == 0 || !seqAfter(end, stream.next-uint32(len(stream.buffer))) {
+			// Acknowledged already
+			return chunk, nil
+		}
+		// The sender may be waiting for an acknowledgement of the held data
+		stream.retransmits++
+		if stream.retransmits >= maxHoldRetransmits {
+			chunk = stream.release(cfg, seg, packet)
+		}
+		return chunk, nil
+	}
+	if stream.lost {
+		return chunk, nil
+	}
+
+	if len(payload) == 0 && (!tcp.FIN || len(stream.buffer) == 0) {
+		// Acknowledgements, and a FIN with nothing held, need no stream handling
+		if tcp.FIN {
+			stream.lost = true
+		}
+		return chunk, nil
+	}
+
+	bufferStart := stream.next - uint32(len(stream.buffer))
+	if seqAfter(tcp.Seq, stream.next) {
+		// Missing data before this segment; the sender retransmits both
+		chunk.Status = StreamHold
+		return chunk, nil
+	}
+
+	if len(payload) > stream.maxSegment {
+		stream.maxSegment = len(payload)
+	}
+	if seqAfter(end, stream.next) {
+		stream.buffer = append(stream.buffer, payload[stream.next-tcp.Seq:]...)
+		stream.next = end
+		stream.retransmits = 0
+	}
+
+	chunk.key = seg.key
+	chunk.seq = bufferStart
+	chunk.template = append([]byte(nil), packet...)
+	chunk.maxSegment = stream.maxSegment
+
+	var framingErr error
+	consumed := 0
+	if stream.skip > 0 {
+		consumed = min(stream.skip, len(stream.buffer))
+		chunk.Lead = stream.buffer[:consumed]
+		stream.skip -= consumed
+	}
+	for consumed < len(stream.buffer) {
+		length, err := cfg.messageLength(stream.buffer[consumed:])
+		if err != nil {
+			framingErr = err
+			stream.lost = true
+			break
+		}
+		if length == 0 || consumed+length > len(stream.buffer) {
+			break
+		}
+		chunk.Messages = append(chunk.Messages, stream.buffer[consumed:consumed+length])
+		consumed += length
+	}
+
+	if stream.lost || tcp.FIN {
+		stream.lost = true
+		chunk.Raw = stream.buffer[consumed:]
+		stream.buffer = nil
+	} else {
+		stream.buffer = append([]byte(nil), stream.buffer[consumed:]...)
+	}
+
+	if len(chunk.Lead) == 0 && len(chunk.Messages) == 0 && len(chunk.Raw) == 0 && !tcp.FIN {
+		chunk.Status = StreamHold
+		return chunk, framingErr
+	}
+	chunk.Status = StreamEmit
+	return chunk, framingErr
+}
+
+// release forwards the held bytes of a stream unmodified, as chunk.Raw of a segment built from
+// packet. Framing continues after the message they start if its length is known.
+func (stream *tcpStream) release(cfg *StreamConfig, seg tcpSegment, packet []byte) StreamChunk {
+	chunk := StreamChunk{
+		Status:     StreamEmit,
+		Raw:        stream.buffer,
+		key:        seg.key,
+		seq:        stream.next - uint32(len(stream.buffer)),
+		template:   append([]byte(nil), packet...),
+		maxSegment: stream.maxSegment,
+	}
+
+	length, err := cfg.messageLength(stream.buffer)
+	if err != nil || length == 0 || seg.tcp.FIN {
+		stream.lost = true
+	} else {
+		stream.skip = length - len(stream.buffer)
+	}
+	stream.buffer = nil
+	stream.retransmits = 0
+	return chunk
+}
+
+// MessagePacket returns a copy of the completing segment carrying only message i at its
+// position in the stream, for matching and rewriting the message like a packet
+func (chunk StreamChunk) MessagePacket(i int) ([]byte, error) {
+	seq := chunk.seq + uint32(len(chunk.Lead))
+	for _, message := range chunk.Messages[:i] {
+		seq += uint32(len(message))
+	}
+	return buildStreamSegment(chunk.template, seq, chunk.Messages[i], false)
+}
+
+// MessageFromPacket returns the TCP payload of a rewritten message packet
+func MessageFromPacket(packet []byte) ([]byte, error) {
+	seg, ok := findTCPSegment(packet)
+	if !ok {
+		return nil, fmt.Errorf("message packet has no TCP header")
+	}
+	start := seg.offset + int(seg.tcp.DataOffset)*4
+	return packet[start : start+seg.payloadLen], nil
+}
+
+// EmitStream builds the segments carrying chunk.Lead, the rewritten messages (nil drops a
+// message) and chunk.Raw, each no larger than the largest segment seen on the connection, and records the
+// length change for AdjustTCPSequence
+func EmitStream(chunk StreamChunk, rewritten [][]byte) ([][]byte, error) {
+	original := append([]byte(nil), chunk.Lead...)
+	payload := append([]byte(nil), chunk.Lead...)
+	for _, message := range chunk.Messages {
+		original = append(original, message...)
+	}
+	for _, message := range rewritten {
+		payload = append(payload, message...)
+	}
+	original = append(original, chunk.Raw...)
+	payload = append(payload, chunk.Raw...)
+
+	before, err := buildStreamSegment(chunk.template, chunk.seq, original, true)
+	if err != nil {
+		return nil, err
+	}
+	after, err := buildStreamSegment(chunk.template, chunk.seq, payload, true)
+	if err != nil {
+		return nil, err
+	}
+	if adjusted, ok := AdjustTCPSequence(before, after); ok {
+		after = adjusted
+	}
+
+	maxSegment := chunk.maxSegment
+	if maxSegment < minStreamSegment {
+		maxSegment = minStreamSegment
+	}
+	seg, _ := findTCPSegment(after)
+	seq := seg.tcp.Seq
+	var fin uint32
+	if seg.tcp.FIN {
+		fin = 1
+	}
+	ackedBy := seq + uint32(len(payload)) + fin
+
+	segments := [][]byte{after}
+	if len(payload) > maxSegment {
+		segments = nil
+		for offset := 0; offset < len(payload); offset += maxSegment {
+			part := payload[offset:min(offset+maxSegment, len(payload))]
+			segment, err := buildStreamSegment(after, seq+uint32(offset), part, offset+len(part) == len(payload))
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+		}
+	}
+
+	tcpStreams.Lock()
+	if stream := tcpStreams.flows[chunk.key]; stream != nil {
+		stream.sent = append(stream.sent, sentSegments{
+			start:    chunk.seq,
+			end:      chunk.seq + uint32(len(original)) + fin,
+			ackedBy:  ackedBy,
+			segments: segments,
+		})
+		if len(stream.sent) > maxSentOutputs {
+			stream.sent = stream.sent[1:]
+		}
+		stream.account()
+		limitStreamMemory()
+	}
+	tcpStreams.Unlock()
+	return segments, nil
+}
+
+// buildStreamSegment copies the headers of template with the given sequence number and payload.
+// FIN and PSH stay only on the last segment of an output.
+func buildStreamSegment(template []byte, seq uint32, payload []byte, last bool) ([]byte, error) {
+	seg, ok := findTCPSegment(template)
+	if !ok {
+		return nil, fmt.Errorf("stream segment has no TCP header")
+	}
+	headerEnd := seg.offset + int(seg.tcp.DataOffset)*4
+
+	packet := make([]byte, headerEnd+len(payload))
+	copy(packet, template[:headerEnd])
+	copy(packet[headerEnd:], payload)
+
+	switch seg.network.(type) {
+	case *layers.IPv4:
+		binary.BigEndian.PutUint16(packet[seg.netOffset+2:], uint16(len(packet)-seg.netOffset))
+		setIPv4HeaderChecksum(packet, seg.netOffset)
+	case *layers.IPv6:
+		binary.BigEndian.PutUint16(packet[seg.netOffset+4:], uint16(len(packet)-seg.netOffset-40))
+	}
+
+	binary.BigEndian.PutUint32(packet[seg.offset+4:], seq)
+	if !last {
+		packet[seg.offset+13] &^= 0x01 | 0x08 // FIN, PSH
+	}
+	setTransportChecksum(packet, seg.network, seg.netOffset, seg.offset, seg.offset+16, layers.IPProtocolTCP)
+	return packet, nil
+}
+
+// sweepStreams drops connections idle for streamIdle; called with the lock held
+func sweepStreams(now time.Time) {
+	if now.Sub(tcpStreams.lastSweep) < time.Minute {
+		return
+	}
+	for key, stream := range tcpStreams.flows {
+		if now.Sub(stream.lastSeen) > streamIdle {
+			discardStream(key)
+		}
+	}
+	tcpStreams.lastSweep = now
+}
+
+// account updates the bytes a stream holds after its buffer or outputs changed; called with the
+// lock held
+func (stream *tcpStream) account() {
+	size := len(stream.buffer)
+	for _, sent := range stream.sent {
+		for _, segment := range sent.segments {
+			size += len(segment)
+		}
+	}
+	tcpStreams.memory += size - stream.size
+	stream.size = size
+}
+
+// discardStream forgets a connection direction; called with the lock held
+func discardStream(key seqKey) {
+	if stream := tcpStreams.flows[key]; stream != nil {
+		tcpStreams.memory -= stream.size
+		delete(tcpStreams.flows, key)
+	}
+}
+
+// limitStreamMemory gives up the framing of the connections seen least recently until the held
+// bytes fit the limit. Their retransmissions pass as packets from then on. Called with the lock
+// held.
+func limitStreamMemory() {
+	for tcpStreams.memory > tcpStreams.maxMemory {
+		var oldest *tcpStream
+		for _, stream := range tcpStreams.flows {
+			if stream.size > 0 && (oldest == nil || stream.lastSeen.Before(oldest.lastSeen)) {
+				oldest = stream
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.lost = true
+		oldest.buffer = nil
+		oldest.sent = nil
+		oldest.skip = 0
+		oldest.account()
+	}
+}
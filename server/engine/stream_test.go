@@ -0,0 +1,300 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+)
+
+// streamMessage frames data like IEC 104: start byte 0x68, then the length of what follows
+func streamMessage(data string) []byte {
+	return append([]byte{0x68, byte(len(data))}, data...)
+}
+
+func streamBytes(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+type wantSegment struct {
+	seq, ack uint32
+	payload  []byte
+	fin      bool
+}
+
+type streamStep struct {
+	fromClient bool
+	seq, ack   uint32
+	payload    []byte
+	fin        bool
+
+	status   string
+	lost     bool                // FeedStream reports lost framing
+	messages [][]byte            // Messages of an emitted chunk
+	rewrite  func([]byte) []byte // Applied to each message before EmitStream; nil keeps it
+	segments []wantSegment       // Segments sent for StreamEmit and StreamResend
+}
+
+func resetStreams() {
+	tcpStreams.Lock()
+	tcpStreams.flows = map[seqKey]*tcpStream{}
+	tcpStreams.memory = 0
+	tcpStreams.maxMemory = defaultStreamMaxMemory
+	tcpStreams.Unlock()
+	resetSeqAdjustments()
+}
+
+func heldStreamMemory() int {
+	tcpStreams.Lock()
+	defer tcpStreams.Unlock()
+	return tcpStreams.memory
+}
+
+func checkSegments(t *testing.T, step int, got [][]byte, want []wantSegment) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("step %d: got %d segments, want %d", step, len(got), len(want))
+		return
+	}
+	for i, packet := range got {
+		seg, ok := findTCPSegment(packet)
+		if !ok {
+			t.Fatalf("step %d: segment %d has no TCP header", step, i)
+		}
+		payload := seg.tcp.LayerPayload()
+		if seg.tcp.Seq != want[i].seq || seg.tcp.Ack != want[i].ack || seg.tcp.FIN != want[i].fin || !bytes.Equal(payload, want[i].payload) {
+			t.Errorf("step %d segment %d: got seq %d ack %d fin %v payload % x, want seq %d ack %d fin %v payload % x",
+				step, i, seg.tcp.Seq, seg.tcp.Ack, seg.tcp.FIN, payload, want[i].seq, want[i].ack, want[i].fin, want[i].payload)
+		}
+		if internetChecksum(packet[:20], 0) != 0 {
+			t.Errorf("step %d segment %d: bad IPv4 header checksum", step, i)
+		}
+	}
+}
+
+func runStreamSteps(t *testing.T, cfg *StreamConfig, steps []streamStep) {
+	t.Helper()
+	resetStreams()
+	for i, s := range steps {
+		packet := tcpTestPacket(t, s.fromClient, s.seq, s.ack, s.payload)
+		if s.fin {
+			packet[20+13] |= 0x01
+		}
+
+		chunk, err := FeedStream(packet, cfg)
+		if (err != nil) != s.lost {
+			t.Fatalf("step %d: got error %v, want lost framing %v", i, err, s.lost)
+		}
+		if chunk.Status != s.status {
+			t.Fatalf("step %d: got status %s, want %s", i, chunk.Status, s.status)
+		}
+
+		switch chunk.Status {
+		case StreamEmit:
+			if len(chunk.Messages) != len(s.messages) {
+				t.Fatalf("step %d: got %d messages, want %d", i, len(chunk.Messages), len(s.messages))
+			}
+			rewritten := make([][]byte, len(chunk.Messages))
+			for j, message := range chunk.Messages {
+				if !bytes.Equal(message, s.messages[j]) {
+					t.Errorf("step %d: message %d is % x, want % x", i, j, message, s.messages[j])
+				}
+				rewritten[j] = message
+				if s.rewrite != nil {
+					rewritten[j] = s.rewrite(message)
+				}
+			}
+			segments, err := EmitStream(chunk, rewritten)
+			if err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			checkSegments(t, i, segments, s.segments)
+		case StreamResend:
+			checkSegments(t, i, chunk.Segments, s.segments)
+		}
+	}
+}
+
+func TestFeedStream(t *testing.T) {
+	cfg, err := ParseStreamConfig(`{"ports": [80], "start": "68", "length_offset": 1, "length_size": 1, "length_adjust": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1, m2, m3 := streamMessage("abcd"), streamMessage("efgh"), streamMessage("ij")
+	grow := func(message []byte) []byte { return append(append([]byte(nil), message...), 'X', 'Y') }
+
+	tests := []struct {
+		name  string
+		steps []streamStep
+	}{
+		{
+			name: "in order",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: streamBytes(m1, m2), status: StreamEmit,
+					messages: [][]byte{m1, m2}, segments: []wantSegment{{1000, 1, streamBytes(m1, m2), false}}},
+				// m3 split in two
+				{fromClient: true, seq: 1012, ack: 1, payload: m3[:1], status: StreamHold},
+				{fromClient: true, seq: 1013, ack: 1, payload: m3[1:], status: StreamEmit,
+					messages: [][]byte{m3}, segments: []wantSegment{{1012, 1, m3, false}}},
+				{fromClient: false, seq: 1, ack: 1016, status: StreamPass},
+			},
+		},
+		{
+			name: "rewrite shifts later messages",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamEmit, rewrite: grow,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, grow(m1), false}}},
+				{fromClient: true, seq: 1006, ack: 1, payload: m2, status: StreamEmit,
+					messages: [][]byte{m2}, segments: []wantSegment{{1008, 1, m2, false}}},
+			},
+		},
+		{
+			name: "out of order",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamEmit,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, m1, false}}},
+				// m3 arrives before m2 and is dropped for the sender to retransmit
+				{fromClient: true, seq: 1012, ack: 1, payload: m3, status: StreamHold},
+				{fromClient: true, seq: 1006, ack: 1, payload: m2, status: StreamEmit,
+					messages: [][]byte{m2}, segments: []wantSegment{{1006, 1, m2, false}}},
+				{fromClient: true, seq: 1012, ack: 1, payload: m3, status: StreamEmit,
+					messages: [][]byte{m3}, segments: []wantSegment{{1012, 1, m3, false}}},
+			},
+		},
+		{
+			name: "retransmitted",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamEmit, rewrite: grow,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, grow(m1), false}}},
+				// Unacknowledged output is sent again as it was
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamResend,
+					segments: []wantSegment{{1000, 1, grow(m1), false}}},
+				{fromClient: false, seq: 1, ack: 1008, status: StreamPass},
+				// Acknowledged output isn't
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamHold},
+			},
+		},
+		{
+			name: "FIN with held data",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: streamBytes(m1, m2[:3]), status: StreamEmit,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, m1, false}}},
+				{fromClient: true, seq: 1009, ack: 1, payload: m2[3:4], fin: true, status: StreamEmit,
+					segments: []wantSegment{{1006, 1, m2[:4], true}}},
+				// The connection is closing; the rest passes as packets
+				{fromClient: true, seq: 1010, ack: 1, payload: m2[4:], status: StreamPass},
+			},
+		},
+		{
+			name: "lost framing",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: m1, status: StreamEmit,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, m1, false}}},
+				{fromClient: true, seq: 1006, ack: 1, payload: []byte{0x99, 0x01, 0x02}, status: StreamEmit, lost: true,
+					segments: []wantSegment{{1006, 1, []byte{0x99, 0x01, 0x02}, false}}},
+				{fromClient: true, seq: 1009, ack: 1, payload: m2, status: StreamPass},
+			},
+		},
+		{
+			// The sender holds the rest of m2 until the first part is acknowledged (Nagle)
+			name: "message completed after an acknowledgement",
+			steps: []streamStep{
+				{fromClient: true, seq: 1000, ack: 1, payload: streamBytes(m1, m2[:2]), status: StreamEmit,
+					messages: [][]byte{m1}, segments: []wantSegment{{1000, 1, m1, false}}},
+				{fromClient: false, seq: 1, ack: 1006, status: StreamPass},
+				{fromClient: true, seq: 1006, ack: 1, payload: m2[:2], status: StreamHold},
+				// The held part is released unmodified
+				{fromClient: true, seq: 1006, ack: 1, payload: m2[:2], status: StreamEmit,
+					segments: []wantSegment{{1006, 1, m2[:2], false}}},
+				{fromClient: false, seq: 1, ack: 1008, status: StreamPass},
+				// The rest of m2 follows unmodified, then framing resumes
+				{fromClient: true, seq: 1008, ack: 1, payload: streamBytes(m2[2:], m3), status: StreamEmit, rewrite: grow,
+					messages: [][]byte{m3}, segments: []wantSegment{{1008, 1, streamBytes(m2[2:], grow(m3)), false}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runStreamSteps(t, cfg, tt.steps)
+		})
+	}
+}
+
+func TestEmitStreamResegments(t *testing.T) {
+	cfg, err := ParseStreamConfig(`{"ports": [80], "start": "68", "length_offset": 1, "length_size": 2, "length_adjust": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 503 byte message grows to 803 bytes; output segments are capped at the 536 byte default MSS
+	message := append([]byte{0x68, 0x01, 0xf4}, bytes.Repeat([]byte{'a'}, 500)...)
+	grown := append(append([]byte(nil), message...), bytes.Repeat([]byte{'b'}, 300)...)
+	grow := func([]byte) []byte { return grown }
+
+	runStreamSteps(t, cfg, []streamStep{
+		{fromClient: true, seq: 1000, ack: 1, payload: message, fin: true, status: StreamEmit, rewrite: grow,
+			messages: [][]byte{message}, segments: []wantSegment{
+				{1000, 1, grown[:536], false},
+				{1536, 1, grown[536:], true},
+			}},
+	})
+}
+
+func TestStreamMemory(t *testing.T) {
+	cfg, err := ParseStreamConfig(`{"ports": [80], "start": "68", "length_offset": 1, "length_size": 1, "length_adjust": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := streamMessage("abcdefgh")
+	feed := func(fromClient bool, seq uint32, payload []byte) StreamChunk {
+		t.Helper()
+		chunk, err := FeedStream(tcpTestPacket(t, fromClient, seq, 1, payload), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunk
+	}
+
+	resetStreams()
+	SetStreamMaxMemory(8)
+	feed(true, 1000, m[:4])
+	feed(false, 1, m[:4])
+	// No room left: the connection seen least recently loses its framing
+	if chunk := feed(false, 5, m[4:6]); chunk.Status != StreamHold {
+		t.Fatalf("got status %s, want %s", chunk.Status, StreamHold)
+	}
+	if memory := heldStreamMemory(); memory != 6 {
+		t.Errorf("%d bytes held, want the server's 6", memory)
+	}
+	if chunk := feed(true, 1000, m[:4]); chunk.Status != StreamPass {
+		t.Errorf("retransmission after eviction: got status %s, want %s", chunk.Status, StreamPass)
+	}
+
+	// Outputs kept for retransmissions count until the peer acknowledges them
+	resetStreams()
+	chunk := feed(true, 1000, m)
+	if chunk.Status != StreamEmit {
+		t.Fatalf("got status %s, want %s", chunk.Status, StreamEmit)
+	}
+	segments, err := EmitStream(chunk, chunk.Messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory := heldStreamMemory(); memory != len(segments[0]) {
+		t.Errorf("%d bytes held, want the %d of the output", memory, len(segments[0]))
+	}
+	feed(false, 1, nil)
+	if memory := heldStreamMemory(); memory != len(segments[0]) {
+		t.Errorf("%d bytes held before the ack, want %d", memory, len(segments[0]))
+	}
+	if _, err := FeedStream(tcpTestPacket(t, false, 1, 1000+uint32(len(m)), nil), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if memory := heldStreamMemory(); memory != 0 {
+		t.Errorf("%d bytes held after the ack, want 0", memory)
+	}
+}
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// When a rewrite changes the payload length of a TCP segment, the sequence numbers of the
+// connection no longer match what the peer sees. Like the kernel's NAT helpers, the change is
+// recorded per direction and later packets are shifted: seq in the direction that changed,
+// ack and SACK edges in the reverse direction. Connections are keyed on the addresses and
+// ports as received. The state of a connection goes away once both FINs are acknowledged,
+// on a RST, on a new SYN for the same addresses and ports, or after seqAdjustIdle.
+
+// seqAdjustIdle is how long the state of a connection is kept without packets
+const seqAdjustIdle = 10 * time.Minute
+
+type seqKey struct {
+	src, dst         string
+	srcPort, dstPort uint16
+}
+
+// seqAdjustment follows nf_nat_seq_adjust: segments starting after correctionPos are shifted by
+// offsetAfter, earlier ones (retransmissions) by offsetBefore
+type seqAdjustment struct {
+	correctionPos uint32
+	offsetBefore  int32
+	offsetAfter   int32
+	lastSeen      time.Time
+
+	// Connection teardown: the sequence number after this direction's FIN, as sent
+	fin      bool
+	finEnd   uint32
+	finAcked bool
+}
+
+var seqAdjustments = struct {
+	sync.Mutex
+	flows     map[seqKey]*seqAdjustment
+	lastSweep time.Time
+	active    atomic.Int32 // len(flows), readable without the lock
+}{flows: map[seqKey]*seqAdjustment{}}
+
+// tcpSegment locates the TCP header of a packet
+type tcpSegment struct {
+	key        seqKey
+	offset     int // TCP header offset
+	payloadLen int
+	tcp        *layers.TCP
+	network    gopacket.Layer
+	netOffset  int
+}
+
+func findTCPSegment(packet []byte) (tcpSegment, bool) {
+	var seg tcpSegment
+	if len(packet) == 0 {
+		return seg, false
+	}
+
+	decoded := gopacket.NewPacket(packet, firstLayerType(packet), gopacket.NoCopy)
+	for _, layer := range decoded.Layers() {
+		offset := cap(packet) - cap(layer.LayerContents())
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			seg.network, seg.netOffset = l, offset
+			seg.key.src, seg.key.dst = l.SrcIP.String(), l.DstIP.String()
+		case *layers.IPv6:
+			seg.network, seg.netOffset = l, offset
+			seg.key.src, seg.key.dst = l.SrcIP.String(), l.DstIP.String()
+		case *layers.TCP:
+			if seg.network == nil {
+				return seg, false
+			}
+			seg.tcp, seg.offset = l, offset
+			seg.payloadLen = len(l.LayerPayload())
+			seg.key.srcPort, seg.key.dstPort = uint16(l.SrcPort), uint16(l.DstPort)
+			return seg, true
+		}
+	}
+	return seg, false
+}
+
+// seqAfter reports whether a comes after b in sequence space
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// AdjustTCPSequence records a change of TCP payload length from original to packet and shifts
+// seq, ack and SACK blocks of packet by the changes recorded on its connection. Pass the same
+// bytes twice for unmodified packets. Returns the adjusted copy and true if anything changed.
+func AdjustTCPSequence(original, packet []byte) ([]byte, bool) {
+	// Unmodified packets while no connection has changes: nothing to decode
+	unmodified := len(original) == len(packet) && (len(packet) == 0 || &original[0] == &packet[0])
+	if unmodified && seqAdjustments.active.Load() == 0 {
+		return packet, false
+	}
+
+	seg, ok := findTCPSegment(packet)
+	if !ok {
+		return packet, false
+	}
+
+	sizeDiff := 0
+	if !unmodified {
+		if orig, ok := findTCPSegment(original); ok {
+			sizeDiff = seg.payloadLen - orig.payloadLen
+		}
+	}
+	if sizeDiff == 0 && seqAdjustments.active.Load() == 0 {
+		return packet, false
+	}
+
+	reverse := seqKey{src: seg.key.dst, dst: seg.key.src, srcPort: seg.key.dstPort, dstPort: seg.key.srcPort}
+	seq, ack := seg.tcp.Seq, seg.tcp.Ack
+	now := time.Now()
+
+	seqAdjustments.Lock()
+	sweepSeqAdjustments(now)
+
+	// A connection attempt reusing the addresses and ports starts over
+	if seg.tcp.SYN && !seg.tcp.ACK {
+		delete(seqAdjustments.flows, seg.key)
+		delete(seqAdjustments.flows, reverse)
+	}
+
+	this := seqAdjustments.flows[seg.key]
+	if sizeDiff != 0 {
+		if this == nil {
+			this = &seqAdjustment{}
+			seqAdjustments.flows[seg.key] = this
+		}
+		// Only the first change at a new position moves the correction point; a retransmitted
+		// rewrite keeps the offsets it already caused
+		if this.offsetBefore == this.offsetAfter || seqAfter(seq, this.correctionPos) {
+			this.correctionPos = seq
+			this.offsetBefore = this.offsetAfter
+			this.offsetAfter += int32(sizeDiff)
+		}
+	}
+
+	newSeq := seq
+	if this != nil {
+		this.lastSeen = now
+		newSeq = seq + uint32(this.offsetFor(seq))
+	}
+
+	other := seqAdjustments.flows[reverse]
+	var unshift func(uint32) uint32
+	if other != nil {
+		other.lastSeen = now
+		copyOther := *other
+		unshift = func(n uint32) uint32 {
+			if seqAfter(n-uint32(copyOther.offsetBefore), copyOther.correctionPos) {
+				return n - uint32(copyOther.offsetAfter)
+			}
+			return n - uint32(copyOther.offsetBefore)
+		}
+	}
+
+	if this != nil || other != nil {
+		trackTeardown(seg, reverse, newSeq, this, other, now)
+	}
+	if seg.tcp.RST {
+		delete(seqAdjustments.flows, seg.key)
+		delete(seqAdjustments.flows, reverse)
+	}
+	seqAdjustments.active.Store(int32(len(seqAdjustments.flows)))
+	seqAdjustments.Unlock()
+
+	if newSeq == seq && unshift == nil {
+		return packet, false
+	}
+
+	result := append([]byte(nil), packet...)
+	changed := newSeq != seq
+	binary.BigEndian.PutUint32(result[seg.offset+4:], newSeq)
+
+	if unshift != nil {
+		if seg.tcp.ACK {
+			if newAck := unshift(ack); newAck != ack {
+				binary.BigEndian.PutUint32(result[seg.offset+8:], newAck)
+				changed = true
+			}
+		}
+		if adjustSACK(result, seg.offset, unshift) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return packet, false
+	}
+	setTransportChecksum(result, seg.network, seg.netOffset, seg.offset, seg.offset+16, layers.IPProtocolTCP)
+	return result, true
+}
+
+// trackTeardown records FINs and their acks and forgets the connection once both FINs are
+// acknowledged; called with the lock held for connections that have state
+func trackTeardown(seg tcpSegment, reverse seqKey, newSeq uint32, this, other *seqAdjustment, now time.Time) {
+	if seg.tcp.FIN {
+		if this == nil {
+			this = &seqAdjustment{lastSeen: now}
+			seqAdjustments.flows[seg.key] = this
+		}
+		// Acks the peer sends are in the shifted sequence space it sees
+		this.fin = true
+		this.finEnd = newSeq + uint32(seg.payloadLen) + 1
+	}
+	if other != nil && other.fin && seg.tcp.ACK && !seqAfter(other.finEnd, seg.tcp.Ack) {
+		other.finAcked = true
+	}
+	if this != nil && other != nil && this.finAcked && other.finAcked {
+		delete(seqAdjustments.flows, seg.key)
+		delete(seqAdjustments.flows, reverse)
+	}
+}
+
+func (a *seqAdjustment) offsetFor(seq uint32) int32 {
+	if seqAfter(seq, a.correctionPos) {
+		return a.offsetAfter
+	}
+	return a.offsetBefore
+}
+
+// adjustSACK rewrites the edges of SACK option blocks in place
+func adjustSACK(packet []byte, tcpOffset int, unshift func(uint32) uint32) bool {
+	end := tcpOffset + int(packet[tcpOffset+12]>>4)*4
+	if end > len(packet) {
+		return false
+	}
+
+	changed := false
+	for i := tcpOffset + 20; i < end; {
+		kind := packet[i]
+		if kind == byte(layers.TCPOptionKindEndList) {
+			break
+		}
+		if kind == byte(layers.TCPOptionKindNop) {
+			i++
+			continue
+		}
+		if i+1 >= end || packet[i+1] < 2 || i+int(packet[i+1]) > end {
+			break
+		}
+		length := int(packet[i+1])
+		if kind == byte(layers.TCPOptionKindSACK) {
+			for edge := i + 2; edge+4 <= i+length; edge += 4 {
+				old := binary.BigEndian.Uint32(packet[edge:])
+				if updated := unshift(old); updated != old {
+					binary.BigEndian.PutUint32(packet[edge:], updated)
+					changed = true
+				}
+			}
+		}
+		i += length
+	}
+	return changed
+}
+
+// sweepSeqAdjustments drops connections idle for seqAdjustIdle; called with the lock held
+func sweepSeqAdjustments(now time.Time) {
+	if now.Sub(seqAdjustments.lastSweep) < time.Minute {
+		return
+	}
+	for key, a := range seqAdjustments.flows {
+		if now.Sub(a.lastSeen) > seqAdjustIdle {
+			delete(seqAdjustments.flows, key)
+		}
+	}
+	seqAdjustments.lastSweep = now
+	seqAdjustments.active.Store(int32(len(seqAdjustments.flows)))
+}
@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpTestPacket builds an IPv4/TCP packet; client is 10.0.0.1:40000, server 10.0.0.2:80
+func tcpTestPacket(t *testing.T, fromClient bool, seq, ack uint32, payload []byte, sack ...uint32) []byte {
+	t.Helper()
+	src, dst := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	srcPort, dstPort := layers.TCPPort(40000), layers.TCPPort(80)
+	if !fromClient {
+		src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+	}
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: seq, Ack: ack, ACK: true, Window: 1024}
+	if len(sack) > 0 {
+		data := make([]byte, 4*len(sack))
+		for i, edge := range sack {
+			binary.BigEndian.PutUint32(data[4*i:], edge)
+		}
+		tcp.Options = []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindSACK, OptionLength: uint8(2 + len(data)), OptionData: data},
+		}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tcpTestFields returns seq, ack and the SACK edges of a packet built by tcpTestPacket
+func tcpTestFields(t *testing.T, packet []byte) (uint32, uint32, []uint32) {
+	t.Helper()
+	seg, ok := findTCPSegment(packet)
+	if !ok {
+		t.Fatal("no TCP segment")
+	}
+	var sack []uint32
+	for _, option := range seg.tcp.Options {
+		if option.OptionType == layers.TCPOptionKindSACK {
+			for i := 0; i+4 <= len(option.OptionData); i += 4 {
+				sack = append(sack, binary.BigEndian.Uint32(option.OptionData[i:]))
+			}
+		}
+	}
+	return seg.tcp.Seq, seg.tcp.Ack, sack
+}
+
+func resetSeqAdjustments() {
+	seqAdjustments.Lock()
+	seqAdjustments.flows = map[seqKey]*seqAdjustment{}
+	seqAdjustments.active.Store(0)
+	seqAdjustments.Unlock()
+}
+
+func TestAdjustTCPSequence(t *testing.T) {
+	type step struct {
+		fromClient bool
+		seq, ack   uint32
+		payload    int // Payload length as received
+		rewritten  int // Payload length after the rewrite
+		sack       []uint32
+		wantSeq    uint32
+		wantAck    uint32
+		wantSACK   []uint32
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "growth then a later growth",
+			steps: []step{
+				{fromClient: true, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantSeq: 1000, wantAck: 1},
+				{fromClient: true, seq: 1010, ack: 1, payload: 10, rewritten: 10, wantSeq: 1014, wantAck: 1},
+				{fromClient: true, seq: 1020, ack: 1, payload: 10, rewritten: 12, wantSeq: 1024, wantAck: 1},
+				{fromClient: true, seq: 1030, ack: 1, payload: 10, rewritten: 10, wantSeq: 1036, wantAck: 1},
+			},
+		},
+		{
+			name: "retransmission before the correction point",
+			steps: []step{
+				{fromClient: true, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantSeq: 1000, wantAck: 1},
+				{fromClient: true, seq: 1010, ack: 1, payload: 10, rewritten: 10, wantSeq: 1014, wantAck: 1},
+				// The rewrite is applied again to the retransmission; the offsets must not grow twice
+				{fromClient: true, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantSeq: 1000, wantAck: 1},
+				{fromClient: true, seq: 1010, ack: 1, payload: 10, rewritten: 10, wantSeq: 1014, wantAck: 1},
+				{fromClient: true, seq: 1020, ack: 1, payload: 10, rewritten: 10, wantSeq: 1024, wantAck: 1},
+			},
+		},
+		{
+			name: "reverse ack and SACK unshift",
+			steps: []step{
+				{fromClient: true, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantSeq: 1000, wantAck: 1},
+				{fromClient: true, seq: 1010, ack: 1, payload: 10, rewritten: 10, wantSeq: 1014, wantAck: 1},
+				// Acks of the rewritten segment and beyond drop the growth
+				{fromClient: false, seq: 1, ack: 1014, wantSeq: 1, wantAck: 1010},
+				{fromClient: false, seq: 1, ack: 1000, sack: []uint32{1014, 1024}, wantSeq: 1, wantAck: 1000, wantSACK: []uint32{1010, 1020}},
+			},
+		},
+		{
+			name: "seq wraparound",
+			steps: []step{
+				{fromClient: true, seq: 0xfffffffa, ack: 1, payload: 10, rewritten: 14, wantSeq: 0xfffffffa, wantAck: 1},
+				{fromClient: true, seq: 4, ack: 1, payload: 10, rewritten: 10, wantSeq: 8, wantAck: 1},
+				{fromClient: true, seq: 0xfffffffa, ack: 1, payload: 10, rewritten: 14, wantSeq: 0xfffffffa, wantAck: 1},
+				{fromClient: false, seq: 1, ack: 0xfffffffa, sack: []uint32{8, 18}, wantSeq: 1, wantAck: 0xfffffffa, wantSACK: []uint32{4, 14}},
+				{fromClient: false, seq: 1, ack: 18, wantSeq: 1, wantAck: 14},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSeqAdjustments()
+			for i, s := range tt.steps {
+				original := tcpTestPacket(t, s.fromClient, s.seq, s.ack, make([]byte, s.payload), s.sack...)
+				packet := tcpTestPacket(t, s.fromClient, s.seq, s.ack, make([]byte, s.rewritten), s.sack...)
+
+				adjusted, _ := AdjustTCPSequence(original, packet)
+				seq, ack, sack := tcpTestFields(t, adjusted)
+				if seq != s.wantSeq || ack != s.wantAck {
+					t.Errorf("step %d: got seq %d ack %d, want seq %d ack %d", i, seq, ack, s.wantSeq, s.wantAck)
+				}
+				for j := range s.wantSACK {
+					if j >= len(sack) || sack[j] != s.wantSACK[j] {
+						t.Errorf("step %d: got SACK %v, want %v", i, sack, s.wantSACK)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// withTCPFlags replaces the flags of a packet built by tcpTestPacket
+func withTCPFlags(packet []byte, flags byte) []byte {
+	packet[20+13] = flags
+	return packet
+}
+
+func TestAdjustTCPSequenceTeardown(t *testing.T) {
+	const (
+		fin = 0x01
+		syn = 0x02
+		rst = 0x04
+		ack = 0x10
+	)
+	type step struct {
+		fromClient bool
+		flags      byte
+		seq, ack   uint32
+		payload    int
+		rewritten  int
+		wantFlows  int
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "both FINs acknowledged",
+			steps: []step{
+				{fromClient: true, flags: ack, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantFlows: 1},
+				{fromClient: true, flags: fin | ack, seq: 1010, ack: 1, wantFlows: 1},
+				// Acks the client's FIN at its shifted position 1014
+				{fromClient: false, flags: ack, seq: 1, ack: 1015, wantFlows: 1},
+				{fromClient: false, flags: fin | ack, seq: 1, ack: 1015, wantFlows: 2},
+				{fromClient: true, flags: ack, seq: 1011, ack: 2, wantFlows: 0},
+			},
+		},
+		{
+			name: "FIN not yet acknowledged",
+			steps: []step{
+				{fromClient: true, flags: ack, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantFlows: 1},
+				{fromClient: true, flags: fin | ack, seq: 1010, ack: 1, wantFlows: 1},
+				{fromClient: false, flags: fin | ack, seq: 1, ack: 1014, wantFlows: 2},
+				{fromClient: true, flags: ack, seq: 1011, ack: 2, wantFlows: 2},
+			},
+		},
+		{
+			name: "new SYN on the same ports",
+			steps: []step{
+				{fromClient: true, flags: ack, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantFlows: 1},
+				{fromClient: false, flags: ack, seq: 1, ack: 1014, wantFlows: 1},
+				{fromClient: true, flags: syn, seq: 5000, wantFlows: 0},
+			},
+		},
+		{
+			name: "reset",
+			steps: []step{
+				{fromClient: true, flags: ack, seq: 1000, ack: 1, payload: 10, rewritten: 14, wantFlows: 1},
+				{fromClient: false, flags: rst, seq: 1, wantFlows: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetSeqAdjustments()
+			for i, s := range tt.steps {
+				original := withTCPFlags(tcpTestPacket(t, s.fromClient, s.seq, s.ack, make([]byte, s.payload)), s.flags)
+				packet := withTCPFlags(tcpTestPacket(t, s.fromClient, s.seq, s.ack, make([]byte, s.rewritten)), s.flags)
+				AdjustTCPSequence(original, packet)
+
+				seqAdjustments.Lock()
+				flows := len(seqAdjustments.flows)
+				seqAdjustments.Unlock()
+				if flows != s.wantFlows {
+					t.Errorf("step %d: %d connections tracked, want %d", i, flows, s.wantFlows)
+				}
+				if active := int(seqAdjustments.active.Load()); active != flows {
+					t.Errorf("step %d: active = %d, want %d", i, active, flows)
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustTCPSequenceUnmodified(t *testing.T) {
+	resetSeqAdjustments()
+	packet := tcpTestPacket(t, true, 1000, 1, make([]byte, 10))
+	if adjusted, changed := AdjustTCPSequence(packet, packet); changed || &adjusted[0] != &packet[0] {
+		t.Error("unmodified packet was copied")
+	}
+	if len(seqAdjustments.flows) != 0 {
+		t.Error("unmodified packet created state")
+	}
+}
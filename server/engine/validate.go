@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ValidateActions checks the actions of a rule before it is saved: the JSON must parse and
+// mirror targets, including those in branches, must be valid
+func ValidateActions(actionsJSON string) error {
+	if strings.TrimSpace(actionsJSON) == "" {
+		return nil
+	}
+	var actions []Action
+	if err := json.Unmarshal([]byte(actionsJSON), &actions); err != nil {
+		return fmt.Errorf("failed to parse actions: %w", err)
+	}
+	return validateActionList(actions)
+}
+
+func validateActionList(actions []Action) error {
+	for _, action := range actions {
+		switch action.Op {
+		case "if":
+			branches := append([]ActionBranch{{Then: action.Then}, {Then: action.Else}}, action.Elif...)
+			for _, branch := range branches {
+				if err := validateActionList(branch.Then); err != nil {
+					return err
+				}
+			}
+		case "mirror":
+			if _, _, err := ParseMirrorTarget(action.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
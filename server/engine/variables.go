@@ -0,0 +1,302 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Variable scopes
+const (
+	ScopeGlobal = "global"
+	ScopeRule   = "rule" // One instance per rule
+	ScopeFlow   = "flow" // One instance per connection, in both directions
+)
+
+// Variable is a named value kept across packets
+type Variable struct {
+	Scope     string      `json:"scope"`
+	Owner     string      `json:"owner"` // Rule ID or flow key, empty for global variables
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	Persist   bool        `json:"persist"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+type variableKey struct {
+	scope, owner, name string
+}
+
+var (
+	variablesMu    sync.Mutex
+	variables      = map[variableKey]*Variable{}
+	dirtyVariables = map[variableKey]bool{} // Persistent variables changed since the last flush
+)
+
+// GetVariable returns the value of a variable as seen by this packet
+func (ctx *PacketContext) GetVariable(scope, name string) (interface{}, error) {
+	key, err := ctx.variableKey(scope, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := ctx.variableOverlay[key]; ok {
+		return value, nil
+	}
+
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+	if v, ok := variables[key]; ok {
+		return v.Value, nil
+	}
+	return nil, nil
+}
+
+// SetVariable assigns a variable. In dry-run mode the change is only visible to this packet.
+func (ctx *PacketContext) SetVariable(scope, name string, value interface{}, persist bool) error {
+	_, err := ctx.updateVariable(scope, name, persist, func(interface{}) (interface{}, error) {
+		return value, nil
+	})
+	return err
+}
+
+// AddVariable increments a numeric variable (unset counts as 0) and returns the new value
+func (ctx *PacketContext) AddVariable(scope, name string, delta int64, persist bool) (int64, error) {
+	value, err := ctx.updateVariable(scope, name, persist, func(current interface{}) (interface{}, error) {
+		if current == nil {
+			return delta, nil
+		}
+		n, ok := toInt64(current)
+		if !ok {
+			return nil, fmt.Errorf("variable %s is not a number", name)
+		}
+		return n + delta, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value.(int64), nil
+}
+
+// updateVariable applies fn to the packet's view of the variable. The change is staged on the
+// context and only reaches the shared store when the actions commit, never in dry-run mode.
+func (ctx *PacketContext) updateVariable(scope, name string, persist bool, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	key, err := ctx.variableKey(scope, name)
+	if err != nil {
+		return nil, err
+	}
+
+	current, _ := ctx.GetVariable(scope, name)
+	value, err := fn(current)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.variableOverlay == nil {
+		ctx.variableOverlay = make(map[variableKey]interface{})
+	}
+	ctx.variableOverlay[key] = value
+
+	if !ctx.DryRun {
+		ctx.pendingVariables = append(ctx.pendingVariables, pendingVariable{key: key, persist: persist, fn: fn})
+	}
+	return value, nil
+}
+
+// pendingVariable is a staged variable update
+type pendingVariable struct {
+	key     variableKey
+	persist bool
+	fn      func(interface{}) (interface{}, error)
+}
+
+// commitVariables replays the staged updates on the shared store. Updates are replayed rather
+// than copied so counters incremented by concurrent packets don't lose counts.
+func (ctx *PacketContext) commitVariables() {
+	if len(ctx.pendingVariables) == 0 {
+		return
+	}
+
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+
+	now := time.Now()
+	for _, update := range ctx.pendingVariables {
+		v, ok := variables[update.key]
+		if !ok {
+			v = &Variable{Scope: update.key.scope, Owner: update.key.owner, Name: update.key.name}
+		}
+
+		// A concurrent packet may have changed the type, e.g. set a counter to a string
+		value, err := update.fn(v.Value)
+		if err != nil {
+			continue
+		}
+		variables[update.key] = v
+		v.Value = value
+		v.Persist = v.Persist || update.persist
+		v.UpdatedAt = now
+		if v.Persist {
+			dirtyVariables[update.key] = true
+		}
+	}
+
+	ctx.pendingVariables = nil
+	ctx.variableOverlay = nil
+}
+
+func (ctx *PacketContext) variableKey(scope, name string) (variableKey, error) {
+	if name == "" {
+		return variableKey{}, fmt.Errorf("variable name is required")
+	}
+
+	switch scope {
+	case "", ScopeGlobal:
+		return variableKey{scope: ScopeGlobal, name: name}, nil
+	case ScopeRule:
+		if ctx.RuleID == 0 {
+			return variableKey{}, fmt.Errorf("rule variable %s used outside a rule", name)
+		}
+		return variableKey{scope: ScopeRule, owner: strconv.FormatUint(uint64(ctx.RuleID), 10), name: name}, nil
+	case ScopeFlow:
+		flow := ctx.FlowKey()
+		if flow == "" {
+			return variableKey{}, fmt.Errorf("flow variable %s used on a non-IP packet", name)
+		}
+		return variableKey{scope: ScopeFlow, owner: flow, name: name}, nil
+	default:
+		return variableKey{}, fmt.Errorf("unknown variable scope: %s", scope)
+	}
+}
+
+// FlowKey identifies the connection of the packet, the same for both directions
+func (ctx *PacketContext) FlowKey() string {
+	tuple := ctx.FiveTuple()
+	if tuple.SrcIP == "" {
+		return ""
+	}
+
+	a := fmt.Sprintf("%s:%d", tuple.SrcIP, tuple.SrcPort)
+	b := fmt.Sprintf("%s:%d", tuple.DstIP, tuple.DstPort)
+	if b < a {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%s-%s/%s", a, b, tuple.Protocol)
+}
+
+// ListVariables returns a snapshot of all variables, optionally limited to one scope
+func ListVariables(scope string) []Variable {
+	variablesMu.Lock()
+	list := make([]Variable, 0, len(variables))
+	for _, v := range variables {
+		if scope == "" || v.Scope == scope {
+			list = append(list, *v)
+		}
+	}
+	variablesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scope != list[j].Scope {
+			return list[i].Scope < list[j].Scope
+		}
+		if list[i].Owner != list[j].Owner {
+			return list[i].Owner < list[j].Owner
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// LoadVariables restores persisted variables, e.g. at startup
+func LoadVariables(list []Variable) {
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+
+	for i := range list {
+		v := list[i]
+		v.Persist = true
+		variables[variableKey{v.Scope, v.Owner, v.Name}] = &v
+	}
+}
+
+// TakeDirtyVariables returns the persistent variables changed since the last call
+func TakeDirtyVariables() []Variable {
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+
+	var list []Variable
+	for key := range dirtyVariables {
+		if v, ok := variables[key]; ok {
+			list = append(list, *v)
+		}
+	}
+	dirtyVariables = map[variableKey]bool{}
+	return list
+}
+
+// DeleteVariables removes variables matching the scope and name (empty matches all)
+// and returns how many were removed
+func DeleteVariables(scope, name string) int {
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+
+	removed := 0
+	for key := range variables {
+		if (scope == "" || key.scope == scope) && (name == "" || key.name == name) {
+			delete(variables, key)
+			delete(dirtyVariables, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// ExpireFlowVariables removes flow variables not updated within idle and returns them
+func ExpireFlowVariables(idle time.Duration) []Variable {
+	cutoff := time.Now().Add(-idle)
+
+	variablesMu.Lock()
+	defer variablesMu.Unlock()
+
+	var expired []Variable
+	for key, v := range variables {
+		if key.scope == ScopeFlow && v.UpdatedAt.Before(cutoff) {
+			expired = append(expired, *v)
+			delete(variables, key)
+			delete(dirtyVariables, key)
+		}
+	}
+	return expired
+}
+
+// executeVariable handles the var_set and var_add actions.
+// action.Field names the variable; var_set evaluates action.Value as an expression,
+// var_add adds it (default 1).
+func executeVariable(action Action, ctx *PacketContext) error {
+	switch action.Op {
+	case "var_set":
+		value, err := EvaluateExpression(action.Value, ctx)
+		if err != nil {
+			return err
+		}
+		return ctx.SetVariable(action.Scope, action.Field, value, action.Persist)
+
+	case "var_add":
+		delta := int64(1)
+		if action.Value != "" {
+			value, err := EvaluateExpression(action.Value, ctx)
+			if err != nil {
+				return err
+			}
+			n, ok := toInt64(value)
+			if !ok {
+				return fmt.Errorf("var_add needs a number, got %v", value)
+			}
+			delta = n
+		}
+		_, err := ctx.AddVariable(action.Scope, action.Field, delta, action.Persist)
+		return err
+	}
+	return fmt.Errorf("unknown variable operation: %s", action.Op)
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Verdicts set by actions; an empty verdict forwards the packet
+const (
+	VerdictAccept       = ""
+	VerdictPass         = "pass" // Forward the original packet unmodified
+	VerdictDrop         = "drop"
+	VerdictRejectTCPRST = "reject-tcp-rst"
+	VerdictRejectICMP   = "reject-icmp-unreachable"
+
+	// Not an action: set when a DF packet grew past the egress MTU and was refused
+	VerdictFragNeeded = "frag-needed"
+)
+
+// rejectICMPPayloadSize is how many bytes of the original transport header ICMP errors quote
+const rejectICMPPayloadSize = 8
+
+// rejectICMPv6MaxSize keeps ICMPv6 errors within the IPv6 minimum MTU (RFC 4443 2.4)
+const rejectICMPv6MaxSize = 1280
+
+// IsReject reports whether the verdict answers the sender with a reply packet
+func IsReject(verdict string) bool {
+	return verdict == VerdictRejectTCPRST || verdict == VerdictRejectICMP
+}
+
+// BuildRejectPacket builds the IPv4 or IPv6 reply (starting at the IP header) sent back to
+// the originator of a rejected packet
+func BuildRejectPacket(ctx *PacketContext) ([]byte, error) {
+	if ctx.IPv4Layer == nil && ctx.IPv6Layer == nil {
+		return nil, fmt.Errorf("reject requires an IP packet")
+	}
+
+	switch ctx.Verdict {
+	case VerdictRejectTCPRST:
+		return buildTCPReset(ctx)
+	case VerdictRejectICMP:
+		return buildICMPUnreachable(ctx)
+	default:
+		return nil, fmt.Errorf("verdict %q has no reply packet", ctx.Verdict)
+	}
+}
+
+func buildTCPReset(ctx *PacketContext) ([]byte, error) {
+	if ctx.TCPLayer == nil {
+		return nil, fmt.Errorf("reject-tcp-rst requires a TCP packet")
+	}
+	orig := ctx.TCPLayer
+	if orig.RST {
+		return nil, fmt.Errorf("not answering a reset with a reset")
+	}
+
+	ip := replyIPLayer(ctx, layers.IPProtocolTCP)
+	tcp := &layers.TCP{
+		SrcPort: orig.DstPort,
+		DstPort: orig.SrcPort,
+		RST:     true,
+		Window:  0,
+	}
+
+	// RFC 793: use the peer's ACK as our sequence if present, otherwise acknowledge what it sent
+	if orig.ACK {
+		tcp.Seq = orig.Ack
+	} else {
+		tcp.ACK = true
+		tcp.Ack = orig.Seq + uint32(len(orig.Payload))
+		if orig.SYN {
+			tcp.Ack++
+		}
+		if orig.FIN {
+			tcp.Ack++
+		}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, ip.(gopacket.SerializableLayer), tcp); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// replyIPLayer returns the IP header of a reply to the packet, addressed back to its sender
+func replyIPLayer(ctx *PacketContext, protocol layers.IPProtocol) gopacket.NetworkLayer {
+	if ctx.IPv4Layer != nil {
+		return &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: protocol,
+			SrcIP:    ctx.IPv4Layer.DstIP,
+			DstIP:    ctx.IPv4Layer.SrcIP,
+		}
+	}
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: protocol,
+		SrcIP:      ctx.IPv6Layer.DstIP,
+		DstIP:      ctx.IPv6Layer.SrcIP,
+	}
+}
+
+func buildICMPUnreachable(ctx *PacketContext) ([]byte, error) {
+	if ctx.IPv4Layer != nil {
+		return buildICMPv4Error(ctx.IPv4Layer, layers.ICMPv4CodePort, 0)
+	}
+	return buildICMPv6Unreachable(ctx)
+}
+
+// buildICMPv6Unreachable builds a port unreachable message quoting as much of the
+// packet as fits in the IPv6 minimum MTU
+func buildICMPv6Unreachable(ctx *PacketContext) ([]byte, error) {
+	offset := ctx.LayerOffset(ctx.IPv6Layer)
+	if offset < 0 {
+		return nil, fmt.Errorf("IPv6 header not found")
+	}
+	quoted := ctx.RawPacket[offset:]
+	if limit := rejectICMPv6MaxSize - 40 - 8; len(quoted) > limit {
+		quoted = quoted[:limit]
+	}
+
+	ip := replyIPLayer(ctx, layers.IPProtocolICMPv6)
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable),
+	}
+	icmp.SetNetworkLayerForChecksum(ip)
+
+	// The 4 unused bytes after the checksum precede the quoted packet
+	body := append(make([]byte, 4), quoted...)
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, ip.(gopacket.SerializableLayer), icmp, gopacket.Payload(body)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// buildFragmentationNeeded tells the sender of a DF packet the largest packet it may send
+func buildFragmentationNeeded(ctx *PacketContext, nextHopMTU int) ([]byte, error) {
+	return buildICMPv4Error(ctx.IPv4Layer, layers.ICMPv4CodeFragmentationNeeded, uint16(nextHopMTU))
+}
+
+// buildICMPv4Error builds a destination unreachable message answering origIP. nextHopMTU
+// fills the low half of the rest-of-header word, as RFC 1191 uses it for code 4.
+func buildICMPv4Error(origIP *layers.IPv4, code uint8, nextHopMTU uint16) ([]byte, error) {
+	// Quote the original IP header and the start of its payload
+	quoted := append([]byte{}, origIP.Contents...)
+	payload := origIP.Payload
+	if len(payload) > rejectICMPPayloadSize {
+		payload = payload[:rejectICMPPayloadSize]
+	}
+	quoted = append(quoted, payload...)
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    origIP.DstIP,
+		DstIP:    origIP.SrcIP,
+	}
+	icmp := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, code),
+		Seq:      nextHopMTU,
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, opts, ip, icmp, gopacket.Payload(quoted)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcp6TestPacket builds an IPv6/TCP packet from 2001:db8::1:40000 to 2001:db8::2:80
+func tcp6TestPacket(t *testing.T, tcp *layers.TCP, payload []byte) []byte {
+	t.Helper()
+	ip := &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	tcp.SrcPort, tcp.DstPort = 40000, 80
+	tcp.SetNetworkLayerForChecksum(ip)
+	return serializeTest(t, ip, tcp, gopacket.Payload(payload))
+}
+
+func TestBuildRejectPacket(t *testing.T) {
+	v4 := tcpTestPacket(t, true, 1000, 2000, []byte("hello"))
+	v6 := tcp6TestPacket(t, &layers.TCP{Seq: 1000, SYN: true}, nil)
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		verdict  string
+		wantSeq  uint32
+		wantAck  uint32
+		wantICMP bool
+	}{
+		{"IPv4 reset answers the peer's ack", v4, VerdictRejectTCPRST, 2000, 0, false},
+		{"IPv6 reset acknowledges the SYN", v6, VerdictRejectTCPRST, 0, 1001, false},
+		{"IPv4 port unreachable", v4, VerdictRejectICMP, 0, 0, true},
+		{"IPv6 port unreachable", v6, VerdictRejectICMP, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := ParsePacket(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx.Verdict = tt.verdict
+			reply, err := BuildRejectPacket(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := ParsePacket(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Packet.ErrorLayer() != nil {
+				t.Fatalf("reply does not decode: %v", parsed.Packet.ErrorLayer().Error())
+			}
+			in, out := ctx.FiveTuple(), parsed.FiveTuple()
+			if out.SrcIP != in.DstIP || out.DstIP != in.SrcIP {
+				t.Errorf("reply goes %s -> %s, want %s -> %s", out.SrcIP, out.DstIP, in.DstIP, in.SrcIP)
+			}
+
+			if !tt.wantICMP {
+				tcp := parsed.TCPLayer
+				if tcp == nil || !tcp.RST {
+					t.Fatal("reply is not a TCP reset")
+				}
+				if tcp.Seq != tt.wantSeq || tcp.Ack != tt.wantAck {
+					t.Errorf("seq/ack = %d/%d, want %d/%d", tcp.Seq, tcp.Ack, tt.wantSeq, tt.wantAck)
+				}
+				checkTCPChecksum(t, parsed)
+				return
+			}
+
+			if icmp := parsed.Packet.Layer(layers.LayerTypeICMPv4); icmp != nil {
+				typeCode := icmp.(*layers.ICMPv4).TypeCode
+				if typeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort) {
+					t.Errorf("type/code = %v", typeCode)
+				}
+				return
+			}
+			icmp, ok := parsed.Packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			if !ok {
+				t.Fatal("reply is not ICMP")
+			}
+			if icmp.TypeCode != layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable) {
+				t.Errorf("type/code = %v", icmp.TypeCode)
+			}
+			// 4 unused bytes, then the offending packet
+			if !bytes.Equal(icmp.Payload[4:], tt.packet) {
+				t.Errorf("quoted %x, want %x", icmp.Payload[4:], tt.packet)
+			}
+			checksum := icmp.Checksum
+			icmp.SetNetworkLayerForChecksum(parsed.IPv6Layer)
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, icmp, gopacket.Payload(icmp.Payload)); err != nil {
+				t.Fatal(err)
+			}
+			if icmp.Checksum != checksum {
+				t.Errorf("checksum = %#04x, want %#04x", checksum, icmp.Checksum)
+			}
+		})
+	}
+}
+
+// checkTCPChecksum recomputes the TCP checksum of a parsed packet and compares it
+func checkTCPChecksum(t *testing.T, ctx *PacketContext) {
+	t.Helper()
+	tcp := *ctx.TCPLayer
+	checksum := tcp.Checksum
+	if ctx.IPv4Layer != nil {
+		tcp.SetNetworkLayerForChecksum(ctx.IPv4Layer)
+	} else {
+		tcp.SetNetworkLayerForChecksum(ctx.IPv6Layer)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, &tcp, gopacket.Payload(tcp.Payload)); err != nil {
+		t.Fatal(err)
+	}
+	if tcp.Checksum != checksum {
+		t.Errorf("TCP checksum = %#04x, want %#04x", checksum, tcp.Checksum)
+	}
+}
@@ -0,0 +1,325 @@
+package engine
+
+// WebAssembly plugin actions run a compiled module against the packet.
+//
+// A plugin exports its linear memory as "memory" and a function
+//
+//	process() -> i32      0 = success, anything else fails the action
+//
+// and may import these host functions from module "env" (all i32):
+//
+//	packet_len() -> len
+//	packet_read(ptr, len) -> copied          copy up to len packet bytes to ptr
+//	packet_write(ptr, len) -> status         replace the packet, fields are re-extracted (0 ok, -1 error)
+//	field_get(name_ptr, name_len, buf_ptr, buf_len) -> value_len
+//	                                         copy the field value (as text) to buf, -1 if the field has no value;
+//	                                         a value_len larger than buf_len means the value was truncated
+//	field_set(name_ptr, name_len, val_ptr, val_len) -> status
+//	                                         set a field value from text (0 ok, -1 error)
+//
+// Every call gets a fresh instance, so plugins keep no state between packets. The action
+// fuel bounds the work process() does (one unit per function call and loop iteration, see
+// wasmfuel.go) and the action timeout its wall-clock time; instantiation, including a WASI
+// _initialize, has its own fixed limits and doesn't count against them.
+// WASI is available for toolchains that need it, without filesystem, environment or arguments.
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	wasmDefaultTimeout = 10 * time.Millisecond
+	wasmInitTimeout    = 100 * time.Millisecond
+	wasmDefaultFuel    = 1000000
+	wasmInitFuel       = 10000000
+	wasmMemoryPages    = 256 // 16 MiB
+)
+
+var (
+	wasmMu      sync.RWMutex
+	wasmRuntime wazero.Runtime
+	wasmModules = map[string]wazero.CompiledModule{}
+
+	// wasmCompiled caches compiled modules by code hash so reloads only compile changed plugins
+	wasmCompiled = map[[sha256.Size]byte]wazero.CompiledModule{}
+)
+
+type wasmCallKey struct{}
+
+// wasmCall carries the packet context into host functions
+type wasmCall struct {
+	ctx *PacketContext
+	err error
+}
+
+// LoadPlugins compiles the given WebAssembly modules (name -> bytes), replacing the loaded set.
+// Modules already compiled by an earlier load are reused. Modules that fail to compile are
+// reported but don't stop the others.
+func LoadPlugins(plugins map[string][]byte) error {
+	wasmMu.Lock()
+	defer wasmMu.Unlock()
+
+	background := context.Background()
+	if wasmRuntime == nil {
+		runtime, err := newWasmRuntime(background)
+		if err != nil {
+			return err
+		}
+		wasmRuntime = runtime
+	}
+
+	modules := make(map[string]wazero.CompiledModule)
+	cache := make(map[[sha256.Size]byte]wazero.CompiledModule)
+	var errs []error
+	for name, code := range plugins {
+		hash := sha256.Sum256(code)
+		compiled, ok := cache[hash]
+		if !ok {
+			compiled, ok = wasmCompiled[hash]
+		}
+		if !ok {
+			var err error
+			compiled, err = compileWasm(background, wasmRuntime, code)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("plugin %s: %w", name, err))
+				continue
+			}
+		}
+		cache[hash] = compiled
+		modules[name] = compiled
+	}
+
+	// Release modules no plugin uses any more
+	for hash, compiled := range wasmCompiled {
+		if _, ok := cache[hash]; !ok {
+			compiled.Close(background)
+		}
+	}
+
+	wasmCompiled = cache
+	wasmModules = modules
+	return errors.Join(errs...)
+}
+
+// ValidatePlugin checks that a module compiles and exports what the host expects
+func ValidatePlugin(code []byte) error {
+	background := context.Background()
+	runtime, err := newWasmRuntime(background)
+	if err != nil {
+		return err
+	}
+	defer runtime.Close(background)
+
+	compiled, err := compileWasm(background, runtime, code)
+	if err != nil {
+		return err
+	}
+	if _, ok := compiled.ExportedFunctions()["process"]; !ok {
+		return fmt.Errorf("module does not export a process function")
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("module does not export its memory")
+	}
+	return nil
+}
+
+// compileWasm compiles a plugin instrumented with fuel metering
+func compileWasm(background context.Context, runtime wazero.Runtime, code []byte) (wazero.CompiledModule, error) {
+	metered, err := instrumentFuel(code, wasmInitFuel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add fuel metering: %w", err)
+	}
+	return runtime.CompileModule(background, metered)
+}
+
+func newWasmRuntime(background context.Context) (wazero.Runtime, error) {
+	config := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryPages)
+	runtime := wazero.NewRuntimeWithConfig(background, config)
+
+	_, err := runtime.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithFunc(wasmPacketLen).Export("packet_len").
+		NewFunctionBuilder().WithFunc(wasmPacketRead).Export("packet_read").
+		NewFunctionBuilder().WithFunc(wasmPacketWrite).Export("packet_write").
+		NewFunctionBuilder().WithFunc(wasmFieldGet).Export("field_get").
+		NewFunctionBuilder().WithFunc(wasmFieldSet).Export("field_set").
+		Instantiate(background)
+	if err != nil {
+		runtime.Close(background)
+		return nil, fmt.Errorf("failed to register host functions: %w", err)
+	}
+
+	// Toolchains targeting WASI import it even when unused; modules get no filesystem, env or args
+	if _, err := wasi_snapshot_preview1.Instantiate(background, runtime); err != nil {
+		runtime.Close(background)
+		return nil, fmt.Errorf("failed to register WASI: %w", err)
+	}
+	return runtime, nil
+}
+
+// executeWasm runs the plugin named by action.Value; action.Fuel and action.Timeout bound process()
+func executeWasm(action Action, ctx *PacketContext) error {
+	wasmMu.RLock()
+	defer wasmMu.RUnlock()
+
+	compiled, ok := wasmModules[action.Value]
+	if !ok {
+		return fmt.Errorf("plugin not loaded: %s", action.Value)
+	}
+
+	timeout := wasmDefaultTimeout
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout) * time.Millisecond
+	}
+	fuel := uint64(wasmDefaultFuel)
+	if action.Fuel > 0 {
+		fuel = uint64(action.Fuel)
+	}
+
+	call := &wasmCall{ctx: ctx}
+	callCtx := context.WithValue(context.Background(), wasmCallKey{}, call)
+
+	// Anonymous instances so concurrent packets don't collide
+	initCtx, cancelInit := context.WithTimeout(callCtx, wasmInitTimeout)
+	defer cancelInit()
+	module, err := wasmRuntime.InstantiateModule(initCtx, compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return fmt.Errorf("failed to instantiate plugin %s: %w", action.Value, err)
+	}
+	defer module.Close(context.Background())
+
+	process := module.ExportedFunction("process")
+	if process == nil {
+		return fmt.Errorf("plugin %s does not export process", action.Value)
+	}
+	meter, ok := module.ExportedGlobal(wasmFuelExport).(api.MutableGlobal)
+	if !ok {
+		return fmt.Errorf("plugin %s has no fuel meter", action.Value)
+	}
+	meter.Set(fuel)
+
+	runCtx, cancel := context.WithTimeout(callCtx, timeout)
+	defer cancel()
+	results, err := process.Call(runCtx)
+	if err != nil {
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("plugin %s timed out after %s", action.Value, timeout)
+		}
+		if meter.Get() == 0 {
+			return fmt.Errorf("plugin %s ran out of fuel (%d)", action.Value, fuel)
+		}
+		return fmt.Errorf("plugin %s failed: %w", action.Value, err)
+	}
+	if call.err != nil {
+		return fmt.Errorf("plugin %s: %w", action.Value, call.err)
+	}
+	if len(results) > 0 && api.DecodeI32(results[0]) != 0 {
+		return fmt.Errorf("plugin %s returned status %d", action.Value, api.DecodeI32(results[0]))
+	}
+
+	return nil
+}
+
+func currentWasmCall(ctx context.Context) *wasmCall {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	return call
+}
+
+func wasmPacketLen(ctx context.Context) int32 {
+	call := currentWasmCall(ctx)
+	if call == nil {
+		return 0
+	}
+	return int32(len(call.ctx.RawPacket))
+}
+
+func wasmPacketRead(ctx context.Context, m api.Module, ptr, length uint32) int32 {
+	call := currentWasmCall(ctx)
+	if call == nil {
+		return -1
+	}
+
+	data := call.ctx.RawPacket
+	if uint32(len(data)) < length {
+		length = uint32(len(data))
+	}
+	if !m.Memory().Write(ptr, data[:length]) {
+		return -1
+	}
+	return int32(length)
+}
+
+func wasmPacketWrite(ctx context.Context, m api.Module, ptr, length uint32) int32 {
+	call := currentWasmCall(ctx)
+	if call == nil {
+		return -1
+	}
+
+	data, ok := m.Memory().Read(ptr, length)
+	if !ok {
+		return -1
+	}
+	packet := make([]byte, len(data))
+	copy(packet, data)
+
+	if err := call.ctx.ReplacePacket(packet); err != nil {
+		call.err = err
+		return -1
+	}
+	return 0
+}
+
+func wasmFieldGet(ctx context.Context, m api.Module, namePtr, nameLen, bufPtr, bufLen uint32) int32 {
+	call := currentWasmCall(ctx)
+	if call == nil {
+		return -1
+	}
+
+	name, ok := m.Memory().Read(namePtr, nameLen)
+	if !ok {
+		return -1
+	}
+	value := call.ctx.Fields[string(name)]
+	if value == nil {
+		return -1
+	}
+
+	text := []byte(fmt.Sprintf("%v", value))
+	n := uint32(len(text))
+	if n > bufLen {
+		n = bufLen
+	}
+	if !m.Memory().Write(bufPtr, text[:n]) {
+		return -1
+	}
+	return int32(len(text))
+}
+
+func wasmFieldSet(ctx context.Context, m api.Module, namePtr, nameLen, valPtr, valLen uint32) int32 {
+	call := currentWasmCall(ctx)
+	if call == nil {
+		return -1
+	}
+
+	name, ok := m.Memory().Read(namePtr, nameLen)
+	if !ok {
+		return -1
+	}
+	value, ok := m.Memory().Read(valPtr, valLen)
+	if !ok {
+		return -1
+	}
+
+	call.ctx.Fields[string(name)] = string(value)
+	return 0
+}
@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+// wasmTestModule assembles a module exporting memory and process() -> i32 with the given body
+// (locals and code); globals, if any, are defined before the fuel global is added
+func wasmTestModule(body []byte, globals ...byte) []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	module = append(module, section(1, 0x01, 0x60, 0x00, 0x01, 0x7f)...) // () -> i32
+	module = append(module, section(3, 0x01, 0x00)...)
+	module = append(module, section(5, 0x01, 0x00, 0x01)...)
+	if len(globals) > 0 {
+		module = append(module, section(6, globals...)...)
+	}
+	exports := []byte{0x02, 0x06}
+	exports = append(exports, "memory"...)
+	exports = append(exports, 0x02, 0x00, 0x07)
+	exports = append(exports, "process"...)
+	exports = append(exports, 0x00, 0x00)
+	module = append(module, section(7, exports...)...)
+	code := append([]byte{0x01, byte(len(body))}, body...)
+	return append(module, section(10, code...)...)
+}
+
+func TestWasmFuel(t *testing.T) {
+	// count a local to 10 in a loop, then return 0
+	count := wasmTestModule([]byte{
+		0x01, 0x01, 0x7f, // one i32 local
+		0x03, 0x40, // loop
+		0x20, 0x00, 0x41, 0x01, 0x6a, 0x22, 0x00, // local = local + 1
+		0x41, 0x0a, 0x48, 0x0d, 0x00, // br_if 0 while local < 10
+		0x0b,       // end
+		0x41, 0x00, // i32.const 0
+		0x0b,
+	})
+	// loop forever, with a mutable global defined ahead of the fuel global
+	spin := wasmTestModule([]byte{
+		0x00,
+		0x03, 0x40, 0x23, 0x00, 0x1a, 0x0c, 0x00, 0x0b, // loop: global.get 0; drop; br 0
+		0x41, 0x00,
+		0x0b,
+	}, 0x01, 0x7f, 0x01, 0x41, 0x00, 0x0b)
+
+	for name, code := range map[string][]byte{"count": count, "spin": spin} {
+		if err := ValidatePlugin(code); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if err := LoadPlugins(map[string][]byte{"count": count, "spin": spin}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { LoadPlugins(nil) })
+
+	ctx, err := ParsePacket(tcpTestPacket(t, true, 1000, 2000, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		action  Action
+		wantErr string
+	}{
+		{"enough fuel", Action{Op: "wasm", Value: "count", Fuel: 11}, ""},
+		{"default fuel", Action{Op: "wasm", Value: "count"}, ""},
+		{"one unit short", Action{Op: "wasm", Value: "count", Fuel: 10}, "ran out of fuel"},
+		{"endless loop", Action{Op: "wasm", Value: "spin", Fuel: 1000, Timeout: 10000}, "ran out of fuel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := executeWasm(tt.action, ctx)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstrumentFuelRejectsFuelExport(t *testing.T) {
+	module := wasmTestModule([]byte{0x00, 0x41, 0x00, 0x0b})
+	module = []byte(strings.Replace(string(module), "\x06memory", "\x06__fuel", 1))
+	if _, err := instrumentFuel(module, 1); err == nil || !strings.Contains(err.Error(), "already exports") {
+		t.Fatalf("error = %v", err)
+	}
+}
@@ -0,0 +1,497 @@
+package engine
+
+// Plugins are metered with fuel: before compiling, the module is instrumented with an
+// exported i64 global that is charged one unit at every function entry and every loop
+// iteration. Straight-line code between those points is bounded by the size of the module,
+// so the fuel bounds the work of a call independently of how fast the host is. A call that
+// finds the global at zero traps.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// wasmFuelExport names the fuel global added to every plugin
+const wasmFuelExport = "__fuel"
+
+const (
+	wasmSectionCustom    = 0
+	wasmSectionImport    = 2
+	wasmSectionGlobal    = 6
+	wasmSectionExport    = 7
+	wasmSectionCode      = 10
+	wasmSectionDataCount = 12
+)
+
+var errWasmTruncated = errors.New("truncated module")
+
+// wasmReader decodes the parts of a module the instrumentation needs
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wasmReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errWasmTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errWasmTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// u32 reads an unsigned LEB128 value
+func (r *wasmReader) u32() (uint32, error) {
+	var value uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("integer too long")
+}
+
+// skipLEB skips a signed or unsigned LEB128 value
+func (r *wasmReader) skipLEB() error {
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+}
+
+func (r *wasmReader) skipLEBs(n int) error {
+	for i := 0; i < n; i++ {
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *wasmReader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(int(n))
+	return string(b), err
+}
+
+func (r *wasmReader) skipLimits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if flags&1 != 0 {
+		return r.skipLEBs(2)
+	}
+	return r.skipLEB()
+}
+
+func appendULEB(dst []byte, value uint64) []byte {
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+func appendSLEB(dst []byte, value int64) []byte {
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			return append(dst, b)
+		}
+		dst = append(dst, b|0x80)
+	}
+}
+
+// wasmSection is a section of a module, content without id and size
+type wasmSection struct {
+	id      byte
+	content []byte
+}
+
+// wasmSectionOrder ranks the known sections in the order the binary format requires
+func wasmSectionOrder(id byte) int {
+	switch id {
+	case wasmSectionDataCount:
+		return 10
+	case wasmSectionCode, wasmSectionCode + 1:
+		return int(id) + 1
+	}
+	return int(id)
+}
+
+// instrumentFuel returns the module with fuel metering added; the fuel global starts at
+// initial, which bounds instantiation (start functions) until the host sets it per call
+func instrumentFuel(code []byte, initial uint64) ([]byte, error) {
+	if len(code) < 8 || string(code[:4]) != "\x00asm" {
+		return nil, errors.New("not a WebAssembly module")
+	}
+
+	r := &wasmReader{data: code, pos: 8}
+	var sections []wasmSection
+	for !r.done() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		content, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, wasmSection{id: id, content: content})
+	}
+
+	// The fuel global goes after the imported and defined ones, so no index moves
+	importedGlobals, definedGlobals := 0, 0
+	for _, section := range sections {
+		var err error
+		switch section.id {
+		case wasmSectionImport:
+			importedGlobals, err = countImportedGlobals(section.content)
+		case wasmSectionGlobal:
+			var n uint32
+			n, err = (&wasmReader{data: section.content}).u32()
+			definedGlobals = int(n)
+		case wasmSectionExport:
+			err = checkExportFree(section.content, wasmFuelExport)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	fuel := uint64(importedGlobals + definedGlobals)
+
+	// global.get fuel; i64.eqz; if; unreachable; end; global.get fuel; i64.const 1; i64.sub; global.set fuel
+	check := appendULEB([]byte{0x23}, fuel)
+	check = append(check, 0x50, 0x04, 0x40, 0x00, 0x0b)
+	check = appendULEB(append(check, 0x23), fuel)
+	check = append(check, 0x42, 0x01, 0x7d)
+	check = appendULEB(append(check, 0x24), fuel)
+
+	global := appendSLEB([]byte{0x7e, 0x01, 0x42}, int64(initial)) // mutable i64 = initial
+	global = append(global, 0x0b)
+	export := appendULEB(nil, uint64(len(wasmFuelExport)))
+	export = appendULEB(append(append(export, wasmFuelExport...), 0x03), fuel)
+
+	pending := []wasmSection{
+		{id: wasmSectionGlobal, content: append(appendULEB(nil, 1), global...)},
+		{id: wasmSectionExport, content: append(appendULEB(nil, 1), export...)},
+	}
+	out := append([]byte(nil), code[:8]...)
+	emit := func(section wasmSection) {
+		out = append(out, section.id)
+		out = appendULEB(out, uint64(len(section.content)))
+		out = append(out, section.content...)
+	}
+
+	for _, section := range sections {
+		content := section.content
+		var err error
+		switch section.id {
+		case wasmSectionGlobal:
+			content, err = appendVecEntry(content, global)
+			pending[0].id = 0xff
+		case wasmSectionExport:
+			content, err = appendVecEntry(content, export)
+			pending[1].id = 0xff
+		case wasmSectionCode:
+			content, err = instrumentCode(content, check)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if section.id != wasmSectionCustom {
+			for i, p := range pending {
+				if p.id != 0xff && wasmSectionOrder(p.id) < wasmSectionOrder(section.id) {
+					emit(p)
+					pending[i].id = 0xff
+				}
+			}
+		}
+		emit(wasmSection{id: section.id, content: content})
+	}
+	for _, p := range pending {
+		if p.id != 0xff {
+			emit(p)
+		}
+	}
+	return out, nil
+}
+
+func countImportedGlobals(content []byte) (int, error) {
+	r := &wasmReader{data: content}
+	count, err := r.u32()
+	if err != nil {
+		return 0, err
+	}
+	globals := 0
+	for i := uint32(0); i < count; i++ {
+		if _, err := r.name(); err != nil {
+			return 0, err
+		}
+		if _, err := r.name(); err != nil {
+			return 0, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case 0x00: // function
+			err = r.skipLEB()
+		case 0x01: // table
+			if _, err = r.byte(); err == nil {
+				err = r.skipLimits()
+			}
+		case 0x02: // memory
+			err = r.skipLimits()
+		case 0x03: // global
+			globals++
+			_, err = r.bytes(2)
+		default:
+			err = fmt.Errorf("unknown import kind %#x", kind)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return globals, nil
+}
+
+func checkExportFree(content []byte, name string) error {
+	r := &wasmReader{data: content}
+	count, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		export, err := r.name()
+		if err != nil {
+			return err
+		}
+		if export == name {
+			return fmt.Errorf("module already exports %s", name)
+		}
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+		if err := r.skipLEB(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVecEntry adds an encoded entry to a section holding a single vector
+func appendVecEntry(content, entry []byte) ([]byte, error) {
+	r := &wasmReader{data: content}
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	out := appendULEB(nil, uint64(count)+1)
+	out = append(out, content[r.pos:]...)
+	return append(out, entry...), nil
+}
+
+// instrumentCode inserts the fuel check at the start of every function body and loop
+func instrumentCode(content, check []byte) ([]byte, error) {
+	r := &wasmReader{data: content}
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	out := appendULEB(nil, uint64(count))
+	for i := uint32(0); i < count; i++ {
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		body, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		body, err = instrumentBody(body, check)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		out = appendULEB(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+	return out, nil
+}
+
+func instrumentBody(body, check []byte) ([]byte, error) {
+	r := &wasmReader{data: body}
+	groups, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < groups; i++ {
+		if err := r.skipLEB(); err != nil {
+			return nil, err
+		}
+		if _, err := r.byte(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, 0, len(body)+len(check)*4)
+	out = append(append(out, body[:r.pos]...), check...)
+	for !r.done() {
+		start := r.pos
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if err := skipImmediates(r, op); err != nil {
+			return nil, err
+		}
+		out = append(out, body[start:r.pos]...)
+		if op == 0x03 { // loop: charge every iteration
+			out = append(out, check...)
+		}
+	}
+	return out, nil
+}
+
+// skipImmediates skips the immediates of an instruction
+func skipImmediates(r *wasmReader, op byte) error {
+	switch {
+	case op == 0x02 || op == 0x03 || op == 0x04: // block, loop, if
+		return skipBlockType(r)
+	case op == 0x0c || op == 0x0d || op == 0x10 || op == 0xd2: // br, br_if, call, ref.func
+		return r.skipLEB()
+	case op >= 0x20 && op <= 0x26: // local, global and table access
+		return r.skipLEB()
+	case op == 0x0e: // br_table
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		return r.skipLEBs(int(n) + 1)
+	case op == 0x11: // call_indirect
+		return r.skipLEBs(2)
+	case op == 0x1c: // select with types
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		_, err = r.bytes(int(n))
+		return err
+	case op >= 0x28 && op <= 0x3e: // loads and stores
+		return r.skipLEBs(2)
+	case op == 0x3f || op == 0x40: // memory.size, memory.grow
+		return r.skipLEB()
+	case op == 0x41 || op == 0x42: // i32.const, i64.const
+		return r.skipLEB()
+	case op == 0x43:
+		_, err := r.bytes(4)
+		return err
+	case op == 0x44:
+		_, err := r.bytes(8)
+		return err
+	case op == 0xd0: // ref.null
+		_, err := r.byte()
+		return err
+	case op == 0xfc:
+		return skipMiscImmediates(r)
+	case op == 0xfd:
+		return skipVectorImmediates(r)
+	case op <= 0x01, op == 0x05, op == 0x0b, op == 0x0f, op == 0x1a, op == 0x1b,
+		op >= 0x45 && op <= 0xc4, op == 0xd1:
+		return nil
+	}
+	return fmt.Errorf("unsupported opcode %#x", op)
+}
+
+func skipBlockType(r *wasmReader) error {
+	b, err := r.byte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0x40, 0x7f, 0x7e, 0x7d, 0x7c, 0x7b, 0x70, 0x6f:
+		return nil
+	}
+	r.pos-- // type index
+	return r.skipLEB()
+}
+
+// skipMiscImmediates handles the 0xfc prefix: saturating truncation, bulk memory and tables
+func skipMiscImmediates(r *wasmReader) error {
+	op, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case op <= 7:
+		return nil
+	case op == 8: // memory.init
+		return r.skipLEBs(2)
+	case op == 9, op == 13, op >= 15 && op <= 17: // data.drop, elem.drop, table.grow/size/fill
+		return r.skipLEB()
+	case op == 10, op == 12, op == 14: // memory.copy, table.init, table.copy
+		return r.skipLEBs(2)
+	case op == 11: // memory.fill
+		return r.skipLEB()
+	}
+	return fmt.Errorf("unsupported opcode 0xfc %d", op)
+}
+
+// skipVectorImmediates handles the 0xfd prefix (SIMD)
+func skipVectorImmediates(r *wasmReader) error {
+	op, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case op <= 11, op == 92, op == 93: // loads and stores
+		return r.skipLEBs(2)
+	case op == 12, op == 13: // v128.const, i8x16.shuffle
+		_, err := r.bytes(16)
+		return err
+	case op >= 21 && op <= 34: // extract and replace lane
+		_, err := r.byte()
+		return err
+	case op >= 84 && op <= 91: // load and store lane
+		if err := r.skipLEBs(2); err != nil {
+			return err
+		}
+		_, err := r.byte()
+		return err
+	}
+	return nil
+}
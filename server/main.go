@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"packet-repackage/api"
 	"packet-repackage/database"
+	"packet-repackage/engine"
 	"packet-repackage/network"
 	"packet-repackage/nfqueue"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -22,6 +24,20 @@ func main() {
 	noQueue := flag.Bool("no-queue", false, "Disable NFQueue (API only mode)")
 	logPath := flag.String("log-path", "./log/backend.log", "Path to log file")
 	logLevel := flag.String("log-level", "debug", "Log level (debug, info, warn, error)")
+	shellTimeout := flag.Duration("shell-timeout", 2*time.Second, "Default timeout for shell actions")
+	shellAllow := flag.String("shell-allow", "", "Comma-separated executables shell actions may run (empty = any command via sh -c)")
+	scriptMaxSteps := flag.Uint64("script-max-steps", 100000, "Maximum Starlark execution steps per script run")
+	scriptMaxAlloc := flag.Int("script-max-alloc", 8, "Maximum MB of values a Starlark script run may build")
+	mirrorPcapSize := flag.Int64("mirror-pcap-max-size", 100, "Rotate mirror pcap files larger than this many MB (0 = never)")
+	mirrorPcapKeep := flag.Int("mirror-pcap-keep", 5, "Rotated mirror pcap files to keep")
+	mirrorPcapDir := flag.String("mirror-pcap-dir", "./mirror", "Directory pcap mirror targets are written under")
+	faultSeed := flag.Int64("fault-seed", 0, "Base seed for fault injection actions (0 = from the clock)")
+	varFlush := flag.Duration("var-flush", 5*time.Second, "How often persistent variables are saved to the database")
+	mtu := flag.Int("mtu", 0, "Egress MTU for rewritten packets (0 = MTU of the output interface)")
+	defrag := flag.Bool("defrag", false, "Reassemble IPv4 fragments before matching rules (no effect while conntrack defragments; fragments are re-sent via this host's routing table)")
+	defragTimeout := flag.Duration("defrag-timeout", 30*time.Second, "How long incomplete fragmented datagrams are held")
+	defragMemory := flag.Int("defrag-max-memory", 4, "Maximum MB of fragments held for reassembly")
+	streamMemory := flag.Int("stream-max-memory", 16, "Maximum MB of TCP stream data held across connections for stream-mode rules")
 	flag.Parse()
 
 	// Initialize logger
@@ -42,6 +58,31 @@ func main() {
 		zap.String("port", *port),
 		zap.String("queues", *queueDefs))
 
+	// Configure shell actions
+	engine.SetShellConfig(engine.ShellConfig{
+		Timeout:   *shellTimeout,
+		Allowlist: splitList(*shellAllow),
+	})
+
+	// Configure script limits
+	engine.SetScriptConfig(engine.ScriptConfig{
+		MaxSteps: *scriptMaxSteps,
+		MaxAlloc: *scriptMaxAlloc << 20,
+	})
+	database.Logger.Info("Fault injection seed", zap.Int64("seed", engine.SetFaultSeed(*faultSeed)))
+	nfqueue.SetMirrorConfig(nfqueue.MirrorConfig{
+		PcapMaxSize: *mirrorPcapSize << 20,
+		PcapKeep:    *mirrorPcapKeep,
+	})
+	engine.SetMirrorPcapDir(*mirrorPcapDir)
+	nfqueue.SetMTU(*mtu)
+	engine.SetDefragConfig(engine.DefragConfig{
+		Enabled:   *defrag,
+		Timeout:   *defragTimeout,
+		MaxMemory: *defragMemory << 20,
+	})
+	engine.SetStreamMaxMemory(*streamMemory << 20)
+
 	// Load and apply network configurations from database
 	database.Logger.Info("Loading network configurations from database")
 	err = network.LoadAndApplyConfigs(database.DB)
@@ -74,6 +115,12 @@ func main() {
 		database.Logger.Error("Failed to load initial configuration", zap.Error(err))
 	}
 
+	// Restore persistent variables and keep saving them
+	if err := nfqueue.LoadVariables(); err != nil {
+		database.Logger.Error("Failed to load variables", zap.Error(err))
+	}
+	go nfqueue.RunVariableMaintenance(*varFlush)
+
 	// Start NFQueue handler if enabled
 	if !*noQueue {
 		err = nfqueue.Start(queues)
@@ -164,6 +211,33 @@ func main() {
 		apiGroup.POST("/nftrules/:id/toggle", api.ToggleNFTRule)
 		apiGroup.POST("/nftrules/apply", api.ApplyNFTRulesAPI)
 
+		// Lookup tables
+		apiGroup.GET("/lookups", api.ListLookupTables)
+		apiGroup.GET("/lookups/:id", api.GetLookupTable)
+		apiGroup.POST("/lookups", api.CreateLookupTable)
+		apiGroup.PUT("/lookups/:id", api.UpdateLookupTable)
+		apiGroup.DELETE("/lookups/:id", api.DeleteLookupTable)
+		apiGroup.POST("/lookups/:id/entries", api.SetLookupEntry)
+		apiGroup.DELETE("/lookups/:id/entries/:entry_id", api.DeleteLookupEntry)
+		apiGroup.POST("/lookups/:id/import", api.ImportLookupEntries)
+		apiGroup.GET("/lookups/:id/export", api.ExportLookupEntries)
+
+		// WebAssembly plugins
+		apiGroup.GET("/plugins", api.ListPlugins)
+		apiGroup.GET("/plugins/:id", api.GetPlugin)
+		apiGroup.POST("/plugins", api.UploadPlugin)
+		apiGroup.DELETE("/plugins/:id", api.DeletePlugin)
+
+		// Secret keys
+		apiGroup.GET("/keys", api.ListKeys)
+		apiGroup.POST("/keys", api.CreateKey)
+		apiGroup.PUT("/keys/:id", api.UpdateKey)
+		apiGroup.DELETE("/keys/:id", api.DeleteKey)
+
+		// Variables
+		apiGroup.GET("/variables", api.ListVariables)
+		apiGroup.DELETE("/variables", api.DeleteVariables)
+
 		// Test mode
 		apiGroup.POST("/test", api.TestRule)
 
@@ -237,3 +311,15 @@ func parseQueueDefs(def string) ([]uint16, error) {
 
 	return queues, nil
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -13,17 +13,71 @@ type Field struct {
 	Offset int    `gorm:"not null" json:"offset"`             // Starting offset in bytes (can be hex like 0x58)
 	Length int    `gorm:"not null" json:"length"`             // Field length in bytes
 	Type   string `gorm:"not null;default:'hex'" json:"type"` // hex, decimal, string, or builtin (for 5-tuple)
+	Anchor string `json:"anchor"`                             // Offset counts from: packet (default), network, transport or payload
+
+	// Length fields are recomputed on repackaging as the size of a region of the modified packet
+	LengthOf     string `json:"length_of"`     // Region measured: "field", "first..last", "field..end" or original offsets like "0x2a..end"
+	LengthAdjust int    `json:"length_adjust"` // Constant added to the measured size
+	LittleEndian bool   `json:"little_endian"` // Write the length little-endian (default big-endian)
 }
 
 // Rule represents a packet modification rule
 type Rule struct {
 	gorm.Model
-	Name           string `gorm:"uniqueIndex;not null" json:"name"`
-	Enabled        bool   `gorm:"default:true" json:"enabled"`
-	MatchCondition string `gorm:"type:text" json:"match_condition"` // Expression like: tagName == "BHB10A01YP01_pmt" && option == "opset"
-	Actions        string `gorm:"type:text" json:"actions"`         // JSON array of actions like: [{"field": "tagName", "op": "set", "value": "BHB10A01YP01"}]
-	OutputOptions  string `gorm:"type:text" json:"output_options"`  // JSON array of processing options like: ["compute_checksum"]
-	Priority       int    `gorm:"default:0" json:"priority"`        // Higher priority rules evaluated first
+	Name            string `gorm:"uniqueIndex;not null" json:"name"`
+	Enabled         bool   `gorm:"default:true" json:"enabled"`
+	MatchCondition  string `gorm:"type:text" json:"match_condition"`  // Expression like: tagName == "BHB10A01YP01_pmt" && option == "opset"
+	ConditionScript string `gorm:"type:text" json:"condition_script"` // Optional Starlark condition, must also hold for the rule to match
+	Actions         string `gorm:"type:text" json:"actions"`          // JSON array of actions like: [{"field": "tagName", "op": "set", "value": "BHB10A01YP01"}]
+	OutputOptions   string `gorm:"type:text" json:"output_options"`   // JSON array of processing options like: ["compute_checksum", {"checksum": "crc16_modbus", ...}]
+	Priority        int    `gorm:"default:0" json:"priority"`         // Higher priority rules evaluated first
+	Stream          string `gorm:"type:text" json:"stream"`           // Optional stream mode: rule matches TCP messages framed like {"ports": [2404], "start": "68", "length_offset": 1, "length_size": 1, "length_adjust": 2}
+}
+
+// Plugin represents an uploaded WebAssembly module usable as a rule action
+type Plugin struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;not null" json:"name"` // Referenced by {"op": "wasm", "value": "<name>"}
+	Description string `json:"description"`
+	Module      []byte `gorm:"type:blob" json:"-"` // Compiled .wasm bytes
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// SecretKey is a named key for hmac_sha256 expressions; the key itself is never returned by the API
+type SecretKey struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex;not null" json:"name"` // Referenced as hmac_sha256("<name>", ...)
+	Description string `json:"description"`
+	Key         []byte `gorm:"type:blob" json:"-"`
+	Size        int    `json:"size"`
+}
+
+// LookupTable represents a mapping dictionary used by the "map" action
+type LookupTable struct {
+	gorm.Model
+	Name         string        `gorm:"uniqueIndex;not null" json:"name"` // Referenced by {"op": "map", "value": "<name>"}
+	Description  string        `json:"description"`
+	MissAction   string        `gorm:"default:'keep'" json:"miss_action"` // keep, default, drop - what to do when the key isn't found
+	DefaultValue string        `json:"default_value"`                     // Value set on a miss when miss_action is "default"
+	Entries      []LookupEntry `gorm:"foreignKey:TableID" json:"entries,omitempty"`
+}
+
+// LookupEntry represents one key/value pair of a lookup table
+type LookupEntry struct {
+	gorm.Model
+	TableID uint   `gorm:"uniqueIndex:idx_lookup_entry;not null" json:"table_id"`
+	Key     string `gorm:"uniqueIndex:idx_lookup_entry;not null" json:"key"`
+	Value   string `json:"value"`
+}
+
+// Variable is a persisted packet-processing variable (see engine.Variable)
+type Variable struct {
+	gorm.Model
+	Scope string `gorm:"uniqueIndex:idx_variable;not null" json:"scope"`
+	Owner string `gorm:"uniqueIndex:idx_variable" json:"owner"`
+	Name  string `gorm:"uniqueIndex:idx_variable;not null" json:"name"`
+	Value string `gorm:"type:text" json:"value"` // JSON-encoded value
 }
 
 // InterfaceConfig represents network interface VLAN configuration
@@ -65,8 +119,18 @@ type ProcessLog struct {
 	OriginalPacket string    `gorm:"type:text" json:"original_packet"` // Hex string
 	ModifiedPacket string    `gorm:"type:text" json:"modified_packet"` // Hex string
 	FieldValues    string    `gorm:"type:text" json:"field_values"`    // JSON object with before/after values
-	Result         string    `json:"result"`                           // success, error, dropped
+	Result         string    `json:"result"`                           // success, error, dropped, passed
+	Verdict        string    `json:"verdict"`                          // Drop/reject action that blocked the packet, pass if forwarded unmodified, empty if forwarded
+	DelayMs        int       `json:"delay_ms"`                         // Time the packet was held by delay actions
+	FaultSeed      int64     `json:"fault_seed"`                       // Seed that reproduces the packet's fault injection
+	Faults         string    `gorm:"type:text" json:"faults"`          // Faults applied, e.g. "bitflip byte 42 bit 3"
+	Mark           string    `json:"mark"`                             // Mark set on the packet, e.g. "0x10/0xff (conntrack)"
 	ErrorMessage   string    `gorm:"type:text" json:"error_message"`
+	ErrorPolicy    string    `json:"error_policy"`              // How a failed action was handled: skipped, aborted or dropped
+	Warnings       string    `gorm:"type:text" json:"warnings"` // Problems that didn't stop processing, e.g. a length that couldn't be fixed
+	Fragments      int       `json:"fragments"`                 // IPv4 fragments the packet was sent as, 0 if sent whole
+	Defragmented   int       `json:"defragmented"`              // Fragments the packet was reassembled from, 0 if it arrived whole
+	Stream         bool      `json:"stream"`                    // Logged for a message reassembled by a stream-mode rule
 	ProcessedAt    time.Time `gorm:"index" json:"processed_at"`
 
 	// 5-Tuple info
@@ -66,17 +66,18 @@ func EnsureNFTInfrastructure() error {
 	database.Logger.Info("Ensuring NFTables infrastructure exists")
 
 	// Try to create table (ignore error if exists)
-	// Remove old BRIDGE table if exists to avoid confusion and ensure we use IP table
+	// Remove old BRIDGE and IPv4-only tables if they exist to avoid confusion and ensure we use the INET table
 	_ = command.GoLinuxShell("nft delete table bridge netvine-table")
+	_ = command.GoLinuxShell("nft delete table ip netvine-table")
 
 	// Try to create table (ignore error if exists)
-	// We use 'table ip' instead of 'table bridge' to work around the nil PacketID issue in AF_BRIDGE
-	// Since net.bridge.bridge-nf-call-iptables=1, bridged IP traffic will traverse this table
-	cmd := "nft add table ip netvine-table"
+	// We use 'table inet' instead of 'table bridge' to work around the nil PacketID issue in AF_BRIDGE
+	// Since net.bridge.bridge-nf-call-iptables=1 (and ip6tables), bridged IPv4 and IPv6 traffic will traverse this table
+	cmd := "nft add table inet netvine-table"
 	_ = command.GoLinuxShell(cmd) // Ignore error, table might exist
 
 	// Try to create chain (ignore error if exists)
-	cmd = "nft add chain ip netvine-table base-rule-chain { type filter hook forward priority 0\\; policy accept\\; }"
+	cmd = "nft add chain inet netvine-table base-rule-chain { type filter hook forward priority 0\\; policy accept\\; }"
 	_ = command.GoLinuxShell(cmd) // Ignore error, chain might exist
 
 	database.Logger.Info("NFTables infrastructure ready")
@@ -88,7 +89,7 @@ func ClearNFTRules() error {
 	database.Logger.Info("Clearing existing NFTables rules")
 
 	// Flush all rules in base-rule-chain
-	cmd := "nft flush chain ip netvine-table base-rule-chain"
+	cmd := "nft flush chain inet netvine-table base-rule-chain"
 	err := command.GoLinuxShell(cmd)
 	if err != nil {
 		return fmt.Errorf("failed to flush chain: %w", err)
@@ -102,15 +103,15 @@ func BuildNFTCommand(rule models.NFTRule) string {
 	var parts []string
 
 	// Start with base command
-	parts = append(parts, "nft add rule ip netvine-table base-rule-chain")
+	parts = append(parts, "nft add rule inet netvine-table base-rule-chain")
 
-	// Add IP filters FIRST (before protocol)
+	// Add IP filters FIRST (before protocol); IPv6 addresses match with ip6
 	if rule.SrcIP != "" {
-		parts = append(parts, fmt.Sprintf("ip saddr %s", rule.SrcIP))
+		parts = append(parts, fmt.Sprintf("%s saddr %s", addressFamily(rule.SrcIP), rule.SrcIP))
 	}
 
 	if rule.DstIP != "" {
-		parts = append(parts, fmt.Sprintf("ip daddr %s", rule.DstIP))
+		parts = append(parts, fmt.Sprintf("%s daddr %s", addressFamily(rule.DstIP), rule.DstIP))
 	}
 
 	// Then add protocol and ports
@@ -163,6 +164,14 @@ func BuildNFTCommand(rule models.NFTRule) string {
 	return strings.Join(parts, " ")
 }
 
+// addressFamily returns the nft payload keyword for an address or CIDR
+func addressFamily(address string) string {
+	if strings.Contains(address, ":") {
+		return "ip6"
+	}
+	return "ip"
+}
+
 // GetRuleSummary returns a human-readable summary of the rule's filters
 func GetRuleSummary(rule models.NFTRule) string {
 	srcIP := rule.SrcIP
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"packet-repackage/database"
 	"packet-repackage/engine"
@@ -27,8 +28,9 @@ var Manager *NFQueueManager
 
 type configCache struct {
 	sync.RWMutex
-	fields []models.Field
-	rules  []models.Rule
+	fields  []models.Field
+	rules   []models.Rule
+	streams []streamRule // Stream-mode rules, matched per message instead of per packet
 }
 
 var cache = &configCache{}
@@ -45,14 +47,68 @@ func ReloadConfig() error {
 		return fmt.Errorf("failed to load rules: %w", err)
 	}
 
+	var plugins []models.Plugin
+	if err := database.DB.Find(&plugins).Error; err != nil {
+		return fmt.Errorf("failed to load plugins: %w", err)
+	}
+
+	var lookupTables []models.LookupTable
+	if err := database.DB.Preload("Entries").Find(&lookupTables).Error; err != nil {
+		return fmt.Errorf("failed to load lookup tables: %w", err)
+	}
+
+	var secretKeys []models.SecretKey
+	if err := database.DB.Find(&secretKeys).Error; err != nil {
+		return fmt.Errorf("failed to load keys: %w", err)
+	}
+
+	// Compile scripts and plugins once so packets don't pay for it
+	if err := engine.CompileScripts(rules); err != nil {
+		database.Logger.Error("Failed to compile rule scripts", zap.Error(err))
+	}
+
+	modules := make(map[string][]byte)
+	for _, plugin := range plugins {
+		modules[plugin.Name] = plugin.Module
+	}
+	if err := engine.LoadPlugins(modules); err != nil {
+		database.Logger.Error("Failed to load plugins", zap.Error(err))
+	}
+
+	tables := make(map[string]*engine.LookupTable)
+	for _, table := range lookupTables {
+		entries := make(map[string]string, len(table.Entries))
+		for _, entry := range table.Entries {
+			entries[entry.Key] = entry.Value
+		}
+		tables[table.Name] = &engine.LookupTable{
+			MissAction:   table.MissAction,
+			DefaultValue: table.DefaultValue,
+			Entries:      entries,
+		}
+	}
+	engine.SetLookupTables(tables)
+
+	keys := make(map[string][]byte, len(secretKeys))
+	for _, key := range secretKeys {
+		keys[key.Name] = key.Key
+	}
+	engine.SetKeys(keys)
+
+	packetRules, streams := splitStreamRules(rules)
+
 	cache.Lock()
 	cache.fields = fields
-	cache.rules = rules
+	cache.rules = packetRules
+	cache.streams = streams
 	cache.Unlock()
 
 	database.Logger.Info("Configuration reloaded",
 		zap.Int("fields_count", len(fields)),
-		zap.Int("rules_count", len(rules)))
+		zap.Int("rules_count", len(rules)),
+		zap.Int("plugins_count", len(plugins)),
+		zap.Int("lookup_tables_count", len(lookupTables)),
+		zap.Int("keys_count", len(secretKeys)))
 
 	return nil
 }
@@ -87,8 +143,9 @@ func Start(queueNums []uint16) error {
 		// We capture the nfq instance in a closure so handlePacket knows which queue to use
 		// This avoids relying on attr.QueueId which might not be available
 		currentNFQ := nfq
+		currentQueue := qNum
 		err = nfq.RegisterWithErrorFunc(ctx, func(attr nfqueue.Attribute) int {
-			return handlePacket(attr, currentNFQ)
+			return handlePacket(attr, currentNFQ, currentQueue)
 		}, handleError)
 		if err != nil {
 			nfq.Close()
@@ -129,7 +186,7 @@ func Stop() error {
 }
 
 // handlePacket processes each packet from the queue
-func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
+func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue, queueNum uint16) int {
 	// Critical: In AF_BRIDGE mode, PacketID can sometimes be nil even when Payload is present
 	// This appears to be a known issue with the nfqueue library when using bridge netfilter
 	// Without a PacketID, we cannot issue a verdict, so we must skip processing
@@ -153,13 +210,41 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 	packetID := *attr.PacketID
 	rawPacket := *attr.Payload
 
+	var currentMark uint32
+	if attr.Mark != nil {
+		currentMark = *attr.Mark
+	}
+
 	// Default verdict is ACCEPT (pass through)
 	verdict := nfqueue.NfAccept
 
+	// Fragments are held until their datagram is complete; the last one to arrive carries the
+	// reassembled packet through the rules
+	var datagram *engine.Datagram
+	if engine.IsIPv4Fragment(rawPacket) && engine.DefragEnabled() {
+		var err error
+		datagram, err = engine.DefragIPv4(rawPacket)
+		if err != nil {
+			database.Logger.Warn("Discarding fragment that can't be reassembled",
+				zap.Uint32("packet_id", packetID),
+				zap.Error(err))
+		}
+		if datagram == nil {
+			// Our copy goes out with the rest of the datagram
+			nfq.SetVerdict(packetID, nfqueue.NfDrop)
+			return 0
+		}
+		rawPacket = datagram.Packet
+	}
+
 	// Parse packet
 	ctx, err := engine.ParsePacket(rawPacket)
 	if err != nil {
 		database.Logger.Error("Failed to parse packet", zap.Error(err))
+		if datagram != nil {
+			acceptUnmodified(nfq, packetID, rawPacket, datagram, currentMark)
+			return 0
+		}
 		nfq.SetVerdict(packetID, verdict)
 		return 0
 	}
@@ -179,15 +264,21 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 	cache.RLock()
 	fields := cache.fields
 	rules := cache.rules
+	streams := cache.streams
 	cache.RUnlock()
 
+	// Segments of stream-mode connections are matched per message
+	if handleStream(nfq, packetID, rawPacket, ctx, fields, streams) {
+		return 0
+	}
+
 	// Extract field values
 	engine.ExtractAllFields(ctx, fields)
 
 	// Try to match rules
 	var matchedRule *models.Rule
 	for _, rule := range rules {
-		matched, err := engine.EvaluateCondition(rule.MatchCondition, ctx, fields)
+		matched, err := engine.MatchRule(rule, ctx, fields)
 		if err != nil {
 			database.Logger.Error("Failed to evaluate condition",
 				zap.String("rule", rule.Name),
@@ -207,21 +298,17 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 		ProcessedAt:    time.Now(),
 		OriginalPacket: hex.EncodeToString(rawPacket),
 	}
-
-	// Populate 5-tuple info
-	if ctx.IPv4Layer != nil {
-		logEntry.SrcIP = ctx.IPv4Layer.SrcIP.String()
-		logEntry.DstIP = ctx.IPv4Layer.DstIP.String()
-		logEntry.Protocol = ctx.IPv4Layer.Protocol.String()
+	if datagram != nil {
+		logEntry.Defragmented = len(datagram.Fragments)
 	}
-	if ctx.TCPLayer != nil {
-		logEntry.SrcPort = int(ctx.TCPLayer.SrcPort)
-		logEntry.DstPort = int(ctx.TCPLayer.DstPort)
-		logEntry.Protocol = "TCP"
-	} else if ctx.UDPLayer != nil {
-		logEntry.SrcPort = int(ctx.UDPLayer.SrcPort)
-		logEntry.DstPort = int(ctx.UDPLayer.DstPort)
-		logEntry.Protocol = "UDP"
+
+	// Populate 5-tuple info (IPv4 or IPv6)
+	if tuple := ctx.FiveTuple(); tuple.SrcIP != "" {
+		logEntry.SrcIP = tuple.SrcIP
+		logEntry.DstIP = tuple.DstIP
+		logEntry.SrcPort = tuple.SrcPort
+		logEntry.DstPort = tuple.DstPort
+		logEntry.Protocol = tuple.Protocol
 	}
 
 	if matchedRule != nil {
@@ -240,10 +327,68 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 			database.Logger.Error("Failed to execute actions",
 				zap.String("rule", matchedRule.Name),
 				zap.Error(err))
-			logEntry.Result = "error"
 			logEntry.ErrorMessage = err.Error()
+
+			// The rule's changes were discarded; drop or accept the original as configured
+			var actionErr *engine.ActionError
+			if errors.As(err, &actionErr) && actionErr.Policy == engine.OnErrorDrop {
+				logEntry.ErrorPolicy = "dropped"
+				ctx.Verdict = engine.VerdictDrop
+				dropPacket(nfq, packetID, ctx, &logEntry)
+				return 0
+			}
+
+			logEntry.Result = "error"
+			logEntry.ErrorPolicy = "aborted"
 			database.DB.Create(&logEntry)
-			nfq.SetVerdict(packetID, verdict)
+			acceptUnmodified(nfq, packetID, rawPacket, datagram, currentMark)
+			return 0
+		}
+		if len(ctx.Skipped) > 0 {
+			logEntry.ErrorPolicy = "skipped"
+			logEntry.ErrorMessage = strings.Join(ctx.Skipped, "; ")
+		}
+
+		// Drop or reject instead of forwarding
+		if ctx.Verdict != engine.VerdictAccept && ctx.Verdict != engine.VerdictPass {
+			dropPacket(nfq, packetID, ctx, &logEntry)
+			mirrorPackets(ctx.Mirrors, rawPacket, nil)
+			return 0
+		}
+
+		if ctx.Mark != nil {
+			logEntry.Mark = ctx.Mark.String()
+		}
+
+		// Held packets outlive this callback, so keep our own copy of the payload
+		original := rawPacket
+		if ctx.Delay > 0 {
+			original = append([]byte(nil), rawPacket...)
+			logEntry.DelayMs = int(ctx.Delay / time.Millisecond)
+		}
+
+		// Forward the original packet, e.g. when over a rate limit with exceed "pass"
+		if ctx.Verdict == engine.VerdictPass {
+			logEntry.Result = "passed"
+			logEntry.Verdict = ctx.Verdict
+			database.DB.Create(&logEntry)
+
+			// Earlier rewrites on the connection may still shift its sequence numbers
+			var adjusted []byte
+			if packet, ok := engine.AdjustTCPSequence(original, original); ok {
+				adjusted = packet
+			}
+
+			sendVerdict(ctx.Delay, func() {
+				if datagram != nil {
+					acceptUnmodified(nfq, packetID, original, datagram, currentMark)
+				} else if err := acceptPacket(nfq, queueNum, packetID, adjusted, ctx.Mark, currentMark); err != nil {
+					database.Logger.Error("Failed to set verdict",
+						zap.Uint32("packet_id", packetID),
+						zap.Error(err))
+				}
+				mirrorPackets(ctx.Mirrors, original, original)
+			})
 			return 0
 		}
 
@@ -256,7 +401,7 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 			logEntry.Result = "error"
 			logEntry.ErrorMessage = err.Error()
 			database.DB.Create(&logEntry)
-			nfq.SetVerdict(packetID, verdict)
+			acceptUnmodified(nfq, packetID, rawPacket, datagram, currentMark)
 			return 0
 		}
 
@@ -270,35 +415,213 @@ func handlePacket(attr nfqueue.Attribute, nfq *nfqueue.Nfqueue) int {
 		}
 		fieldValuesJSON, _ := json.Marshal(fieldComparison)
 		logEntry.FieldValues = string(fieldValuesJSON)
-		logEntry.ModifiedPacket = hex.EncodeToString(modifiedPacket)
-		logEntry.Result = "success"
 
-		// For modified packets, we need to set the verdict with the new packet data
-		err = nfq.SetVerdictModPacket(packetID, verdict, modifiedPacket)
+		// Keep the TCP connection consistent when the payload length changed
+		if adjusted, ok := engine.AdjustTCPSequence(rawPacket, modifiedPacket); ok {
+			modifiedPacket = adjusted
+		}
+
+		// Fault injection works on the final bytes
+		duplicates := 0
+		if ctx.HasFaults() {
+			faults, err := engine.ApplyFaults(ctx, modifiedPacket)
+			if err != nil {
+				database.Logger.Error("Failed to inject faults",
+					zap.String("rule", matchedRule.Name),
+					zap.Error(err))
+				logEntry.ErrorMessage = "fault injection failed: " + err.Error()
+			} else {
+				modifiedPacket = faults.Packet
+				duplicates = faults.Duplicates
+				logEntry.Faults = strings.Join(faults.Applied, "; ")
+			}
+		}
+		logEntry.FaultSeed = ctx.FaultSeed
+
+		// Packets that grew past the egress MTU are fragmented, or refused when DF is set.
+		// Reassembled datagrams leave in fragments no larger than those they arrived in.
+		if len(modifiedPacket) > len(rawPacket) || datagram != nil {
+			ctx.MTU = egressMTU(attr)
+		}
+		if datagram != nil && (ctx.MTU == 0 || datagram.FragmentSize() < ctx.MTU) {
+			ctx.MTU = datagram.FragmentSize()
+		}
+		sizing, err := engine.ApplyMTU(ctx, modifiedPacket)
+		// Fragments and duplicates go out through a raw socket and carry the mark the verdict would set
+		injectMark := currentMark
+		if ctx.Mark != nil {
+			injectMark = ctx.Mark.Apply(currentMark)
+			if ctx.Mark.Conntrack && (sizing.Fragments != nil || duplicates > 0) {
+				ctx.Warnings = append(ctx.Warnings, "conntrack mark is not set on fragments and duplicates")
+			}
+		}
+		logEntry.Warnings = strings.Join(ctx.Warnings, "; ")
+		logEntry.ModifiedPacket = hex.EncodeToString(modifiedPacket)
 		if err != nil {
-			database.Logger.Error("Failed to set verdict with modified packet",
-				zap.Uint32("packet_id", packetID),
-				zap.Error(err))
-			// Fallback to accepting original if modification fails
-			nfq.SetVerdict(packetID, verdict)
-		} else {
-			database.Logger.Info("Packet modified and sent",
+			database.Logger.Error("Failed to fit packet to MTU",
 				zap.String("rule", matchedRule.Name),
-				zap.Int("original_size", len(rawPacket)),
-				zap.Int("modified_size", len(modifiedPacket)))
+				zap.Int("mtu", ctx.MTU),
+				zap.Error(err))
+			// The rewritten packet can't leave, and the original would not match the TCP
+			// sequence shift already recorded for it
+			logEntry.Result = "error"
+			logEntry.ErrorMessage = "fragmentation failed: " + err.Error()
+			logEntry.Verdict = engine.VerdictDrop
+			database.DB.Create(&logEntry)
+			nfq.SetVerdict(packetID, nfqueue.NfDrop)
+			return 0
 		}
 
+		if sizing.Reply != nil {
+			if err := injectPacket(sizing.Reply); err != nil {
+				database.Logger.Error("Failed to send fragmentation-needed reply", zap.Error(err))
+				logEntry.ErrorMessage = "fragmentation-needed reply not sent: " + err.Error()
+			}
+			ctx.Verdict = engine.VerdictFragNeeded
+			dropPacket(nfq, packetID, ctx, &logEntry)
+			mirrorPackets(ctx.Mirrors, rawPacket, nil)
+			return 0
+		}
+		fragments := sizing.Fragments
+		logEntry.Fragments = len(fragments)
+
+		logEntry.Result = "success"
+
 		// Log the processing
 		database.DB.Create(&logEntry)
 
+		ruleName := matchedRule.Name
+		sendVerdict(ctx.Delay, func() {
+			// Fragments replace the packet
+			if fragments != nil {
+				sendFragments(nfq, packetID, fragments, duplicates, injectMark)
+				database.Logger.Info("Packet modified, fragmented and sent",
+					zap.String("rule", ruleName),
+					zap.Int("modified_size", len(modifiedPacket)),
+					zap.Int("fragments", len(fragments)))
+				mirrorPackets(ctx.Mirrors, original, modifiedPacket)
+				return
+			}
+
+			// For modified packets, we need to set the verdict with the new packet data
+			err := acceptPacket(nfq, queueNum, packetID, modifiedPacket, ctx.Mark, currentMark)
+			if err != nil {
+				database.Logger.Error("Failed to set verdict with modified packet",
+					zap.Uint32("packet_id", packetID),
+					zap.Error(err))
+				// Fallback to accepting original if modification fails
+				nfq.SetVerdict(packetID, verdict)
+			} else {
+				database.Logger.Info("Packet modified and sent",
+					zap.String("rule", ruleName),
+					zap.Int("original_size", len(original)),
+					zap.Int("modified_size", len(modifiedPacket)))
+			}
+
+			// Duplicates are sent as locally generated IPv4 or IPv6 packets
+			for i := 0; i < duplicates; i++ {
+				if err := injectPacketWithMark(modifiedPacket, injectMark); err != nil {
+					database.Logger.Error("Failed to send duplicate packet", zap.Error(err))
+					break
+				}
+			}
+
+			// Copies go out after the verdict so mirroring never delays the packet
+			mirrorPackets(ctx.Mirrors, original, modifiedPacket)
+		})
+
 		return 0
 	}
 
 	// No rule matched, pass through unchanged
-	nfq.SetVerdict(packetID, verdict)
+	acceptUnmodified(nfq, packetID, rawPacket, datagram, currentMark)
 	return 0
 }
 
+// sendVerdict issues a verdict now or, for packets held by delay actions, from a timer
+// so the queue keeps serving other packets in the meantime. Held packets count against
+// the kernel queue length.
+func sendVerdict(delay time.Duration, send func()) {
+	if delay <= 0 {
+		send()
+		return
+	}
+	time.AfterFunc(delay, send)
+}
+
+// dropPacket drops a packet blocked by a rule action, answering the sender for reject verdicts
+func dropPacket(nfq *nfqueue.Nfqueue, packetID uint32, ctx *engine.PacketContext, logEntry *models.ProcessLog) {
+	if err := nfq.SetVerdict(packetID, nfqueue.NfDrop); err != nil {
+		database.Logger.Error("Failed to set drop verdict",
+			zap.Uint32("packet_id", packetID),
+			zap.Error(err))
+	}
+
+	logEntry.Result = "dropped"
+	logEntry.Verdict = ctx.Verdict
+
+	if engine.IsReject(ctx.Verdict) {
+		reply, err := engine.BuildRejectPacket(ctx)
+		if err == nil {
+			err = injectPacket(reply)
+		}
+		if err != nil {
+			database.Logger.Error("Failed to send reject reply",
+				zap.String("verdict", ctx.Verdict),
+				zap.Error(err))
+			logEntry.ErrorMessage = "reject reply not sent: " + err.Error()
+		}
+	}
+
+	database.Logger.Info("Packet dropped",
+		zap.String("rule", logEntry.RuleName),
+		zap.String("verdict", ctx.Verdict))
+
+	database.DB.Create(logEntry)
+}
+
+// acceptUnmodified accepts a packet the rules didn't change, shifting its TCP sequence numbers
+// if earlier rewrites changed payload lengths on its connection. A reassembled datagram goes
+// out as the fragments it arrived in.
+func acceptUnmodified(nfq *nfqueue.Nfqueue, packetID uint32, rawPacket []byte, datagram *engine.Datagram, mark uint32) {
+	if datagram != nil {
+		fragments := datagram.Fragments
+		if adjusted, ok := engine.AdjustTCPSequence(rawPacket, rawPacket); ok {
+			if refragmented, err := engine.FragmentIPv4(adjusted, datagram.FragmentSize()); err == nil {
+				fragments = refragmented
+			}
+		}
+		sendFragments(nfq, packetID, fragments, 0, mark)
+		return
+	}
+
+	if adjusted, ok := engine.AdjustTCPSequence(rawPacket, rawPacket); ok {
+		if err := nfq.SetVerdictModPacket(packetID, nfqueue.NfAccept, adjusted); err == nil {
+			return
+		}
+	}
+	nfq.SetVerdict(packetID, nfqueue.NfAccept)
+}
+
+// sendFragments drops the queued packet and sends the fragments replacing it, plus the given
+// number of duplicate sets. They go out as locally generated packets carrying mark; the
+// conntrack mark can't be set this way.
+func sendFragments(nfq *nfqueue.Nfqueue, packetID uint32, fragments [][]byte, duplicates int, mark uint32) {
+	if err := nfq.SetVerdict(packetID, nfqueue.NfDrop); err != nil {
+		database.Logger.Error("Failed to drop fragmented packet",
+			zap.Uint32("packet_id", packetID),
+			zap.Error(err))
+	}
+	for i := 0; i <= duplicates; i++ {
+		for _, fragment := range fragments {
+			if err := injectPacketWithMark(fragment, mark); err != nil {
+				database.Logger.Error("Failed to send fragment", zap.Error(err))
+				return
+			}
+		}
+	}
+}
+
 func handleError(err error) int {
 	database.Logger.Error("NFQueue error", zap.Error(err))
 	return 0
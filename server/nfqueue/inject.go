@@ -0,0 +1,69 @@
+package nfqueue
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// rawSender is a raw socket sending locally built packets (reject replies and the like)
+// of one IP version
+type rawSender struct {
+	sync.Mutex
+	family int
+	fd     int
+	mark   uint32 // SO_MARK currently set on fd
+}
+
+var (
+	rawSocket4 = &rawSender{family: syscall.AF_INET}
+	rawSocket6 = &rawSender{family: syscall.AF_INET6}
+)
+
+// injectPacket sends a complete IPv4 or IPv6 packet, starting at the IP header, through a raw socket
+func injectPacket(packet []byte) error {
+	return injectPacketWithMark(packet, 0)
+}
+
+// injectPacketWithMark sends a packet like injectPacket with the given netfilter mark, so packets
+// replacing a queued one keep its mark
+func injectPacketWithMark(packet []byte, mark uint32) error {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		var dst syscall.SockaddrInet4
+		copy(dst.Addr[:], packet[16:20])
+		return rawSocket4.send(packet, mark, &dst)
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		var dst syscall.SockaddrInet6
+		copy(dst.Addr[:], packet[24:40])
+		return rawSocket6.send(packet, mark, &dst)
+	}
+	return fmt.Errorf("not an IP packet")
+}
+
+func (raw *rawSender) send(packet []byte, mark uint32, dst syscall.Sockaddr) error {
+	raw.Lock()
+	defer raw.Unlock()
+
+	if raw.fd <= 0 {
+		// IPPROTO_RAW implies IP_HDRINCL (IPV6_HDRINCL for IPv6), so the kernel sends our header as-is
+		fd, err := syscall.Socket(raw.family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+		if err != nil {
+			return fmt.Errorf("failed to open raw socket: %w", err)
+		}
+		raw.fd = fd
+		raw.mark = 0
+	}
+
+	if mark != raw.mark {
+		if err := syscall.SetsockoptInt(raw.fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+			return fmt.Errorf("failed to set mark 0x%x: %w", mark, err)
+		}
+		raw.mark = mark
+	}
+
+	if err := syscall.Sendto(raw.fd, packet, 0, dst); err != nil {
+		return fmt.Errorf("failed to send packet: %w", err)
+	}
+	return nil
+}
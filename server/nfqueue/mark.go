@@ -0,0 +1,77 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"packet-repackage/engine"
+
+	"github.com/florianl/go-nfqueue"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Netlink constants not exported by go-nfqueue
+const (
+	nfnlSubsysQueue = 3  // NFNL_SUBSYS_QUEUE
+	nfqnlMsgVerdict = 1  // NFQNL_MSG_VERDICT
+	nfqaVerdictHdr  = 2  // NFQA_VERDICT_HDR
+	nfqaMark        = 3  // NFQA_MARK
+	nfqaPayload     = 10 // NFQA_PAYLOAD
+	nfqaCt          = 11 // NFQA_CT
+	ctaMark         = 8  // CTA_MARK
+)
+
+// acceptPacket accepts a packet, replacing its payload unless packet is nil, and applies
+// the mark set by the rule. current is the packet's mark as received.
+func acceptPacket(nfq *nfqueue.Nfqueue, queueNum uint16, packetID uint32, packet []byte, mark *engine.PacketMark, current uint32) error {
+	switch {
+	case mark == nil && packet == nil:
+		return nfq.SetVerdict(packetID, nfqueue.NfAccept)
+	case mark == nil:
+		return nfq.SetVerdictModPacket(packetID, nfqueue.NfAccept, packet)
+	case mark.Conntrack:
+		return setVerdictWithConntrackMark(nfq, queueNum, packetID, packet, mark.Apply(current))
+	case packet == nil:
+		return nfq.SetVerdictWithMark(packetID, nfqueue.NfAccept, int(mark.Apply(current)))
+	default:
+		return nfq.SetVerdictModPacketWithMark(packetID, nfqueue.NfAccept, int(mark.Apply(current)), packet)
+	}
+}
+
+// setVerdictWithConntrackMark accepts the packet and sets both its mark and its connection's
+// mark. go-nfqueue cannot attach NFQA_CT, so the verdict message is built here. The kernel
+// only applies the conntrack mark when nf_conntrack_netlink is loaded.
+func setVerdictWithConntrackMark(nfq *nfqueue.Nfqueue, queueNum uint16, packetID uint32, packet []byte, mark uint32) error {
+	verdictHdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(verdictHdr[0:4], uint32(nfqueue.NfAccept))
+	binary.BigEndian.PutUint32(verdictHdr[4:8], packetID)
+
+	markData := binary.BigEndian.AppendUint32(nil, mark)
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(nfqaVerdictHdr, verdictHdr)
+	ae.Bytes(nfqaMark, markData)
+	ae.Nested(nfqaCt, func(nae *netlink.AttributeEncoder) error {
+		nae.Bytes(ctaMark, markData)
+		return nil
+	})
+	if packet != nil {
+		ae.Bytes(nfqaPayload, packet)
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	// struct nfgenmsg: family (as in Config.AfFamily), version, queue number (big endian)
+	data := []byte{unix.AF_INET, unix.NFNETLINK_V0, byte(queueNum >> 8), byte(queueNum)}
+	data = append(data, attrs...)
+
+	_, err = nfq.Con.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysQueue<<8 | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: data,
+	})
+	return err
+}
@@ -0,0 +1,230 @@
+package nfqueue
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"packet-repackage/database"
+	"packet-repackage/engine"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"go.uber.org/zap"
+)
+
+// MirrorConfig controls the mirror worker
+type MirrorConfig struct {
+	QueueSize   int   // Pending copies before new ones are dropped
+	PcapMaxSize int64 // Rotate pcap files larger than this many bytes (0 = never)
+	PcapKeep    int   // Rotated pcap files to keep (file.1 ... file.N)
+}
+
+var mirrorConfig = MirrorConfig{
+	QueueSize:   1024,
+	PcapMaxSize: 100 << 20,
+	PcapKeep:    5,
+}
+
+// SetMirrorConfig sets the mirror worker settings; call before Start
+func SetMirrorConfig(cfg MirrorConfig) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = mirrorConfig.QueueSize
+	}
+	mirrorConfig = cfg
+}
+
+type mirrorJob struct {
+	request engine.MirrorRequest
+	packet  []byte
+}
+
+var (
+	mirrorOnce sync.Once
+	mirrorJobs chan mirrorJob
+)
+
+// mirrorPackets queues the copies requested by mirror actions. It never blocks:
+// copies are dropped when the worker falls behind.
+func mirrorPackets(requests []engine.MirrorRequest, original, modified []byte) {
+	if len(requests) == 0 {
+		return
+	}
+
+	mirrorOnce.Do(func() {
+		mirrorJobs = make(chan mirrorJob, mirrorConfig.QueueSize)
+		go runMirrorWorker()
+	})
+
+	for _, request := range requests {
+		if request.Copy == engine.MirrorOriginal || request.Copy == engine.MirrorBoth {
+			queueMirror(request, original)
+		}
+		// Dropped packets have no modified copy
+		if (request.Copy == engine.MirrorModified || request.Copy == engine.MirrorBoth) && modified != nil {
+			queueMirror(request, modified)
+		}
+	}
+}
+
+func queueMirror(request engine.MirrorRequest, packet []byte) {
+	job := mirrorJob{request: request, packet: append([]byte(nil), packet...)}
+	select {
+	case mirrorJobs <- job:
+	default:
+		database.Logger.Warn("Mirror queue full, dropping copy",
+			zap.String("destination", request.Destination))
+	}
+}
+
+func runMirrorWorker() {
+	sockets := make(map[string]int)
+	sinks := make(map[string]*pcapSink)
+
+	for job := range mirrorJobs {
+		frame := ethernetFrame(job.packet)
+
+		var err error
+		switch job.request.Kind {
+		case engine.MirrorTargetInterface:
+			err = sendOnInterface(sockets, job.request.Destination, frame)
+		case engine.MirrorTargetPcap:
+			sink, ok := sinks[job.request.Destination]
+			if !ok {
+				sink = &pcapSink{path: job.request.Destination}
+				sinks[job.request.Destination] = sink
+			}
+			err = sink.write(frame)
+		}
+
+		if err != nil {
+			database.Logger.Error("Failed to mirror packet",
+				zap.String("kind", job.request.Kind),
+				zap.String("destination", job.request.Destination),
+				zap.Error(err))
+		}
+	}
+}
+
+// ethernetFrame wraps an IP packet, as delivered by NFQueue, in an Ethernet header
+// with zero MAC addresses so interfaces and pcap readers can take it
+func ethernetFrame(packet []byte) []byte {
+	etherType := uint16(layers.EthernetTypeIPv4)
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		etherType = uint16(layers.EthernetTypeIPv6)
+	}
+
+	frame := make([]byte, 14+len(packet))
+	frame[12] = byte(etherType >> 8)
+	frame[13] = byte(etherType)
+	copy(frame[14:], packet)
+	return frame
+}
+
+// sendOnInterface transmits a frame through an AF_PACKET socket bound to the interface
+func sendOnInterface(sockets map[string]int, name string, frame []byte) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	fd, ok := sockets[name]
+	if !ok {
+		// Protocol 0: send only, never receive
+		fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open packet socket: %w", err)
+		}
+		sockets[name] = fd
+	}
+
+	addr := syscall.SockaddrLinklayer{
+		Ifindex:  iface.Index,
+		Protocol: uint16(frame[12]) | uint16(frame[13])<<8, // Network byte order
+		Halen:    6,
+	}
+	return syscall.Sendto(fd, frame, 0, &addr)
+}
+
+// pcapSink appends frames to a pcap file, rotating it when it grows too large
+type pcapSink struct {
+	path   string
+	file   *os.File
+	writer *pcapgo.Writer
+	size   int64
+}
+
+func (s *pcapSink) write(frame []byte) error {
+	if s.file != nil && mirrorConfig.PcapMaxSize > 0 && s.size+int64(len(frame))+16 > mirrorConfig.PcapMaxSize {
+		s.file.Close()
+		s.file = nil
+		rotateFiles(s.path, mirrorConfig.PcapKeep)
+	}
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(frame),
+		Length:        len(frame),
+	}
+	if err := s.writer.WritePacket(ci, frame); err != nil {
+		return err
+	}
+	s.size += int64(len(frame)) + 16 // Record header
+	return nil
+}
+
+func (s *pcapSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	writer := pcapgo.NewWriter(file)
+	if info.Size() == 0 {
+		if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	s.file = file
+	s.writer = writer
+	s.size = info.Size()
+	if s.size == 0 {
+		s.size = 24 // File header
+	}
+	return nil
+}
+
+// rotateFiles shifts path -> path.1 -> path.2 ..., discarding the oldest beyond keep
+func rotateFiles(path string, keep int) {
+	if keep <= 0 {
+		os.Remove(path)
+		return
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	os.Rename(path, path+".1")
+}
@@ -0,0 +1,38 @@
+package nfqueue
+
+import (
+	"net"
+
+	"github.com/florianl/go-nfqueue"
+)
+
+// mtuOverride replaces the MTU of the output interface when set
+var mtuOverride int
+
+// SetMTU sets the egress MTU rewritten packets are checked against; 0 uses the MTU of
+// each packet's output interface. Call before Start.
+func SetMTU(mtu int) {
+	mtuOverride = mtu
+}
+
+// egressMTU returns the MTU of the port the packet leaves on, or 0 if unknown. Bridged
+// packets report the bridge as output device, so the physical port takes precedence.
+func egressMTU(attr nfqueue.Attribute) int {
+	if mtuOverride > 0 {
+		return mtuOverride
+	}
+
+	index := attr.OutDev
+	if attr.PhysOutDev != nil {
+		index = attr.PhysOutDev
+	}
+	if index == nil {
+		return 0
+	}
+
+	iface, err := net.InterfaceByIndex(int(*index))
+	if err != nil {
+		return 0
+	}
+	return iface.MTU
+}
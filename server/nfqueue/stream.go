@@ -0,0 +1,258 @@
+package nfqueue
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"packet-repackage/database"
+	"packet-repackage/engine"
+	"packet-repackage/models"
+	"strings"
+	"time"
+
+	"github.com/florianl/go-nfqueue"
+	"go.uber.org/zap"
+)
+
+// streamRule is a rule in stream mode with its parsed framing
+type streamRule struct {
+	rule   models.Rule
+	config *engine.StreamConfig
+}
+
+// splitStreamRules separates stream-mode rules from the rules matched per packet. Rules with an
+// invalid stream config are left out.
+func splitStreamRules(rules []models.Rule) ([]models.Rule, []streamRule) {
+	var packetRules []models.Rule
+	var streams []streamRule
+	for _, rule := range rules {
+		if rule.Stream == "" {
+			packetRules = append(packetRules, rule)
+			continue
+		}
+		config, err := engine.ParseStreamConfig(rule.Stream)
+		if err != nil {
+			database.Logger.Error("Ignoring rule with invalid stream config",
+				zap.String("rule", rule.Name),
+				zap.Error(err))
+			continue
+		}
+		streams = append(streams, streamRule{rule: rule, config: config})
+	}
+	return packetRules, streams
+}
+
+// handleStream feeds TCP segments of connections covered by stream-mode rules to their stream
+// and sends the rewritten messages. It returns false for segments to process as packets.
+// The highest priority rule covering a port defines the framing of its connections. Only IPv4
+// connections are reassembled: output segments beyond the first are sent through a raw IPv4 socket.
+func handleStream(nfq *nfqueue.Nfqueue, packetID uint32, rawPacket []byte, ctx *engine.PacketContext, fields []models.Field, streams []streamRule) bool {
+	if ctx.TCPLayer == nil || ctx.IPv4Layer == nil || len(streams) == 0 {
+		return false
+	}
+
+	srcPort, dstPort := int(ctx.TCPLayer.SrcPort), int(ctx.TCPLayer.DstPort)
+	var config *engine.StreamConfig
+	var rules []streamRule
+	for _, stream := range streams {
+		if stream.config.MatchesPort(srcPort, dstPort) {
+			if config == nil {
+				config = stream.config
+			}
+			rules = append(rules, stream)
+		}
+	}
+	if config == nil {
+		return false
+	}
+
+	chunk, err := engine.FeedStream(rawPacket, config)
+	if err != nil {
+		database.Logger.Warn("Stream framing lost, processing the connection per packet",
+			zap.String("5-tuple", ctx.Get5Tuple()),
+			zap.Error(err))
+	}
+
+	switch chunk.Status {
+	case engine.StreamPass:
+		return false
+	case engine.StreamHold:
+		nfq.SetVerdict(packetID, nfqueue.NfDrop)
+		return true
+	case engine.StreamResend:
+		sendSegments(nfq, packetID, chunk.Segments)
+		return true
+	}
+
+	rewritten := make([][]byte, len(chunk.Messages))
+	for i := range chunk.Messages {
+		rewritten[i] = processMessage(chunk, i, fields, rules)
+	}
+
+	segments, err := engine.EmitStream(chunk, rewritten)
+	if err != nil {
+		database.Logger.Error("Failed to build stream segments", zap.Error(err))
+		nfq.SetVerdict(packetID, nfqueue.NfAccept)
+		return true
+	}
+	sendSegments(nfq, packetID, segments)
+	return true
+}
+
+// processMessage matches message i of a chunk against the stream rules and applies the first
+// that matches. Returns the message to send, nil if a rule dropped it. Only field rewrites,
+// drop verdicts and mirroring apply to messages; the verdict is issued for the segments.
+func processMessage(chunk engine.StreamChunk, i int, fields []models.Field, rules []streamRule) []byte {
+	message := chunk.Messages[i]
+	packet, err := chunk.MessagePacket(i)
+	if err != nil {
+		database.Logger.Error("Failed to build message packet", zap.Error(err))
+		return message
+	}
+	ctx, err := engine.ParsePacket(packet)
+	if err != nil {
+		database.Logger.Error("Failed to parse message packet", zap.Error(err))
+		return message
+	}
+	engine.ExtractAllFields(ctx, fields)
+
+	var matchedRule *models.Rule
+	for _, stream := range rules {
+		matched, err := engine.MatchRule(stream.rule, ctx, fields)
+		if err != nil {
+			database.Logger.Error("Failed to evaluate condition",
+				zap.String("rule", stream.rule.Name),
+				zap.Error(err))
+			continue
+		}
+		if matched {
+			matchedRule = &stream.rule
+			break
+		}
+	}
+	if matchedRule == nil {
+		return message
+	}
+
+	logEntry := models.ProcessLog{
+		ProcessedAt:    time.Now(),
+		OriginalPacket: hex.EncodeToString(packet),
+		RuleID:         matchedRule.ID,
+		RuleName:       matchedRule.Name,
+		Stream:         true,
+	}
+	tuple := ctx.FiveTuple()
+	logEntry.SrcIP = tuple.SrcIP
+	logEntry.DstIP = tuple.DstIP
+	logEntry.SrcPort = tuple.SrcPort
+	logEntry.DstPort = tuple.DstPort
+	logEntry.Protocol = tuple.Protocol
+
+	originalFields := make(map[string]interface{})
+	for k, v := range ctx.Fields {
+		originalFields[k] = v
+	}
+
+	if err := engine.ExecuteActions(matchedRule.Actions, ctx); err != nil {
+		database.Logger.Error("Failed to execute actions",
+			zap.String("rule", matchedRule.Name),
+			zap.Error(err))
+		logEntry.ErrorMessage = err.Error()
+
+		var actionErr *engine.ActionError
+		if errors.As(err, &actionErr) && actionErr.Policy == engine.OnErrorDrop {
+			logEntry.Result = "dropped"
+			logEntry.ErrorPolicy = "dropped"
+			logEntry.Verdict = engine.VerdictDrop
+			database.DB.Create(&logEntry)
+			return nil
+		}
+
+		logEntry.Result = "error"
+		logEntry.ErrorPolicy = "aborted"
+		database.DB.Create(&logEntry)
+		return message
+	}
+	if len(ctx.Skipped) > 0 {
+		logEntry.ErrorPolicy = "skipped"
+		logEntry.ErrorMessage = strings.Join(ctx.Skipped, "; ")
+	}
+
+	// Packet-level effects have no meaning for a single message
+	if ctx.Delay > 0 || ctx.Mark != nil || ctx.HasFaults() {
+		ctx.Warnings = append(ctx.Warnings, "delay, mark and fault actions are ignored in stream mode")
+	}
+
+	switch ctx.Verdict {
+	case engine.VerdictAccept:
+	case engine.VerdictPass:
+		logEntry.Result = "passed"
+		logEntry.Verdict = ctx.Verdict
+		database.DB.Create(&logEntry)
+		mirrorPackets(ctx.Mirrors, packet, packet)
+		return message
+	default:
+		// The message is cut from the stream; there is no packet to answer for reject verdicts
+		if engine.IsReject(ctx.Verdict) {
+			ctx.Warnings = append(ctx.Warnings, "reject replies are not sent in stream mode")
+		}
+		logEntry.Result = "dropped"
+		logEntry.Verdict = ctx.Verdict
+		logEntry.Warnings = strings.Join(ctx.Warnings, "; ")
+		database.DB.Create(&logEntry)
+		mirrorPackets(ctx.Mirrors, packet, nil)
+		return nil
+	}
+
+	modifiedPacket, err := engine.RepackagePacket(matchedRule.OutputOptions, ctx, fields)
+	if err == nil {
+		message, err = engine.MessageFromPacket(modifiedPacket)
+	}
+	if err != nil {
+		database.Logger.Error("Failed to repackage message",
+			zap.String("rule", matchedRule.Name),
+			zap.Error(err))
+		logEntry.Result = "error"
+		logEntry.ErrorMessage = err.Error()
+		database.DB.Create(&logEntry)
+		return chunk.Messages[i]
+	}
+
+	fieldComparison := make(map[string]map[string]interface{})
+	for k, v := range ctx.Fields {
+		fieldComparison[k] = map[string]interface{}{
+			"before": originalFields[k],
+			"after":  v,
+		}
+	}
+	fieldValuesJSON, _ := json.Marshal(fieldComparison)
+	logEntry.FieldValues = string(fieldValuesJSON)
+	logEntry.Warnings = strings.Join(ctx.Warnings, "; ")
+	logEntry.ModifiedPacket = hex.EncodeToString(modifiedPacket)
+	logEntry.Result = "success"
+	database.DB.Create(&logEntry)
+
+	mirrorPackets(ctx.Mirrors, packet, modifiedPacket)
+	return message
+}
+
+// sendSegments replaces the queued segment with the first of the output segments and sends the
+// rest as locally generated packets
+func sendSegments(nfq *nfqueue.Nfqueue, packetID uint32, segments [][]byte) {
+	if len(segments) == 0 {
+		nfq.SetVerdict(packetID, nfqueue.NfDrop)
+		return
+	}
+	if err := nfq.SetVerdictModPacket(packetID, nfqueue.NfAccept, segments[0]); err != nil {
+		database.Logger.Error("Failed to set verdict with stream segment",
+			zap.Uint32("packet_id", packetID),
+			zap.Error(err))
+		nfq.SetVerdict(packetID, nfqueue.NfDrop)
+	}
+	for _, segment := range segments[1:] {
+		if err := injectPacket(segment); err != nil {
+			database.Logger.Error("Failed to send stream segment", zap.Error(err))
+			return
+		}
+	}
+}
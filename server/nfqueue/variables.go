@@ -0,0 +1,128 @@
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"packet-repackage/database"
+	"packet-repackage/engine"
+	"packet-repackage/models"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// flowVariableIdle is how long a flow variable lives without updates
+const flowVariableIdle = 10 * time.Minute
+
+// LoadVariables restores persisted variables into the engine
+func LoadVariables() error {
+	var stored []models.Variable
+	if err := database.DB.Find(&stored).Error; err != nil {
+		return fmt.Errorf("failed to load variables: %w", err)
+	}
+
+	list := make([]engine.Variable, 0, len(stored))
+	for _, s := range stored {
+		value, err := decodeVariableValue(s.Value)
+		if err != nil {
+			database.Logger.Warn("Skipping unreadable variable",
+				zap.String("name", s.Name), zap.Error(err))
+			continue
+		}
+		list = append(list, engine.Variable{
+			Scope:     s.Scope,
+			Owner:     s.Owner,
+			Name:      s.Name,
+			Value:     value,
+			UpdatedAt: s.UpdatedAt,
+		})
+	}
+
+	engine.LoadVariables(list)
+	database.Logger.Info("Variables loaded", zap.Int("count", len(list)))
+	return nil
+}
+
+// RunVariableMaintenance periodically saves changed persistent variables and
+// expires idle flow variables. It never returns; run it in a goroutine.
+func RunVariableMaintenance(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired := engine.ExpireFlowVariables(flowVariableIdle)
+		for _, v := range expired {
+			if !v.Persist {
+				continue
+			}
+			if err := DeleteStoredVariables(v.Scope, v.Owner, v.Name); err != nil {
+				database.Logger.Error("Failed to delete expired variable",
+					zap.String("name", v.Name), zap.Error(err))
+			}
+		}
+
+		if err := FlushVariables(); err != nil {
+			database.Logger.Error("Failed to save variables", zap.Error(err))
+		}
+	}
+}
+
+// FlushVariables writes persistent variables changed since the last flush
+func FlushVariables() error {
+	changed := engine.TakeDirtyVariables()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	rows := make([]models.Variable, 0, len(changed))
+	for _, v := range changed {
+		value, err := json.Marshal(v.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode variable %s: %w", v.Name, err)
+		}
+		rows = append(rows, models.Variable{Scope: v.Scope, Owner: v.Owner, Name: v.Name, Value: string(value)})
+	}
+
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "scope"}, {Name: "owner"}, {Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at"}),
+	}).CreateInBatches(rows, 500).Error
+}
+
+// DeleteStoredVariables removes persisted variables; empty arguments match everything
+func DeleteStoredVariables(scope, owner, name string) error {
+	query := database.DB.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped()
+	if scope != "" {
+		query = query.Where("scope = ?", scope)
+	}
+	if owner != "" {
+		query = query.Where("owner = ?", owner)
+	}
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	return query.Delete(&models.Variable{}).Error
+}
+
+// decodeVariableValue decodes a stored value, keeping integers as int64
+func decodeVariableValue(raw string) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	if n, ok := value.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, _ := n.Float64()
+		return f, nil
+	}
+	return value, nil
+}
@@ -52,6 +52,13 @@ if [ "$EUID" -eq 0 ]; then
     else
         echo "Warning: /proc/sys/net/bridge/bridge-nf-call-iptables not found. Bridge traffic may not be intercepted."
     fi
+
+    if [ -f "/proc/sys/net/bridge/bridge-nf-call-ip6tables" ]; then
+        if [ "$(sysctl -n net.bridge.bridge-nf-call-ip6tables)" -ne 1 ]; then
+            echo "Enabling bridge-nf-call-ip6tables..."
+            sysctl -w net.bridge.bridge-nf-call-ip6tables=1
+        fi
+    fi
 fi
 
 # Check and enable IP IP forwarding if running as root